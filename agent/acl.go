@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/hashicorp/hcl"
+)
+
+// aclAny matches every zone, product or env in an ACL rule.
+const aclAny = "*"
+
+// aclRule allows clients from networks to query service addresses in the
+// listed zones, products and envs. Empty lists match everything.
+type aclRule struct {
+	Networks []string `hcl:"networks"`
+	Zones    []string `hcl:"zones"`
+	Products []string `hcl:"products"`
+	Envs     []string `hcl:"envs"`
+
+	nets []*net.IPNet
+}
+
+// aclPolicy is the ACL configuration, e.g.:
+//
+//	default = "deny"
+//
+//	rule {
+//	  networks = ["10.1.0.0/16"]
+//	  envs     = ["prod"]
+//	}
+//
+// A query is allowed if any rule matching the client network allows it.
+// Queries of clients not matched by any rule fall back to the default, which
+// is "allow" unless set.
+type aclPolicy struct {
+	Default string    `hcl:"default"`
+	Rules   []aclRule `hcl:"rule"`
+}
+
+func parseACLPolicy(in string) (*aclPolicy, error) {
+	p := &aclPolicy{}
+	if err := hcl.Decode(p, in); err != nil {
+		return nil, err
+	}
+
+	switch p.Default {
+	case "":
+		p.Default = "allow"
+	case "allow", "deny":
+	default:
+		return nil, fmt.Errorf("default %q is invalid", p.Default)
+	}
+
+	for i := range p.Rules {
+		r := &p.Rules[i]
+
+		nets, err := parseNetworks(r.Networks)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i, err)
+		}
+		r.nets = nets
+	}
+
+	return p, nil
+}
+
+// parseNetworks parses a non-empty list of CIDR networks.
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("no networks")
+	}
+
+	nets := make([]*net.IPNet, 0, len(networks))
+	for _, n := range networks {
+		_, ipNet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+// networksContain reports whether any of nets contains ip.
+func networksContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowed reports whether the client at ip may query the service address,
+// or, for an info with only a zone, the servers of the zone.
+func (p *aclPolicy) allowed(ip net.IP, i info) bool {
+	matched := false
+
+	for _, r := range p.Rules {
+		if !networksContain(r.nets, ip) {
+			continue
+		}
+		matched = true
+
+		if aclMatch(r.Zones, i.zone) &&
+			(i.product == "" || aclMatch(r.Products, i.product)) &&
+			(i.env == "" || aclMatch(r.Envs, i.env)) {
+			return true
+		}
+	}
+
+	return !matched && p.Default == "allow"
+}
+
+func aclMatch(patterns []string, v string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, p := range patterns {
+		if p == aclAny || p == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acl guards the DNS and HTTP handlers with the policy loaded from path,
+// which can be reloaded at runtime. A nil acl allows everything.
+type acl struct {
+	path string
+
+	mu     sync.RWMutex
+	policy *aclPolicy
+}
+
+func newACL(path string) (*acl, error) {
+	a := &acl{path: path}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// load replaces the policy with the one read from path. The current policy
+// stays in place if the file is invalid.
+func (a *acl) load() error {
+	b, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+
+	p, err := parseACLPolicy(string(b))
+	if err != nil {
+		return fmt.Errorf("invalid ACL %s: %s", a.path, err)
+	}
+
+	a.mu.Lock()
+	a.policy = p
+	a.mu.Unlock()
+
+	return nil
+}
+
+// allowed reports whether the client at ip may query i, which was asked for
+// as name. Denials are logged and counted per protocol.
+func (a *acl) allowed(protocol string, ip net.IP, i info, name string) bool {
+	if a == nil {
+		return true
+	}
+
+	a.mu.RLock()
+	p := a.policy
+	a.mu.RUnlock()
+
+	if p.allowed(ip, i) {
+		return true
+	}
+
+	aclDenials.WithLabelValues(protocol, i.zone).Inc()
+	logger.Printf("%s denied %s %s", protocol, ip, name)
+
+	return false
+}
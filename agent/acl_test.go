@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testACLPolicy = `
+default = "deny"
+
+rule {
+  networks = ["10.1.0.0/16", "10.2.0.0/16"]
+  envs     = ["prod"]
+}
+
+rule {
+  networks = ["10.3.0.0/16"]
+  zones    = ["gg"]
+  products = ["harpoon"]
+  envs     = ["*"]
+}
+`
+
+func TestParseACLPolicy(t *testing.T) {
+	p, err := parseACLPolicy(testACLPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := 2, len(p.Rules); want != got {
+		t.Fatalf("want %d rules, got %d", want, got)
+	}
+	if want, got := 2, len(p.Rules[0].nets); want != got {
+		t.Errorf("want %d networks, got %d", want, got)
+	}
+
+	j, err := parseACLPolicy(`{"rule": [{"networks": ["10.0.0.0/8"]}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "allow", j.Default; want != got {
+		t.Errorf("want default %s, got %s", want, got)
+	}
+
+	for _, in := range []string{
+		`default = "maybe"`,
+		`rule { envs = ["prod"] }`,
+		`rule { networks = ["10.0.0.0"] }`,
+	} {
+		if _, err := parseACLPolicy(in); err == nil {
+			t.Errorf("want error for %s", in)
+		}
+	}
+}
+
+func TestACLPolicyAllowed(t *testing.T) {
+	p, err := parseACLPolicy(testACLPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		prod    = info{service: "http", job: "api", env: "prod", product: "harpoon", zone: "gg"}
+		staging = info{service: "http", job: "api", env: "staging", product: "harpoon", zone: "gg"}
+		other   = info{service: "http", job: "api", env: "staging", product: "roshi", zone: "gg"}
+	)
+
+	for _, test := range []struct {
+		ip   string
+		i    info
+		want bool
+	}{
+		{"10.1.2.3", prod, true},
+		{"10.2.2.3", prod, true},
+		{"10.1.2.3", staging, false},
+		{"10.3.2.3", staging, true},
+		{"10.3.2.3", other, false},
+		{"10.3.2.3", info{zone: "gg"}, true},
+		{"10.3.2.3", info{zone: "tt"}, false},
+		{"10.1.2.3", info{zone: "tt"}, true},
+		{"192.168.1.1", prod, false},
+	} {
+		if got := p.allowed(net.ParseIP(test.ip), test.i); test.want != got {
+			t.Errorf("want %t for %s querying %s, got %t", test.want, test.ip, test.i.addr(), got)
+		}
+	}
+
+	open, err := parseACLPolicy(`rule { networks = ["10.1.0.0/16"] envs = ["prod"] }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !open.allowed(net.ParseIP("192.168.1.1"), staging) {
+		t.Errorf("want unmatched networks allowed by default")
+	}
+	if open.allowed(net.ParseIP("10.1.1.1"), staging) {
+		t.Errorf("want matched networks restricted to their rules")
+	}
+}
+
+func TestACLReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glimpse-acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		path = filepath.Join(dir, "acl.hcl")
+		ip   = net.ParseIP("10.1.2.3")
+		i    = info{service: "http", job: "api", env: "prod", product: "harpoon", zone: "gg"}
+	)
+
+	if err := ioutil.WriteFile(path, []byte(`default = "deny"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := newACL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.allowed("DNS", ip, i, i.addr()) {
+		t.Errorf("want query denied")
+	}
+
+	if err := ioutil.WriteFile(path, []byte(testACLPolicy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.load(); err != nil {
+		t.Fatal(err)
+	}
+	if !a.allowed("DNS", ip, i, i.addr()) {
+		t.Errorf("want query allowed after reload")
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`default = "maybe"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.load(); err == nil {
+		t.Fatal("want error for invalid policy")
+	}
+	if !a.allowed("DNS", ip, i, i.addr()) {
+		t.Errorf("want previous policy kept after failed reload")
+	}
+}
+
+func TestACLHandlers(t *testing.T) {
+	p, err := parseACLPolicy(testACLPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		a     = &acl{policy: p}
+		i     = info{service: "http", job: "api", env: "staging", product: "roshi", zone: "gg"}
+		store = &testStore{instances: map[info]instances{i: generateInstancesFromInfo(i)}}
+		m     = &dns.Msg{}
+		w     = &testWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.1.2.3")}}
+	)
+
+	m.SetQuestion("http.api.staging.roshi.gg.test.glimpse.io.", dns.TypeA)
+	newDNSHandler(store, dns.Fqdn("test.glimpse.io"), false, 0, a, nil).ServeDNS(w, m)
+
+	if want, got := dns.RcodeRefused, w.msg.Rcode; want != got {
+		t.Errorf(
+			"want rcode %s, got %s",
+			dns.RcodeToString[want],
+			dns.RcodeToString[got],
+		)
+	}
+
+	var (
+		rec = httptest.NewRecorder()
+		r   = httptest.NewRequest("GET", "/v1/instances/"+i.addr(), nil)
+	)
+	r.RemoteAddr = "10.1.2.3:4321"
+	instancesHandler(store, 0, a, nil).ServeHTTP(rec, r)
+
+	if want, got := http.StatusForbidden, rec.Code; want != got {
+		t.Errorf("want status %d, got %d", want, got)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// aliasMode is how an alias resolves to its targets.
+type aliasMode string
+
+const (
+	// aliasSample answers every lookup with the instances of a single target,
+	// picked by weight.
+	aliasSample aliasMode = "sample"
+	// aliasMix answers every lookup with instances of all targets, their
+	// number proportional to the weights.
+	aliasMix aliasMode = "mix"
+)
+
+// aliasTarget is a service address an alias resolves to.
+type aliasTarget struct {
+	Address string `json:"address"`
+	Weight  int    `json:"weight"`
+
+	info info
+}
+
+// alias is a service address resolving to weighted targets, stored as JSON
+// in Consul KV under <prefix>/<alias address>, e.g.:
+//
+//	{
+//	  "mode": "sample",
+//	  "targets": [
+//	    {"address": "http.api.prod.goku.gg", "weight": 90},
+//	    {"address": "http.api-v2.prod.goku.gg", "weight": 10}
+//	  ]
+//	}
+//
+// Targets must be in the zone, env and product of the alias, so the ACL and
+// views checked against the alias cover them. They are never resolved as
+// aliases themselves.
+type alias struct {
+	Address string        `json:"address"`
+	Mode    aliasMode     `json:"mode"`
+	Targets []aliasTarget `json:"targets"`
+}
+
+// parseAlias parses and validates the alias of the service address. The mode
+// defaults to aliasSample.
+func parseAlias(address string, b []byte) (alias, error) {
+	a := alias{}
+	if err := json.Unmarshal(b, &a); err != nil {
+		return alias{}, err
+	}
+	a.Address = address
+
+	ai, err := infoFromAddr(address)
+	if err != nil {
+		return alias{}, err
+	}
+
+	switch a.Mode {
+	case "":
+		a.Mode = aliasSample
+	case aliasSample, aliasMix:
+	default:
+		return alias{}, fmt.Errorf("mode %q is invalid", a.Mode)
+	}
+
+	if len(a.Targets) == 0 {
+		return alias{}, fmt.Errorf("no targets")
+	}
+
+	var (
+		total = 0
+		seen  = map[string]bool{}
+	)
+	for i := range a.Targets {
+		t := &a.Targets[i]
+
+		info, err := infoFromAddr(t.Address)
+		if err != nil {
+			return alias{}, fmt.Errorf("target %d: %s", i, err)
+		}
+		if t.Address == address {
+			return alias{}, fmt.Errorf("target %s is the alias itself", t.Address)
+		}
+		if info.zone != ai.zone || info.env != ai.env || info.product != ai.product {
+			return alias{}, fmt.Errorf("target %s is outside of zone, env or product of the alias", t.Address)
+		}
+		if seen[t.Address] {
+			return alias{}, fmt.Errorf("target %s defined twice", t.Address)
+		}
+		seen[t.Address] = true
+
+		if t.Weight < 0 {
+			return alias{}, fmt.Errorf("target %s: weight %d is invalid", t.Address, t.Weight)
+		}
+		total += t.Weight
+
+		t.info = info
+	}
+	if total == 0 {
+		return alias{}, fmt.Errorf("all weights are 0")
+	}
+
+	return a, nil
+}
+
+// aliasStore resolves the aliases stored in Consul KV under prefix to their
+// targets in the next store. It's meant to wrap the cache, so every lookup is
+// split on its own while the lookups of targets are cached. Aliases are
+// refreshed periodically, which makes the split adjustable at runtime.
+type aliasStore struct {
+	next   store
+	kv     *api.KV
+	prefix string
+	logger *log.Logger
+
+	// random returns a pseudo-random number in [0.0,1.0).
+	random func() float64
+
+	mu      sync.RWMutex
+	aliases map[info]alias
+}
+
+func newAliasStore(next store, kv *api.KV, prefix string, logger *log.Logger) *aliasStore {
+	return &aliasStore{
+		next:    next,
+		kv:      kv,
+		prefix:  strings.Trim(prefix, "/"),
+		logger:  logger,
+		random:  rand.Float64,
+		aliases: map[info]alias{},
+	}
+}
+
+func (s *aliasStore) getInstances(ctx context.Context, i info) (instances, error) {
+	a, ok := s.lookup(i)
+	if !ok {
+		return s.next.getInstances(ctx, i)
+	}
+
+	return s.resolve(a, func(t info) (instances, error) {
+		return s.next.getInstances(ctx, t)
+	})
+}
+
+func (s *aliasStore) getInstancesByHealth(ctx context.Context, i info, h health) (instances, error) {
+	a, ok := s.lookup(i)
+	if !ok {
+		return s.next.getInstancesByHealth(ctx, i, h)
+	}
+
+	return s.resolve(a, func(t info) (instances, error) {
+		return s.next.getInstancesByHealth(ctx, t, h)
+	})
+}
+
+func (s *aliasStore) getServers(ctx context.Context, zone string) (instances, error) {
+	return s.next.getServers(ctx, zone)
+}
+
+func (s *aliasStore) lookup(i info) (alias, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	a, ok := s.aliases[i]
+	return a, ok
+}
+
+// resolve returns the instances of the alias, looking up targets with get.
+func (s *aliasStore) resolve(a alias, get func(info) (instances, error)) (instances, error) {
+	if a.Mode == aliasMix {
+		return s.mix(a, get)
+	}
+
+	return s.sample(a, get)
+}
+
+// sample answers with the instances of a target picked by weight. Targets
+// without instances are left out and another one is picked.
+func (s *aliasStore) sample(a alias, get func(info) (instances, error)) (instances, error) {
+	var (
+		targets = append([]aliasTarget{}, a.Targets...)
+		failed  error
+	)
+
+	for len(targets) > 0 {
+		total := 0
+		for _, t := range targets {
+			total += t.Weight
+		}
+		if total == 0 {
+			break
+		}
+
+		var (
+			n      = s.random() * float64(total)
+			picked = 0
+		)
+		for ; picked < len(targets)-1; picked++ {
+			n -= float64(targets[picked].Weight)
+			if n < 0 {
+				break
+			}
+		}
+		t := targets[picked]
+
+		is, err := get(t.info)
+		if err == nil {
+			aliasHits.WithLabelValues(a.Address, t.Address).Inc()
+			return is, nil
+		}
+		if !isNoInstances(err) {
+			return nil, err
+		}
+
+		failed = err
+		targets = append(targets[:picked], targets[picked+1:]...)
+	}
+
+	if failed == nil {
+		failed = newError(errNoInstances, "found for alias %s", a.Address)
+	}
+
+	return nil, failed
+}
+
+// mix answers with instances of all targets, as many of each as its weight
+// allows given the instances of the other targets. Fractions are rounded at
+// random, so the shares of targets with few instances are kept on average.
+// Failing targets are left out, unless no instances are left.
+func (s *aliasStore) mix(a alias, get func(info) (instances, error)) (instances, error) {
+	// The target with the fewest instances for its weight limits the shares
+	// of all targets. Its ratio is kept as integers, so it's answered with
+	// exactly all of its instances.
+	var (
+		found  = make([]instances, len(a.Targets))
+		num    = 0
+		den    = 0
+		failed error
+	)
+
+	for i, t := range a.Targets {
+		if t.Weight == 0 {
+			continue
+		}
+
+		is, err := get(t.info)
+		if err != nil {
+			if !isNoInstances(err) || failed == nil {
+				failed = err
+			}
+			continue
+		}
+
+		found[i] = is
+		if den == 0 || len(is)*den < num*t.Weight {
+			num, den = len(is), t.Weight
+		}
+	}
+
+	res := instances{}
+	for i, t := range a.Targets {
+		is := found[i]
+		if len(is) == 0 {
+			continue
+		}
+
+		n := t.Weight * num / den
+		if s.random() < float64(t.Weight*num%den)/float64(den) {
+			n++
+		}
+		if n > len(is) {
+			n = len(is)
+		}
+		if n == 0 {
+			continue
+		}
+
+		for _, j := range rand.Perm(len(is))[:n] {
+			res = append(res, is[j])
+		}
+		aliasHits.WithLabelValues(a.Address, t.Address).Inc()
+	}
+
+	if len(res) == 0 {
+		if failed == nil {
+			failed = newError(errNoInstances, "found for alias %s", a.Address)
+		}
+		return nil, failed
+	}
+
+	return res, nil
+}
+
+// refresh replaces the aliases with the ones stored in Consul. Invalid
+// aliases are logged and left out.
+func (s *aliasStore) refresh() error {
+	pairs, _, err := s.kv.List(s.prefix+"/", nil)
+	if err != nil {
+		return consulError(err)
+	}
+
+	aliases := map[info]alias{}
+	for _, p := range pairs {
+		address := strings.TrimPrefix(p.Key, s.prefix+"/")
+
+		a, err := parseAlias(address, p.Value)
+		if err != nil {
+			s.logger.Printf("[warning] invalid alias %s: %s", p.Key, err)
+			continue
+		}
+
+		// parseAlias validated the address.
+		i, _ := infoFromAddr(address)
+		aliases[i] = a
+	}
+
+	s.mu.Lock()
+	s.aliases = aliases
+	s.mu.Unlock()
+
+	return nil
+}
+
+// run refreshes the aliases every interval.
+func (s *aliasStore) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.refresh(); err != nil {
+			s.logger.Printf("[warning] aliases not refreshed: %s", err)
+		}
+	}
+}
+
+// list returns all aliases ordered by address.
+func (s *aliasStore) list() []alias {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]alias, 0, len(s.aliases))
+	for _, a := range s.aliases {
+		res = append(res, a)
+	}
+	sort.Sort(aliasesByAddress(res))
+
+	return res
+}
+
+type aliasesByAddress []alias
+
+func (a aliasesByAddress) Len() int           { return len(a) }
+func (a aliasesByAddress) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a aliasesByAddress) Less(i, j int) bool { return a[i].Address < a[j].Address }
+
+// aliasesHandler answers GET /v1/aliases with all aliases and their targets.
+func aliasesHandler(s *aliasStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		httpJSON(w, s.list())
+	})
+}
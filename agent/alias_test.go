@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const testAlias = `{
+  "mode": "%s",
+  "targets": [
+    {"address": "http.api.prod.goku.gg", "weight": 90},
+    {"address": "http.api-v2.prod.goku.gg", "weight": 10}
+  ]
+}`
+
+func TestParseAlias(t *testing.T) {
+	a, err := parseAlias("http.web.prod.goku.gg", []byte(fmt.Sprintf(testAlias, "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := aliasSample, a.Mode; want != got {
+		t.Errorf("want default mode %s, got %s", want, got)
+	}
+	if want, got := "api-v2", a.Targets[1].info.job; want != got {
+		t.Errorf("want target job %s, got %s", want, got)
+	}
+
+	for _, in := range []string{
+		`{"targets": [{"address": "http.api.prod.goku.gg", "weight": 1}`,
+		`{"mode": "split", "targets": [{"address": "http.api.prod.goku.gg", "weight": 1}]}`,
+		`{"targets": []}`,
+		`{"targets": [{"address": "http.api.prod.goku", "weight": 1}]}`,
+		`{"targets": [{"address": "http.web.prod.goku.gg", "weight": 1}]}`,
+		`{"targets": [{"address": "http.api.prod.goku.tt", "weight": 1}]}`,
+		`{"targets": [{"address": "http.api.qa.goku.gg", "weight": 1}]}`,
+		`{"targets": [{"address": "http.api.prod.roshi.gg", "weight": 1}]}`,
+		`{"targets": [{"address": "http.api.prod.goku.gg", "weight": 1}, {"address": "http.api.prod.goku.gg", "weight": 1}]}`,
+		`{"targets": [{"address": "http.api.prod.goku.gg", "weight": -1}]}`,
+		`{"targets": [{"address": "http.api.prod.goku.gg", "weight": 0}]}`,
+	} {
+		if _, err := parseAlias("http.web.prod.goku.gg", []byte(in)); err == nil {
+			t.Errorf("want error for %s", in)
+		}
+	}
+}
+
+func testAliasStore(t *testing.T, mode aliasMode, next store, random float64) (*aliasStore, info) {
+	a, err := parseAlias("http.web.prod.goku.gg", []byte(fmt.Sprintf(testAlias, mode)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := infoFromAddr(a.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newAliasStore(next, nil, "glimpse/aliases", log.New(ioutil.Discard, "", 0))
+	s.aliases[i] = a
+	s.random = func() float64 { return random }
+
+	return s, i
+}
+
+// aliasTargetInstances returns n instances of the target named by host.
+func aliasTargetInstances(host string, n int) instances {
+	is := instances{}
+	for i := 0; i < n; i++ {
+		is = append(is, instance{host: host, ip: net.ParseIP(fmt.Sprintf("10.0.0.%d", i+1)), port: 80})
+	}
+	return is
+}
+
+func countHosts(is instances) map[string]int {
+	counts := map[string]int{}
+	for _, i := range is {
+		counts[i.host]++
+	}
+	return counts
+}
+
+func TestAliasStoreSample(t *testing.T) {
+	var (
+		ctx = context.Background()
+		v1  = info{service: "http", job: "api", env: "prod", product: "goku", zone: "gg"}
+		v2  = info{service: "http", job: "api-v2", env: "prod", product: "goku", zone: "gg"}
+
+		next = &testStore{instances: map[info]instances{
+			v1: aliasTargetInstances("api", 2),
+			v2: aliasTargetInstances("v2", 2),
+		}}
+	)
+
+	for random, want := range map[float64]string{0.05: "api", 0.89: "api", 0.9: "v2", 0.99: "v2"} {
+		s, alias := testAliasStore(t, aliasSample, next, random)
+
+		is, err := s.getInstances(ctx, alias)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := countHosts(is); got[want] != 2 || len(got) != 1 {
+			t.Errorf("want instances of %s for %v, got %v", want, random, got)
+		}
+	}
+
+	// Targets without instances are left out.
+	s, alias := testAliasStore(t, aliasSample, &testStore{instances: map[info]instances{
+		v2: aliasTargetInstances("v2", 2),
+	}}, 0.05)
+	is, err := s.getInstancesByHealth(ctx, alias, healthAny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := countHosts(is); got["v2"] != 2 {
+		t.Errorf("want instances of remaining target, got %v", got)
+	}
+
+	s, alias = testAliasStore(t, aliasSample, &testStore{}, 0.05)
+	if _, err := s.getInstances(ctx, alias); !isNoInstances(err) {
+		t.Errorf("want no instances without any target, got %v", err)
+	}
+
+	s, alias = testAliasStore(t, aliasSample, &brokenStore{}, 0.05)
+	if _, err := s.getInstances(ctx, alias); !isConsulAPI(err) {
+		t.Errorf("want error of failing target, got %v", err)
+	}
+
+	// Other service addresses aren't touched.
+	if is, err := s.getInstances(ctx, v1); err == nil || len(is) != 0 {
+		t.Errorf("want lookup of target passed through, got %v, %v", is, err)
+	}
+}
+
+func TestAliasStoreMix(t *testing.T) {
+	var (
+		ctx = context.Background()
+		v1  = info{service: "http", job: "api", env: "prod", product: "goku", zone: "gg"}
+		v2  = info{service: "http", job: "api-v2", env: "prod", product: "goku", zone: "gg"}
+
+		next = &testStore{instances: map[info]instances{
+			v1: aliasTargetInstances("api", 9),
+			v2: aliasTargetInstances("v2", 5),
+		}}
+	)
+
+	// 9 instances of api at weight 90 allow exactly 1 instance of v2.
+	s, alias := testAliasStore(t, aliasMix, next, 0.5)
+	is, err := s.getInstances(ctx, alias)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := countHosts(is); got["api"] != 9 || got["v2"] != 1 {
+		t.Errorf("want 9 api and 1 v2 instances, got %v", got)
+	}
+
+	// With too few instances of api, fractions of v2 are rounded at random.
+	next.instances[v1] = aliasTargetInstances("api", 4)
+	for random, want := range map[float64]int{0.1: 1, 0.9: 0} {
+		s, alias := testAliasStore(t, aliasMix, next, random)
+
+		is, err := s.getInstances(ctx, alias)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := countHosts(is); got["api"] != 4 || got["v2"] != want {
+			t.Errorf("want 4 api and %d v2 instances for %v, got %v", want, random, got)
+		}
+	}
+
+	// Targets without instances are left out.
+	delete(next.instances, v1)
+	is, err = s.getInstances(ctx, alias)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := countHosts(is); got["v2"] != 5 {
+		t.Errorf("want all v2 instances, got %v", got)
+	}
+
+	s, alias = testAliasStore(t, aliasMix, &brokenStore{}, 0.5)
+	if _, err := s.getInstances(ctx, alias); !isConsulAPI(err) {
+		t.Errorf("want error of failing targets, got %v", err)
+	}
+}
+
+func TestAliasStoreRefresh(t *testing.T) {
+	kv, stub := setupStubKV(t)
+	defer stub.Close()
+
+	put := func(key, value string) {
+		if _, err := kv.Put(&api.KVPair{Key: key, Value: []byte(value)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("glimpse/aliases/http.web.prod.goku.gg", fmt.Sprintf(testAlias, aliasMix))
+	put("glimpse/aliases/http.invalid.prod.goku.gg", `{"targets": []}`)
+
+	s := newAliasStore(&testStore{}, kv, "glimpse/aliases/", log.New(ioutil.Discard, "", 0))
+	if err := s.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	aliasesHandler(s).ServeHTTP(w, httptest.NewRequest("GET", "/v1/aliases", nil))
+
+	as := []alias{}
+	if err := json.NewDecoder(w.Body).Decode(&as); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(as); want != got {
+		t.Fatalf("want %d alias, got %d", want, got)
+	}
+	if want, got := "http.web.prod.goku.gg", as[0].Address; want != got {
+		t.Errorf("want alias %s, got %s", want, got)
+	}
+	if want, got := aliasMix, as[0].Mode; want != got {
+		t.Errorf("want mode %s, got %s", want, got)
+	}
+
+	// Changed weights apply after the next refresh.
+	put("glimpse/aliases/http.web.prod.goku.gg", `{"targets": [{"address": "http.api-v2.prod.goku.gg", "weight": 1}]}`)
+	if err := s.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(s.list()[0].Targets); want != got {
+		t.Errorf("want %d target after refresh, got %d", want, got)
+	}
+
+	w = httptest.NewRecorder()
+	aliasesHandler(s).ServeHTTP(w, httptest.NewRequest("PUT", "/v1/aliases", nil))
+	if want, got := http.StatusMethodNotAllowed, w.Code; want != got {
+		t.Errorf("want status %d, got %d", want, got)
+	}
+}
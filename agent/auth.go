@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/hcl"
+)
+
+// role is the level of access to the HTTP API, each role includes the ones
+// below it.
+type role int
+
+const (
+	roleNone role = iota
+	// roleRead allows queries, like instances and metrics.
+	roleRead
+	// roleWrite allows changes to the services of the identity's providers.
+	roleWrite
+	// roleAdmin allows everything, including debug endpoints.
+	roleAdmin
+)
+
+var roleNames = map[string]role{
+	"read":  roleRead,
+	"write": roleWrite,
+	"admin": roleAdmin,
+}
+
+func (r role) String() string {
+	switch r {
+	case roleRead:
+		return "read"
+	case roleWrite:
+		return "write"
+	case roleAdmin:
+		return "admin"
+	default:
+		return "none"
+	}
+}
+
+// authIdentity grants a role to clients presenting a verified certificate
+// with the name as common name, or the token as bearer token.
+type authIdentity struct {
+	Name      string   `hcl:"name"`
+	Role      string   `hcl:"role"`
+	Token     string   `hcl:"token"`
+	Providers []string `hcl:"providers"`
+
+	role role
+}
+
+// authConfig is the HTTP API authorization configuration, e.g.:
+//
+//	identity {
+//	  name      = "provider-harpoon"
+//	  role      = "write"
+//	  providers = ["harpoon"]
+//	}
+//
+//	identity {
+//	  name  = "prometheus"
+//	  role  = "read"
+//	  token = "secret"
+//	}
+type authConfig struct {
+	Identities []authIdentity `hcl:"identity"`
+}
+
+func parseAuthConfig(in string) (*authConfig, error) {
+	c := &authConfig{}
+	if err := hcl.Decode(c, in); err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for i := range c.Identities {
+		id := &c.Identities[i]
+
+		if id.Name == "" {
+			return nil, fmt.Errorf("identity %d: no name", i)
+		}
+		if names[id.Name] {
+			return nil, fmt.Errorf("identity %s defined twice", id.Name)
+		}
+		names[id.Name] = true
+
+		r, ok := roleNames[id.Role]
+		if !ok {
+			return nil, fmt.Errorf("identity %s: role %q is invalid", id.Name, id.Role)
+		}
+		id.role = r
+	}
+
+	return c, nil
+}
+
+// identify returns the identity of the client, nil if it's unknown.
+func (c *authConfig) identify(r *http.Request) *authIdentity {
+	if token := bearerToken(r); token != "" {
+		for i := range c.Identities {
+			id := &c.Identities[i]
+			if id.Token != "" &&
+				subtle.ConstantTimeCompare([]byte(id.Token), []byte(token)) == 1 {
+				return id
+			}
+		}
+		return nil
+	}
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	for i := range c.Identities {
+		if c.Identities[i].Name == cn {
+			return &c.Identities[i]
+		}
+	}
+
+	return nil
+}
+
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return ""
+	}
+
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+// permits reports whether the identity has the role, for writes scoped to
+// the provider if set.
+func (id *authIdentity) permits(required role, provider string) bool {
+	if id.role == roleAdmin {
+		return true
+	}
+	if id.role < required {
+		return false
+	}
+	if required != roleWrite || provider == "" {
+		return true
+	}
+
+	for _, p := range id.Providers {
+		if p == provider {
+			return true
+		}
+	}
+
+	return false
+}
+
+// httpPermission returns the role required for the request and, for writes,
+// the provider it's scoped to. Endpoints not listed require roleAdmin.
+func httpPermission(r *http.Request) (role, string) {
+	switch {
+	case r.URL.Path == "/metrics",
+		r.URL.Path == "/v1/flaps",
+		r.URL.Path == "/v1/status",
+		r.URL.Path == "/v1/aliases",
+		strings.HasPrefix(r.URL.Path, "/v1/instances/"):
+		return roleRead, ""
+	case strings.HasPrefix(r.URL.Path, "/v1/drain"):
+		return drainPermission(r)
+	}
+
+	return roleAdmin, ""
+}
+
+// drainPermission allows listing drains to readers and draining providers to
+// the writers of the provider. Hosts and instances can only be drained by
+// admins.
+func drainPermission(r *http.Request) (role, string) {
+	if r.Method == "GET" {
+		return roleRead, ""
+	}
+
+	fields := strings.SplitN(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/drain"), "/"), "/", 2)
+	if len(fields) == 2 && fields[0] == "provider" {
+		return roleWrite, fields[1]
+	}
+
+	return roleAdmin, ""
+}
+
+// authorizer guards the HTTP API with the identities loaded from path, which
+// can be reloaded at runtime. A nil authorizer allows everything.
+type authorizer struct {
+	path string
+
+	mu     sync.RWMutex
+	config *authConfig
+}
+
+func newAuthorizer(path string) (*authorizer, error) {
+	a := &authorizer{path: path}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// load replaces the identities with the ones read from path. The current
+// identities stay in place if the file is invalid.
+func (a *authorizer) load() error {
+	b, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+
+	c, err := parseAuthConfig(string(b))
+	if err != nil {
+		return fmt.Errorf("invalid auth config %s: %s", a.path, err)
+	}
+
+	a.mu.Lock()
+	a.config = c
+	a.mu.Unlock()
+
+	return nil
+}
+
+// authHandler answers requests of unknown clients with 401 and of clients
+// without the required role with 403. Both are logged and counted.
+func authHandler(a *authorizer, next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required, provider := httpPermission(r)
+
+		a.mu.RLock()
+		id := a.config.identify(r)
+		a.mu.RUnlock()
+
+		switch {
+		case id == nil:
+			authDenials.WithLabelValues(required.String()).Inc()
+			logger.Printf("HTTP unauthenticated %s %s %s", httpClientIP(r), r.Method, r.URL.Path)
+
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		case !id.permits(required, provider):
+			authDenials.WithLabelValues(required.String()).Inc()
+			logger.Printf("HTTP unauthorized %s %s %s %s", id.Name, httpClientIP(r), r.Method, r.URL.Path)
+
+			http.Error(w, "forbidden", http.StatusForbidden)
+		default:
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id.Name)))
+		}
+	})
+}
+
+// identityKey is the context key of the name of the authenticated identity.
+type identityKey struct{}
+
+// httpIdentity returns the name of the identity of the request, or the client
+// IP if the HTTP API isn't guarded by an authorizer.
+func httpIdentity(r *http.Request) string {
+	if name, ok := r.Context().Value(identityKey{}).(string); ok {
+		return name
+	}
+
+	return httpClientIP(r).String()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testAuthConfig = `
+identity {
+  name      = "provider-harpoon"
+  role      = "write"
+  providers = ["harpoon"]
+}
+
+identity {
+  name  = "prometheus"
+  role  = "read"
+  token = "secret"
+}
+
+identity {
+  name  = "ops"
+  role  = "admin"
+  token = "admin-secret"
+}
+`
+
+func TestParseAuthConfig(t *testing.T) {
+	c, err := parseAuthConfig(testAuthConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 3, len(c.Identities); want != got {
+		t.Fatalf("want %d identities, got %d", want, got)
+	}
+	if want, got := roleWrite, c.Identities[0].role; want != got {
+		t.Errorf("want role %s, got %s", want, got)
+	}
+
+	for _, in := range []string{
+		`identity { role = "read" }`,
+		`identity { name = "a" role = "root" }`,
+		`identity { name = "a" role = "read" } identity { name = "a" role = "read" }`,
+	} {
+		if _, err := parseAuthConfig(in); err == nil {
+			t.Errorf("want error for %s", in)
+		}
+	}
+}
+
+func TestAuthHandler(t *testing.T) {
+	c, err := parseAuthConfig(testAuthConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		a  = &authorizer{config: c}
+		ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		h  = authHandler(a, ok)
+	)
+
+	withCert := func(r *http.Request, cn string) *http.Request {
+		r.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{
+				{{Subject: pkix.Name{CommonName: cn}}},
+			},
+		}
+		return r
+	}
+	withToken := func(r *http.Request, token string) *http.Request {
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+
+	for _, test := range []struct {
+		r    *http.Request
+		want int
+	}{
+		{httptest.NewRequest("GET", "/v1/instances/http.api.prod.harpoon.gg", nil), http.StatusUnauthorized},
+		{withToken(httptest.NewRequest("GET", "/metrics", nil), "wrong"), http.StatusUnauthorized},
+		{withCert(httptest.NewRequest("GET", "/metrics", nil), "unknown"), http.StatusUnauthorized},
+		{withToken(httptest.NewRequest("GET", "/metrics", nil), "secret"), http.StatusOK},
+		{withToken(httptest.NewRequest("GET", "/v1/drain", nil), "secret"), http.StatusOK},
+		{withToken(httptest.NewRequest("GET", "/v1/status", nil), "secret"), http.StatusOK},
+		{withToken(httptest.NewRequest("PUT", "/v1/drain/provider/harpoon", nil), "secret"), http.StatusForbidden},
+		{withToken(httptest.NewRequest("GET", "/debug/pprof/", nil), "secret"), http.StatusForbidden},
+		{withCert(httptest.NewRequest("GET", "/v1/instances/http.api.prod.harpoon.gg", nil), "provider-harpoon"), http.StatusOK},
+		{withCert(httptest.NewRequest("PUT", "/v1/drain/provider/harpoon", nil), "provider-harpoon"), http.StatusOK},
+		{withCert(httptest.NewRequest("DELETE", "/v1/drain/provider/harpoon", nil), "provider-harpoon"), http.StatusOK},
+		{withCert(httptest.NewRequest("PUT", "/v1/drain/provider/roshi", nil), "provider-harpoon"), http.StatusForbidden},
+		{withCert(httptest.NewRequest("PUT", "/v1/drain/host", nil), "provider-harpoon"), http.StatusForbidden},
+		{withCert(httptest.NewRequest("GET", "/debug/pprof/", nil), "provider-harpoon"), http.StatusForbidden},
+		{withToken(httptest.NewRequest("PUT", "/v1/drain/host", nil), "admin-secret"), http.StatusOK},
+		{withToken(httptest.NewRequest("GET", "/debug/pprof/", nil), "admin-secret"), http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, test.r)
+
+		if test.want != rec.Code {
+			t.Errorf("%s %s: want status %d, got %d", test.r.Method, test.r.URL.Path, test.want, rec.Code)
+		}
+	}
+
+	if authHandler(nil, ok) == nil {
+		t.Errorf("want handler without authorizer")
+	}
+}
+
+func TestHTTPIdentity(t *testing.T) {
+	c, err := parseAuthConfig(testAuthConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		got string
+		h   = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = httpIdentity(r)
+		})
+		r = httptest.NewRequest("PUT", "/v1/overrides/http.api.prod.harpoon.gg", nil)
+	)
+
+	authHandler(nil, h).ServeHTTP(httptest.NewRecorder(), r)
+	if want := "192.0.2.1"; want != got {
+		t.Errorf("want client IP %s without authorizer, got %s", want, got)
+	}
+
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	authHandler(&authorizer{config: c}, h).ServeHTTP(httptest.NewRecorder(), r)
+	if want := "ops"; want != got {
+		t.Errorf("want identity %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// defaultBackend labels the Consul agent of -consul.addr, serving all zones
+// without a backend of their own.
+const defaultBackend = "default"
+
+// backend is a Consul cluster serving a single srv zone, for zones whose
+// cluster isn't WAN-joined with the one of the local Consul agent.
+type backend struct {
+	zone       string
+	address    string
+	datacenter string
+}
+
+// parseBackends parses a comma separated list of backends in the format
+// zone=address[/datacenter], e.g. "tt=10.1.0.1:8500,ss=10.2.0.1:8500/ss1".
+// The datacenter defaults to the zone.
+func parseBackends(s string) ([]backend, error) {
+	var (
+		bs    = []backend{}
+		zones = map[string]bool{}
+	)
+
+	if s == "" {
+		return bs, nil
+	}
+
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid backend %q", field)
+		}
+
+		b := backend{zone: kv[0], address: kv[1], datacenter: kv[0]}
+		if i := strings.Index(b.address, "/"); i >= 0 {
+			b.address, b.datacenter = b.address[:i], b.address[i+1:]
+		}
+
+		if !rZone.MatchString(b.zone) {
+			return nil, fmt.Errorf("invalid backend zone %q", b.zone)
+		}
+		if b.address == "" || b.datacenter == "" {
+			return nil, fmt.Errorf("invalid backend %q", field)
+		}
+		if zones[b.zone] {
+			return nil, fmt.Errorf("backend for zone %s defined twice", b.zone)
+		}
+		zones[b.zone] = true
+
+		bs = append(bs, b)
+	}
+
+	return bs, nil
+}
+
+// zoneStore routes store calls by zone to the store of the zone's backend,
+// and calls for all other zones to the default store.
+type zoneStore struct {
+	def   store
+	zones map[string]store
+}
+
+func newZoneStore(def store, zones map[string]store) *zoneStore {
+	return &zoneStore{def: def, zones: zones}
+}
+
+func (s *zoneStore) route(zone string) store {
+	if z, ok := s.zones[zone]; ok {
+		return z
+	}
+
+	return s.def
+}
+
+func (s *zoneStore) getInstances(ctx context.Context, i info) (instances, error) {
+	return s.route(i.zone).getInstances(ctx, i)
+}
+
+func (s *zoneStore) getInstancesByHealth(ctx context.Context, i info, h health) (instances, error) {
+	return s.route(i.zone).getInstancesByHealth(ctx, i, h)
+}
+
+// getServers merges the servers of all backends if no zone is given, each
+// backend contributing the servers of its own zone. Failing backends are left
+// out, unless no servers are left.
+func (s *zoneStore) getServers(ctx context.Context, zone string) (instances, error) {
+	if zone != "" {
+		return s.route(zone).getServers(ctx, zone)
+	}
+
+	var (
+		merged = instances{}
+		seen   = map[string]bool{}
+		failed error
+	)
+
+	add := func(is instances, err error) {
+		if err != nil {
+			if !isNoInstances(err) && failed == nil {
+				failed = err
+			}
+			return
+		}
+
+		for _, i := range is {
+			if seen[i.ip.String()] {
+				continue
+			}
+			seen[i.ip.String()] = true
+			merged = append(merged, i)
+		}
+	}
+
+	add(s.def.getServers(ctx, ""))
+
+	zones := make([]string, 0, len(s.zones))
+	for z := range s.zones {
+		zones = append(zones, z)
+	}
+	sort.Strings(zones)
+
+	for _, z := range zones {
+		add(s.zones[z].getServers(ctx, z))
+	}
+
+	if len(merged) == 0 && failed != nil {
+		return nil, failed
+	}
+
+	return merged, nil
+}
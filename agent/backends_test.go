@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestParseBackends(t *testing.T) {
+	bs, err := parseBackends("tt=10.1.0.1:8500,ss=10.2.0.1:8500/ss1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []backend{
+		{zone: "tt", address: "10.1.0.1:8500", datacenter: "tt"},
+		{zone: "ss", address: "10.2.0.1:8500", datacenter: "ss1"},
+	}
+	if !reflect.DeepEqual(want, bs) {
+		t.Errorf("want backends %v, got %v", want, bs)
+	}
+
+	if bs, err := parseBackends(""); err != nil || len(bs) != 0 {
+		t.Errorf("want no backends, got %v, %v", bs, err)
+	}
+
+	for _, in := range []string{
+		"tt",
+		"tt=",
+		"ttt=10.1.0.1:8500",
+		"tt=10.1.0.1:8500/",
+		"tt=10.1.0.1:8500,tt=10.2.0.1:8500",
+	} {
+		if _, err := parseBackends(in); err == nil {
+			t.Errorf("want error for %s", in)
+		}
+	}
+}
+
+func TestZoneStore(t *testing.T) {
+	var (
+		gg = info{service: "http", job: "api", env: "prod", product: "harpoon", zone: "gg"}
+		tt = info{service: "http", job: "api", env: "prod", product: "harpoon", zone: "tt"}
+
+		server = func(host, ip string) instance {
+			return instance{host: host, ip: net.ParseIP(ip)}
+		}
+
+		def = &testStore{
+			instances: map[info]instances{gg: {server("gg", "10.0.0.1")}},
+			servers: map[string]instances{
+				"":   {server("ns-gg", "10.0.0.53"), server("ns-shared", "10.9.0.53")},
+				"gg": {server("ns-gg", "10.0.0.53")},
+			},
+		}
+		backend = &testStore{
+			instances: map[info]instances{tt: {server("tt", "10.1.0.1")}},
+			servers: map[string]instances{
+				"tt": {server("ns-tt", "10.1.0.53"), server("ns-shared", "10.9.0.53")},
+			},
+		}
+		s = newZoneStore(def, map[string]store{"tt": backend, "ss": &brokenStore{}})
+	)
+
+	for i, want := range map[info]string{gg: "gg", tt: "tt"} {
+		is, err := s.getInstances(context.Background(), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := is[0].host; want != got {
+			t.Errorf("want %s routed to %s, got %s", i.addr(), want, got)
+		}
+	}
+
+	is, err := s.getServers(context.Background(), "tt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(is); want != got {
+		t.Errorf("want %d servers of zone tt, got %d", want, got)
+	}
+
+	if _, err := s.getServers(context.Background(), "ss"); !isConsulAPI(err) {
+		t.Errorf("want error of failing backend, got %v", err)
+	}
+
+	is, err = s.getServers(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := []string{}
+	for _, i := range is {
+		hosts = append(hosts, i.host)
+	}
+	if want := []string{"ns-gg", "ns-shared", "ns-tt"}; !reflect.DeepEqual(want, hosts) {
+		t.Errorf("want merged servers %v, got %v", want, hosts)
+	}
+
+	failing := newZoneStore(&brokenStore{}, map[string]store{"ss": &brokenStore{}})
+	if _, err := failing.getServers(context.Background(), ""); !isConsulAPI(err) {
+		t.Errorf("want error without any servers, got %v", err)
+	}
+}
+
+func TestConsulStoreDatacenter(t *testing.T) {
+	dcs := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dcs <- r.URL.Query().Get("dc")
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	store := newConsulStore(&api.Config{
+		Address: strings.TrimPrefix(server.URL, "http://"),
+	}, log.New(ioutil.Discard, "", 0), 0, nil)
+	store.datacenter = "ss1"
+
+	store.getInstances(context.Background(), info{service: "http", job: "api", env: "prod", product: "harpoon", zone: "ss"})
+	if want, got := "ss1", <-dcs; want != got {
+		t.Errorf("want datacenter %s, got %s", want, got)
+	}
+}
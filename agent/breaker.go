@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// breakerState is the state of a breakerStore.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+var breakerStateNames = map[breakerState]string{
+	breakerClosed:   "closed",
+	breakerHalfOpen: "half-open",
+	breakerOpen:     "open",
+}
+
+func (s breakerState) String() string {
+	return breakerStateNames[s]
+}
+
+// breakerStore is a circuit breaker around the next store. It opens after
+// failures consecutive errConsulAPI failures and fails fast with
+// errCircuitOpen for cooldown. Afterwards a single probe is let through while
+// half-open, which closes the breaker on success and opens it again with a
+// doubled cooldown, bounded by maxCooldown, on failure.
+type breakerStore struct {
+	backend     string
+	next        store
+	failures    int
+	cooldown    time.Duration
+	maxCooldown time.Duration
+
+	// changed is called on every state transition.
+	changed func(from, to breakerState)
+
+	mu      sync.Mutex
+	now     func() time.Time
+	state   breakerState
+	failed  int
+	backoff time.Duration
+	until   time.Time
+	probing bool
+}
+
+func newBreakerStore(
+	backend string,
+	next store,
+	failures int,
+	cooldown, maxCooldown time.Duration,
+	changed func(from, to breakerState),
+) *breakerStore {
+	breakerStateGauge.WithLabelValues(backend).Set(float64(breakerClosed))
+
+	return &breakerStore{
+		backend:     backend,
+		next:        next,
+		failures:    failures,
+		cooldown:    cooldown,
+		maxCooldown: maxCooldown,
+		changed:     changed,
+		now:         time.Now,
+		backoff:     cooldown,
+	}
+}
+
+func (s *breakerStore) getInstances(ctx context.Context, i info) (instances, error) {
+	return s.call(func() (instances, error) {
+		return s.next.getInstances(ctx, i)
+	})
+}
+
+func (s *breakerStore) getInstancesByHealth(ctx context.Context, i info, h health) (instances, error) {
+	return s.call(func() (instances, error) {
+		return s.next.getInstancesByHealth(ctx, i, h)
+	})
+}
+
+func (s *breakerStore) getServers(ctx context.Context, zone string) (instances, error) {
+	return s.call(func() (instances, error) {
+		return s.next.getServers(ctx, zone)
+	})
+}
+
+func (s *breakerStore) call(fetch func() (instances, error)) (instances, error) {
+	probe, err := s.allow()
+	if err != nil {
+		breakerRejected.WithLabelValues(s.backend).Inc()
+		return nil, err
+	}
+
+	is, err := fetch()
+	s.done(probe, isConsulAPI(err))
+
+	return is, err
+}
+
+// allow reports whether a call may pass and whether it is the probe of a
+// half-open breaker.
+func (s *breakerStore) allow() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.state {
+	case breakerOpen:
+		if s.now().Before(s.until) {
+			return false, newError(errCircuitOpen, "retry in %s", s.until.Sub(s.now()))
+		}
+		s.transition(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if s.probing {
+			return false, newError(errCircuitOpen, "probe in flight")
+		}
+		s.probing = true
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (s *breakerStore) done(probe, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if probe {
+		s.probing = false
+
+		if failed {
+			s.backoff *= 2
+			if s.backoff > s.maxCooldown {
+				s.backoff = s.maxCooldown
+			}
+			s.open()
+			return
+		}
+
+		s.failed = 0
+		s.backoff = s.cooldown
+		s.transition(breakerClosed)
+		return
+	}
+
+	if !failed {
+		s.failed = 0
+		return
+	}
+
+	s.failed++
+	if s.state == breakerClosed && s.failed >= s.failures {
+		s.open()
+	}
+}
+
+func (s *breakerStore) open() {
+	s.failed = 0
+	s.until = s.now().Add(s.backoff)
+	s.transition(breakerOpen)
+}
+
+func (s *breakerStore) transition(to breakerState) {
+	from := s.state
+	if from == to {
+		return
+	}
+	s.state = to
+
+	breakerStateGauge.WithLabelValues(s.backend).Set(float64(to))
+	breakerTransitions.WithLabelValues(s.backend, to.String()).Inc()
+
+	if s.changed != nil {
+		s.changed(from, to)
+	}
+}
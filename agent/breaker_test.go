@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBreakerStore(t *testing.T) {
+	var (
+		srv  = info{env: "prod", job: "web", product: "harpoon", service: "http", zone: "gg"}
+		next = &outageStore{
+			up:   &testStore{instances: map[info]instances{srv: generateInstancesFromInfo(srv)}},
+			down: true,
+		}
+		counting    = &countingStore{next: next}
+		clock       = newTestClock()
+		transitions = []string{}
+		s           = newBreakerStore(defaultBackend, counting, 3, time.Second, 4*time.Second, func(from, to breakerState) {
+			transitions = append(transitions, from.String()+"->"+to.String())
+		})
+	)
+	s.now = clock.now
+
+	for i := 0; i < 3; i++ {
+		if _, err := s.getInstances(context.Background(), srv); !isConsulAPI(err) {
+			t.Fatalf("want consul API error, got %v", err)
+		}
+	}
+
+	// Open: fail fast without calling the next store.
+	if _, err := s.getServers(context.Background(), "gg"); !isCircuitOpen(err) {
+		t.Fatalf("want circuit open error, got %v", err)
+	}
+	if got, want := counting.calls, int32(3); got != want {
+		t.Errorf("want %d calls, got %d", want, got)
+	}
+
+	// Failed probe doubles the cooldown.
+	clock.add(time.Second)
+	if _, err := s.getInstances(context.Background(), srv); !isConsulAPI(err) {
+		t.Fatalf("want consul API error of probe, got %v", err)
+	}
+	clock.add(time.Second)
+	if _, err := s.getInstances(context.Background(), srv); !isCircuitOpen(err) {
+		t.Fatalf("want circuit open error within doubled cooldown, got %v", err)
+	}
+
+	// Successful probe closes the breaker.
+	clock.add(time.Second)
+	next.down = false
+	if _, err := s.getInstances(context.Background(), srv); err != nil {
+		t.Fatalf("want probe to pass, got %s", err)
+	}
+	if _, err := s.getInstances(context.Background(), srv); err != nil {
+		t.Fatalf("want closed breaker, got %s", err)
+	}
+
+	want := []string{
+		"closed->open",
+		"open->half-open",
+		"half-open->open",
+		"open->half-open",
+		"half-open->closed",
+	}
+	if !reflect.DeepEqual(want, transitions) {
+		t.Errorf("want transitions %v, got %v", want, transitions)
+	}
+}
+
+func TestBreakerStoreNonConsecutiveFailures(t *testing.T) {
+	var (
+		srv  = info{env: "prod", job: "web", product: "harpoon", service: "http", zone: "gg"}
+		next = &outageStore{
+			up: &testStore{instances: map[info]instances{srv: generateInstancesFromInfo(srv)}},
+		}
+		s = newBreakerStore(defaultBackend, next, 2, time.Second, time.Second, nil)
+	)
+
+	for i := 0; i < 5; i++ {
+		next.down = true
+		s.getInstances(context.Background(), srv)
+		next.down = false
+
+		if _, err := s.getInstances(context.Background(), srv); err != nil {
+			t.Fatalf("want breaker to stay closed, got %s", err)
+		}
+	}
+
+	// Missing instances are no failures of Consul.
+	for i := 0; i < 5; i++ {
+		if _, err := s.getInstances(context.Background(), info{}); !isNoInstances(err) {
+			t.Fatalf("want no instances error, got %v", err)
+		}
+	}
+}
+
+func TestBreakerStoreSingleProbe(t *testing.T) {
+	var (
+		srv  = info{env: "prod", job: "web", product: "harpoon", service: "http", zone: "gg"}
+		next = &countingStore{
+			next:    &testStore{instances: map[info]instances{srv: generateInstancesFromInfo(srv)}},
+			release: make(chan struct{}),
+		}
+		clock = newTestClock()
+		s     = newBreakerStore(defaultBackend, next, 1, time.Second, time.Second, nil)
+		done  = make(chan error)
+	)
+	s.now = clock.now
+
+	s.mu.Lock()
+	s.open()
+	s.mu.Unlock()
+	clock.add(time.Second)
+
+	go func() {
+		_, err := s.getInstances(context.Background(), srv)
+		done <- err
+	}()
+
+	for {
+		s.mu.Lock()
+		probing := s.probing
+		s.mu.Unlock()
+		if probing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := s.getInstances(context.Background(), srv); !isCircuitOpen(err) {
+		t.Errorf("want circuit open error while probing, got %v", err)
+	}
+
+	close(next.release)
+	if err := <-done; err != nil {
+		t.Errorf("want probe to pass, got %s", err)
+	}
+}
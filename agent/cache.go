@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// cachePrefetchWindow is the fraction of the TTL before expiry in which
+	// popular entries are refreshed in the background.
+	cachePrefetchWindow = 0.1
+
+	// cachePrefetchHits is the number of hits which make an entry popular.
+	cachePrefetchHits = 2
+)
+
+type cacheKey struct {
+	op     string
+	info   info
+	health health
+	zone   string
+}
+
+type cacheEntry struct {
+	is      instances
+	err     error
+	ttl     time.Duration
+	expires time.Time
+
+	hits        int
+	prefetching bool
+}
+
+// cacheCall is an in-flight lookup other lookups for the same key wait for.
+type cacheCall struct {
+	done chan struct{}
+	is   instances
+	err  error
+}
+
+// cachingStore caches results of the next store for ttl, and errNoInstances
+// results for negativeTTL. Stale results are cached no longer than staleTTL,
+// so fresh results are served soon after the store recovered. Concurrent
+// lookups of the same key are coalesced into one call to the next store.
+type cachingStore struct {
+	next        store
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	now     func() time.Time
+	swept   time.Time
+	entries map[cacheKey]*cacheEntry
+	calls   map[cacheKey]*cacheCall
+}
+
+func newCachingStore(next store, ttl, negativeTTL time.Duration) *cachingStore {
+	return &cachingStore{
+		next:        next,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		now:         time.Now,
+		entries:     map[cacheKey]*cacheEntry{},
+		calls:       map[cacheKey]*cacheCall{},
+	}
+}
+
+func (s *cachingStore) getInstances(ctx context.Context, i info) (instances, error) {
+	key := cacheKey{op: "getInstances", info: i}
+	return s.get(ctx, key, func(ctx context.Context) (instances, error) {
+		return s.next.getInstances(ctx, i)
+	})
+}
+
+func (s *cachingStore) getInstancesByHealth(ctx context.Context, i info, h health) (instances, error) {
+	key := cacheKey{op: "getInstancesByHealth", info: i, health: h}
+	return s.get(ctx, key, func(ctx context.Context) (instances, error) {
+		return s.next.getInstancesByHealth(ctx, i, h)
+	})
+}
+
+func (s *cachingStore) getServers(ctx context.Context, zone string) (instances, error) {
+	key := cacheKey{op: "getServers", zone: zone}
+	return s.get(ctx, key, func(ctx context.Context) (instances, error) {
+		return s.next.getServers(ctx, zone)
+	})
+}
+
+func (s *cachingStore) get(
+	ctx context.Context,
+	key cacheKey,
+	fetch func(context.Context) (instances, error),
+) (instances, error) {
+	s.mu.Lock()
+
+	now := s.now()
+	s.sweep(now)
+
+	if e, ok := s.entries[key]; ok && now.Before(e.expires) {
+		e.hits++
+
+		if !e.prefetching &&
+			e.hits >= cachePrefetchHits &&
+			e.expires.Sub(now) < time.Duration(float64(e.ttl)*cachePrefetchWindow) {
+			e.prefetching = true
+			cacheEvents.WithLabelValues("prefetch").Inc()
+
+			// Prefetches outlive the query triggering them.
+			go func(ttl time.Duration) {
+				ctx, cancel := context.WithTimeout(context.Background(), ttl)
+				defer cancel()
+
+				s.call(ctx, key, fetch)
+			}(e.ttl)
+		}
+
+		s.mu.Unlock()
+		cacheEvents.WithLabelValues("hit").Inc()
+
+		return copyInstances(e.is), e.err
+	}
+
+	c, ok := s.calls[key]
+	s.mu.Unlock()
+
+	if ok {
+		cacheEvents.WithLabelValues("coalesced").Inc()
+
+		select {
+		case <-c.done:
+			return copyInstances(c.is), c.err
+		case <-ctx.Done():
+			return nil, newError(errConsulAPI, "%s", ctx.Err())
+		}
+	}
+
+	cacheEvents.WithLabelValues("miss").Inc()
+	c = s.call(ctx, key, fetch)
+
+	return copyInstances(c.is), c.err
+}
+
+// call fetches the key from the next store, unless a call for it is already
+// in flight, and stores the result.
+func (s *cachingStore) call(
+	ctx context.Context,
+	key cacheKey,
+	fetch func(context.Context) (instances, error),
+) *cacheCall {
+	s.mu.Lock()
+	if c, ok := s.calls[key]; ok {
+		s.mu.Unlock()
+		<-c.done
+		return c
+	}
+
+	c := &cacheCall{done: make(chan struct{})}
+	s.calls[key] = c
+	s.mu.Unlock()
+
+	c.is, c.err = fetch(ctx)
+
+	s.mu.Lock()
+	delete(s.calls, key)
+	s.store(key, c.is, c.err)
+	s.mu.Unlock()
+
+	close(c.done)
+
+	return c
+}
+
+func (s *cachingStore) store(key cacheKey, is instances, err error) {
+	ttl := s.ttl
+	switch {
+	case err == nil:
+		if isStale(is) && ttl > time.Duration(staleTTL)*time.Second {
+			ttl = time.Duration(staleTTL) * time.Second
+		}
+	case isNoInstances(err):
+		ttl = s.negativeTTL
+	default:
+		ttl = 0
+	}
+
+	if ttl <= 0 {
+		// Keep serving a still valid entry if a prefetch failed.
+		if e, ok := s.entries[key]; ok {
+			e.prefetching = false
+		}
+		return
+	}
+
+	s.entries[key] = &cacheEntry{
+		is:      is,
+		err:     err,
+		ttl:     ttl,
+		expires: s.now().Add(ttl),
+	}
+}
+
+// isStale reports whether any of the instances was served from the snapshot.
+func isStale(is instances) bool {
+	for _, i := range is {
+		if i.stale {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sweep drops expired entries, at most once per ttl.
+func (s *cachingStore) sweep(now time.Time) {
+	if now.Sub(s.swept) < s.ttl {
+		return
+	}
+	s.swept = now
+
+	for key, e := range s.entries {
+		if !now.Before(e.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// copyInstances protects cached results from modifications by the caller.
+func copyInstances(is instances) instances {
+	if is == nil {
+		return nil
+	}
+
+	return append(make(instances, 0, len(is)), is...)
+}
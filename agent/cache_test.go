@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStore counts calls to the next store and optionally blocks them
+// until release is closed.
+type countingStore struct {
+	next    store
+	calls   int32
+	release chan struct{}
+}
+
+func (s *countingStore) wait() {
+	atomic.AddInt32(&s.calls, 1)
+	if s.release != nil {
+		<-s.release
+	}
+}
+
+func (s *countingStore) getInstances(ctx context.Context, i info) (instances, error) {
+	s.wait()
+	return s.next.getInstances(context.Background(), i)
+}
+
+func (s *countingStore) getInstancesByHealth(ctx context.Context, i info, h health) (instances, error) {
+	s.wait()
+	return s.next.getInstancesByHealth(context.Background(), i, h)
+}
+
+func (s *countingStore) getServers(ctx context.Context, zone string) (instances, error) {
+	s.wait()
+	return s.next.getServers(context.Background(), zone)
+}
+
+func TestCachingStore(t *testing.T) {
+	var (
+		i = info{
+			service: "http",
+			job:     "api",
+			env:     "prod",
+			product: "harpoon",
+			zone:    "tt",
+		}
+		unknown = info{product: "unknown", zone: "tt"}
+		clock   = newTestClock()
+		next    = &countingStore{next: &testStore{
+			instances: map[info]instances{i: generateInstancesFromInfo(i)},
+			servers:   map[string]instances{"tt": instances{{host: "foo"}}},
+		}}
+		s = newCachingStore(next, 5*time.Second, time.Second)
+	)
+	s.now = clock.now
+
+	for _, test := range []struct {
+		after time.Duration
+		info  info
+		calls int32
+	}{
+		{info: i, calls: 1},
+		{info: i, after: time.Second, calls: 1},
+		{info: i, after: 4 * time.Second, calls: 2},
+		{info: unknown, calls: 3},
+		{info: unknown, after: 500 * time.Millisecond, calls: 3},
+		{info: unknown, after: 500 * time.Millisecond, calls: 4},
+	} {
+		clock.add(test.after)
+
+		_, err := s.getInstances(context.Background(), test.info)
+		if test.info == unknown && !isNoInstances(err) {
+			t.Errorf("want %s, got %s", errNoInstances, err)
+		}
+		if want, got := test.calls, atomic.LoadInt32(&next.calls); want != got {
+			t.Errorf("%s want %d calls, got %d", test.info.addr(), want, got)
+		}
+	}
+
+	ss, err := s.getServers(context.Background(), "tt")
+	if err != nil {
+		t.Fatalf("getServers failed: %s", err)
+	}
+	ss[0].host = "modified"
+
+	ss, err = s.getServers(context.Background(), "tt")
+	if err != nil {
+		t.Fatalf("getServers failed: %s", err)
+	}
+	if want, got := "foo", ss[0].host; want != got {
+		t.Errorf("want cached host %s, got %s", want, got)
+	}
+	if want, got := int32(5), atomic.LoadInt32(&next.calls); want != got {
+		t.Errorf("want %d calls, got %d", want, got)
+	}
+}
+
+func TestCachingStoreErrors(t *testing.T) {
+	var (
+		next = &countingStore{next: &brokenStore{}}
+		s    = newCachingStore(next, 5*time.Second, time.Second)
+	)
+
+	for j := 0; j < 3; j++ {
+		if _, err := s.getServers(context.Background(), "tt"); !isConsulAPI(err) {
+			t.Fatalf("want %s, got %s", errConsulAPI, err)
+		}
+	}
+
+	if want, got := int32(3), atomic.LoadInt32(&next.calls); want != got {
+		t.Errorf("want API errors to not be cached, got %d calls", got)
+	}
+}
+
+func TestCachingStoreStale(t *testing.T) {
+	var (
+		i     = info{service: "http", job: "api", env: "prod", product: "harpoon", zone: "tt"}
+		is    = generateInstancesFromInfo(i)
+		clock = newTestClock()
+	)
+	for j := range is {
+		is[j].stale = true
+	}
+
+	var (
+		next = &countingStore{next: &testStore{instances: map[info]instances{i: is}}}
+		s    = newCachingStore(next, time.Minute, time.Second)
+	)
+	s.now = clock.now
+
+	for _, test := range []struct {
+		after time.Duration
+		calls int32
+	}{
+		{calls: 1},
+		{after: 500 * time.Millisecond, calls: 1},
+		{after: 600 * time.Millisecond, calls: 2},
+	} {
+		clock.add(test.after)
+
+		if _, err := s.getInstances(context.Background(), i); err != nil {
+			t.Fatalf("getInstances failed: %s", err)
+		}
+		if want, got := test.calls, atomic.LoadInt32(&next.calls); want != got {
+			t.Errorf("want %d calls after %s, got %d", want, test.after, got)
+		}
+	}
+}
+
+func TestCachingStoreCoalescing(t *testing.T) {
+	var (
+		i    = info{service: "http", job: "api", env: "prod", product: "harpoon", zone: "tt"}
+		next = &countingStore{
+			next:    &testStore{instances: map[info]instances{i: generateInstancesFromInfo(i)}},
+			release: make(chan struct{}),
+		}
+		s  = newCachingStore(next, 5*time.Second, time.Second)
+		wg sync.WaitGroup
+	)
+
+	for j := 0; j < 10; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, err := s.getInstances(context.Background(), i); err != nil {
+				t.Errorf("getInstances failed: %s", err)
+			}
+		}()
+	}
+
+	// Wait for the first call to reach the next store.
+	for atomic.LoadInt32(&next.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(next.release)
+	wg.Wait()
+
+	if want, got := int32(1), atomic.LoadInt32(&next.calls); want != got {
+		t.Errorf("want %d calls, got %d", want, got)
+	}
+}
+
+func TestCachingStorePrefetch(t *testing.T) {
+	var (
+		i     = info{service: "http", job: "api", env: "prod", product: "harpoon", zone: "tt"}
+		clock = newTestClock()
+		next  = &countingStore{
+			next: &testStore{instances: map[info]instances{i: generateInstancesFromInfo(i)}},
+		}
+		s = newCachingStore(next, 10*time.Second, time.Second)
+	)
+	s.now = clock.now
+
+	for _, after := range []time.Duration{0, time.Second, 8500 * time.Millisecond} {
+		clock.add(after)
+		if _, err := s.getInstances(context.Background(), i); err != nil {
+			t.Fatalf("getInstances failed: %s", err)
+		}
+	}
+
+	// The prefetch runs in the background.
+	for j := 0; j < 100 && atomic.LoadInt32(&next.calls) < 2; j++ {
+		time.Sleep(time.Millisecond)
+	}
+	if want, got := int32(2), atomic.LoadInt32(&next.calls); want != got {
+		t.Fatalf("want %d calls, got %d", want, got)
+	}
+
+	// The prefetched entry outlives the original expiry.
+	clock.add(time.Second)
+	if _, err := s.getInstances(context.Background(), i); err != nil {
+		t.Fatalf("getInstances failed: %s", err)
+	}
+	if want, got := int32(2), atomic.LoadInt32(&next.calls); want != got {
+		t.Errorf("want %d calls, got %d", want, got)
+	}
+}
+
+func TestCachingStoreCoalescedDeadline(t *testing.T) {
+	var (
+		srv  = info{env: "prod", job: "web", product: "harpoon", service: "http", zone: "gg"}
+		next = &countingStore{
+			next:    &testStore{instances: map[info]instances{srv: generateInstancesFromInfo(srv)}},
+			release: make(chan struct{}),
+		}
+		s    = newCachingStore(next, time.Minute, time.Second)
+		done = make(chan error)
+	)
+
+	go func() {
+		_, err := s.getInstances(context.Background(), srv)
+		done <- err
+	}()
+
+	for atomic.LoadInt32(&next.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := s.getInstances(ctx, srv); !isConsulAPI(err) {
+		t.Errorf("want coalesced lookup to give up with its context, got %v", err)
+	}
+
+	close(next.release)
+	if err := <-done; err != nil {
+		t.Errorf("want first lookup to succeed, got %s", err)
+	}
+}
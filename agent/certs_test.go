@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and
+// its key to dir and returns the file paths.
+func writeTestCertificate(t *testing.T, dir, name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glimpse-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCertificate(t, dir, "first")
+
+	c, err := newCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := c.getCertificate(nil)
+
+	second, _ := writeTestCertificate(t, dir, "second")
+	if err := os.Rename(second, certFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.load(); err == nil {
+		t.Fatal("want error for certificate not matching the key")
+	}
+	if got, _ := c.getCertificate(nil); got != first {
+		t.Errorf("want previous certificate kept after failed reload")
+	}
+
+	writeTestCertificate(t, dir, "first")
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.getCertificate(nil); got == first {
+		t.Errorf("want certificate replaced after reload")
+	}
+}
+
+func TestVerifyClients(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glimpse-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		serverCert, serverKey = writeTestCertificate(t, dir, "server")
+		clientCert, clientKey = writeTestCertificate(t, dir, "client")
+	)
+
+	c, err := newCertificate(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+		}
+	}))
+	s.TLS = c.tlsConfig()
+	if err := verifyClients(s.TLS, clientCert, true); err != nil {
+		t.Fatal(err)
+	}
+	s.StartTLS()
+	defer s.Close()
+
+	// The server presents the httptest certificate for IP addresses.
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if _, err := client.Get(s.URL); err == nil {
+		t.Errorf("want request without client certificate rejected")
+	}
+
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{cert},
+	}}}
+	res, err := client.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "client", string(b); want != got {
+		t.Errorf("want client identity %s, got %s", want, got)
+	}
+
+	if err := verifyClients(s.TLS, serverKey, false); err == nil {
+		t.Errorf("want error for CA bundle without certificates")
+	}
+}
@@ -1,50 +1,102 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"net"
+	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Check states reported by consul.
+const (
+	checkPassing  = "passing"
+	checkWarning  = "warning"
+	checkCritical = "critical"
+)
+
+const (
+	// Check IDs consul-agent uses for maintenance mode, see
+	// https://www.consul.io/docs/commands/maint.html
+	nodeMaintenanceID    = "_node_maintenance"
+	serviceMaintenanceID = "_service_maintenance:"
+)
+
+const (
+	panicTagPrefix = "glimpse:panic="
+
+	// addrTagPrefix sets the address of an instance for a view, e.g.
+	// glimpse:addr.edge=192.0.2.1.
+	addrTagPrefix = "glimpse:addr."
 )
 
 type consulStore struct {
-	client *api.Client
+	config *api.Config
+	logger *log.Logger
+
+	// panicThreshold is the fraction of healthy instances below which all
+	// instances are returned regardless of their health. It can be overridden
+	// per service address with the glimpse:panic=<percent> tag.
+	panicThreshold float64
+
+	// flaps dampens the status of flapping instances, if set.
+	flaps *flapTracker
+
+	// datacenter is queried for all zones if set, for backends serving a
+	// single zone from a datacenter of another name.
+	datacenter string
 }
 
-func newConsulStore(client *api.Client) store {
+func newConsulStore(
+	config *api.Config,
+	logger *log.Logger,
+	panicThreshold float64,
+	flaps *flapTracker,
+) *consulStore {
 	return &consulStore{
-		client: client,
+		config:         config,
+		logger:         logger,
+		panicThreshold: panicThreshold,
+		flaps:          flaps,
 	}
 }
 
-func (s *consulStore) getInstances(info info) (instances, error) {
+// getInstances returns healthy instances only.
+func (s *consulStore) getInstances(ctx context.Context, info info) (instances, error) {
+	return s.getInstancesByHealth(ctx, info, healthPassing)
+}
+
+// getInstancesByHealth returns the instances whose checks are at least in the
+// given state.
+func (s *consulStore) getInstancesByHealth(ctx context.Context, info info, h health) (instances, error) {
 	var (
-		envTag      = fmt.Sprintf("glimpse:env=%s", info.env)
-		jobTag      = fmt.Sprintf("glimpse:job=%s", info.job)
-		serviceTag  = fmt.Sprintf("glimpse:service=%s", info.service)
-		passingOnly = true
-		options     = &api.QueryOptions{
+		envTag     = fmt.Sprintf("glimpse:env=%s", info.env)
+		jobTag     = fmt.Sprintf("glimpse:job=%s", info.job)
+		serviceTag = fmt.Sprintf("glimpse:service=%s", info.service)
+		options    = &api.QueryOptions{
 			AllowStale: true,
-			Datacenter: info.zone,
+			Datacenter: s.zoneDatacenter(info.zone),
 		}
 
-		is = instances{}
+		all       = instances{}
+		is        = instances{}
+		threshold = -1.0
+		skipped   error
 	)
 
-	// As the default we only retrieve healthy instances. Returning different
-	// sub/super-sets should be done through different methods communicated clearly
-	// the expected response.
-	entries, _, err := s.client.Health().Service(info.product, jobTag, passingOnly, options)
+	// All instances are retrieved, as the health filtering and the panic
+	// threshold need to know about the unhealthy ones.
+	entries, _, err := s.client(ctx).Health().Service(info.product, jobTag, false, options)
 	if err != nil {
 		if strings.Contains(err.Error(), "No path to datacenter") {
 			return nil, newError(errNoInstances, "unknown zone %s", info.zone)
 		}
-		return nil, newError(errConsulAPI, "%s", err)
-	}
-
-	if len(entries) == 0 {
-		return nil, newError(errNoInstances, "found for %s", info.addr())
+		return nil, consulError(err)
 	}
 
 	for _, e := range entries {
@@ -62,31 +114,75 @@ func (s *consulStore) getInstances(info info) (instances, error) {
 			}
 		}
 
-		ip := net.ParseIP(e.Node.Address)
-		if ip == nil {
-			return nil, newError(errInvalidIP, "parse failed for %s", e.Node.Address)
+		if !isEnv || !isService {
+			continue
 		}
 
-		if isEnv && isService {
-			is = append(is, instance{
-				host: e.Node.Node,
-				ip:   ip,
-				port: uint16(e.Service.Port),
-			})
+		// Draining instances stay registered but are never handed out.
+		if isDraining(e.Checks) {
+			continue
+		}
+
+		ip, err := entryIP(e)
+		if err != nil {
+			// A single broken registration must not fail the whole answer.
+			skipped = err
+			s.skip(info, e, err)
+			continue
+		}
+
+		if t, ok := panicThreshold(e.Service.Tags); ok && t > threshold {
+			threshold = t
+		}
+
+		i := instance{
+			host:   e.Node.Node,
+			ip:     ip,
+			port:   uint16(e.Service.Port),
+			status: checksStatus(e.Checks),
+			addrs:  viewAddrs(e.Service.Tags),
+		}
+		if s.flaps != nil {
+			i.status = s.flaps.observe(info, i)
+		}
+
+		all = append(all, i)
+		if isHealthy(i.status, h) {
+			is = append(is, i)
 		}
 	}
 
+	if len(all) == 0 {
+		if skipped != nil {
+			return nil, skipped
+		}
+		return nil, newError(errNoInstances, "found for %s", info.addr())
+	}
+
+	if threshold < 0 {
+		threshold = s.panicThreshold
+	}
+	if float64(len(is)) < threshold*float64(len(all)) {
+		s.panic(info, len(is), len(all), threshold)
+		return all, nil
+	}
+
+	if len(is) == 0 {
+		return nil, newError(errNoInstances, "found for %s", info.addr())
+	}
+
 	return is, nil
 }
 
-func (s *consulStore) getServers(zone string) (is instances, err error) {
-	members, err := s.client.Agent().Members(true)
+func (s *consulStore) getServers(ctx context.Context, zone string) (is instances, err error) {
+	members, err := s.client(ctx).Agent().Members(true)
 	if err != nil {
-		return nil, newError(errConsulAPI, "%s", err)
+		return nil, consulError(err)
 	}
 
+	dc := s.zoneDatacenter(zone)
 	for _, m := range members {
-		if zone == "" || strings.HasSuffix(m.Name, "."+zone) {
+		if dc == "" || strings.HasSuffix(m.Name, "."+dc) {
 			n := m.Name
 			if i := strings.LastIndex(n, "."); i > 0 {
 				n = n[:i]
@@ -98,6 +194,169 @@ func (s *consulStore) getServers(zone string) (is instances, err error) {
 	return is, nil
 }
 
+// zoneDatacenter returns the datacenter of the zone.
+func (s *consulStore) zoneDatacenter(zone string) string {
+	if s.datacenter != "" {
+		return s.datacenter
+	}
+
+	return zone
+}
+
+// client returns a Consul client whose requests are cancelled with ctx.
+func (s *consulStore) client(ctx context.Context) *api.Client {
+	var (
+		config = *s.config
+		hc     = &http.Client{}
+	)
+
+	if config.HttpClient != nil {
+		*hc = *config.HttpClient
+	}
+	hc.Transport = &contextTransport{ctx: ctx, next: hc.Transport}
+	config.HttpClient = hc
+
+	// NewClient never fails.
+	client, _ := api.NewClient(&config)
+
+	return client
+}
+
+// consulError classifies an error of the Consul API, telling requests denied
+// by the ACLs apart from failed ones.
+func consulError(err error) glimpseError {
+	msg := err.Error()
+	if strings.Contains(msg, "Permission denied") ||
+		strings.Contains(msg, "ACL not found") ||
+		strings.Contains(msg, "response code: 403") {
+		return newError(errPermissionDenied, "%s", err)
+	}
+
+	return newError(errConsulAPI, "%s", err)
+}
+
+// contextTransport binds all requests to a context, as the Consul API client
+// doesn't support contexts itself.
+type contextTransport struct {
+	ctx  context.Context
+	next http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return next.RoundTrip(r.WithContext(t.ctx))
+}
+
+func (s *consulStore) skip(info info, e *api.ServiceEntry, err error) {
+	storeSkipped.WithLabelValues(errToLabel(err), info.zone).Inc()
+
+	s.logger.Printf(
+		"STORE skipped instance %s of %s on %s: %s",
+		e.Service.ID,
+		info.addr(),
+		e.Node.Node,
+		err,
+	)
+}
+
+func (s *consulStore) panic(info info, healthy, total int, threshold float64) {
+	storePanics.With(prometheus.Labels{
+		"service": info.service,
+		"job":     info.job,
+		"env":     info.env,
+		"product": info.product,
+		"zone":    info.zone,
+	}).Inc()
+
+	s.logger.Printf(
+		"STORE panic mode for %s: %d of %d instances healthy, below %.0f%%",
+		info.addr(),
+		healthy,
+		total,
+		threshold*100,
+	)
+}
+
+// panicThreshold returns the threshold set by the glimpse:panic=<percent> tag
+// as a fraction.
+func panicThreshold(tags []string) (float64, bool) {
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, panicTagPrefix) {
+			continue
+		}
+
+		p, err := strconv.ParseFloat(strings.TrimPrefix(tag, panicTagPrefix), 64)
+		if err != nil || p < 0 || p > 100 {
+			return 0, false
+		}
+
+		return p / 100, true
+	}
+
+	return 0, false
+}
+
+// viewAddrs returns the addresses of an instance per view. Invalid addresses
+// are ignored, they are reported by the doctor.
+func viewAddrs(tags []string) map[string]net.IP {
+	var addrs map[string]net.IP
+
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, addrTagPrefix) {
+			continue
+		}
+
+		kv := strings.SplitN(strings.TrimPrefix(tag, addrTagPrefix), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		ip := net.ParseIP(kv[1])
+		if ip == nil {
+			continue
+		}
+
+		if addrs == nil {
+			addrs = map[string]net.IP{}
+		}
+		addrs[kv[0]] = ip
+	}
+
+	return addrs
+}
+
+// isHealthy reports if the aggregated check status satisfies h.
+func isHealthy(status string, h health) bool {
+	switch h {
+	case healthPassing:
+		return status == checkPassing
+	case healthWarning:
+		return status != checkCritical
+	default:
+		return true
+	}
+}
+
+// entryIP returns the address of a service instance. The service address takes
+// precedence over the node address if set.
+func entryIP(e *api.ServiceEntry) (net.IP, error) {
+	addr := e.Node.Address
+	if e.Service.Address != "" {
+		addr = e.Service.Address
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, newError(errInvalidIP, "parse failed for %s", addr)
+	}
+
+	return ip, nil
+}
+
 func infoToTags(info info) []string {
 	return []string{
 		fmt.Sprintf("glimpse:env=%s", info.env),
@@ -107,3 +366,68 @@ func infoToTags(info info) []string {
 		fmt.Sprintf("glimpse:service=%s", info.service),
 	}
 }
+
+func infoFromTags(tags []string) (info, error) {
+	var (
+		i      = info{}
+		fields = map[string]*string{
+			"env":      &i.env,
+			"job":      &i.job,
+			"product":  &i.product,
+			"provider": &i.provider,
+			"service":  &i.service,
+		}
+	)
+
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, "glimpse:") {
+			continue
+		}
+
+		kv := strings.SplitN(strings.TrimPrefix(tag, "glimpse:"), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		if f, ok := fields[kv[0]]; ok {
+			*f = kv[1]
+		}
+	}
+
+	for name, f := range fields {
+		if *f == "" {
+			return info{}, fmt.Errorf("missing tag glimpse:%s", name)
+		}
+	}
+
+	return i, nil
+}
+
+// checksStatus aggregates the states of all checks to the worst one. Unknown
+// states count as critical.
+func checksStatus(checks []*api.HealthCheck) string {
+	status := checkPassing
+
+	for _, c := range checks {
+		switch c.Status {
+		case checkPassing:
+		case checkWarning:
+			status = checkWarning
+		default:
+			return checkCritical
+		}
+	}
+
+	return status
+}
+
+func isDraining(checks []*api.HealthCheck) bool {
+	for _, c := range checks {
+		if c.CheckID == nodeMaintenanceID ||
+			strings.HasPrefix(c.CheckID, serviceMaintenanceID) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,7 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -22,12 +30,12 @@ func TestConsulGetInstances(t *testing.T) {
 		createServiceEntry(i, 8080, "host00.gg.local", "10.2.3.4", nil),
 	}
 
-	client, server := setupStubConsul(result, t)
+	config, server := setupStubConsul(result, t)
 	defer server.Close()
 
-	store := newConsulStore(client)
+	store := newConsulStore(config, log.New(ioutil.Discard, "", 0), 0, nil)
 
-	is, err := store.getInstances(i)
+	is, err := store.getInstances(context.Background(), i)
 	if err != nil {
 		t.Fatalf("getInstances failed: %s", err)
 	}
@@ -37,17 +45,17 @@ func TestConsulGetInstances(t *testing.T) {
 }
 
 func TestConsulGetInstancesEmptyResult(t *testing.T) {
-	client, server := setupStubConsul([]*api.CatalogService{}, t)
+	config, server := setupStubConsul([]*api.CatalogService{}, t)
 	defer server.Close()
 
-	store := newConsulStore(client)
+	store := newConsulStore(config, log.New(ioutil.Discard, "", 0), 0, nil)
 
 	i, err := infoFromAddr("predict.future.experimental.oracle.gg")
 	if err != nil {
 		t.Fatalf("info extraction failed: %s", err)
 	}
 
-	_, err = store.getInstances(i)
+	_, err = store.getInstances(context.Background(), i)
 
 	if !isNoInstances(err) {
 		t.Errorf("want %s, got %s", errNoInstances, err)
@@ -63,43 +71,274 @@ func TestConsulGetInstancesInvalidIP(t *testing.T) {
 		createServiceEntry(i, 8081, "host01.gg.local", "3.2.1", nil),
 	}
 
-	client, server := setupStubConsul(result, t)
+	config, server := setupStubConsul(result, t)
 	defer server.Close()
 
-	store := newConsulStore(client)
+	store := newConsulStore(config, log.New(ioutil.Discard, "", 0), 0, nil)
 
-	_, err = store.getInstances(i)
+	_, err = store.getInstances(context.Background(), i)
 	if !isInvalidIP(err) {
 		t.Fatalf("want %s, got %s", errInvalidIP, err)
 	}
 }
 
+func TestConsulGetInstancesSkipInvalidIP(t *testing.T) {
+	i, err := infoFromAddr("prometheus.walker.qa.roshi.gg")
+	if err != nil {
+		t.Fatalf("info extraction failed: %s", err)
+	}
+	result := []*api.ServiceEntry{
+		createServiceEntry(i, 8081, "host01.gg.local", "3.2.1", nil),
+		createServiceEntry(i, 8081, "host02.gg.local", "10.2.3.4", nil),
+	}
+
+	config, server := setupStubConsul(result, t)
+	defer server.Close()
+
+	var (
+		b     = &bytes.Buffer{}
+		store = newConsulStore(config, log.New(b, "", 0), 0, nil)
+	)
+
+	is, err := store.getInstances(context.Background(), i)
+	if err != nil {
+		t.Fatalf("getInstances failed: %s", err)
+	}
+	if want, got := 1, len(is); want != got {
+		t.Fatalf("want %d instances, got %d", want, got)
+	}
+	if want, got := "host02.gg.local", is[0].host; want != got {
+		t.Errorf("want host %s, got %s", want, got)
+	}
+	if !strings.Contains(b.String(), "host01.gg.local") {
+		t.Errorf("want skipped host to be logged, got %q", b.String())
+	}
+}
+
+func TestConsulGetInstancesServiceAddress(t *testing.T) {
+	i, err := infoFromAddr("http.walker.qa.roshi.gg")
+	if err != nil {
+		t.Fatalf("info extraction failed: %s", err)
+	}
+
+	container := createServiceEntry(i, 8080, "host00.gg.local", "10.2.3.4", nil)
+	container.Service.Address = "172.17.0.2"
+
+	result := []*api.ServiceEntry{
+		container,
+		createServiceEntry(i, 8081, "host00.gg.local", "10.2.3.4", nil),
+	}
+
+	config, server := setupStubConsul(result, t)
+	defer server.Close()
+
+	is, err := newConsulStore(config, log.New(ioutil.Discard, "", 0), 0, nil).getInstances(context.Background(), i)
+	if err != nil {
+		t.Fatalf("getInstances failed: %s", err)
+	}
+	if want, got := 2, len(is); want != got {
+		t.Fatalf("want %d instances, got %d", want, got)
+	}
+	for j, want := range []net.IP{net.ParseIP("172.17.0.2"), net.ParseIP("10.2.3.4")} {
+		if got := is[j].ip; !want.Equal(got) {
+			t.Errorf("want ip %s, got %s", want, got)
+		}
+	}
+}
+
 func TestConsulGetInstancesNoConsul(t *testing.T) {
-	client, err := api.NewClient(&api.Config{
+	config := &api.Config{
 		Address:    "1.2.3.4",
 		Datacenter: defaultSrvZone,
 		HttpClient: &http.Client{
 			Timeout: time.Millisecond,
 		},
-	})
-	if err != nil {
-		t.Fatalf("consul setup failed: %s", err)
 	}
 
-	store := newConsulStore(client)
+	store := newConsulStore(config, log.New(ioutil.Discard, "", 0), 0, nil)
 
 	i, err := infoFromAddr("amqp.broker.qa.solution.gg")
 	if err != nil {
 		t.Fatalf("info extraction failed: %s", err)
 	}
 
-	_, err = store.getInstances(i)
+	_, err = store.getInstances(context.Background(), i)
 
 	if !isConsulAPI(err) {
 		t.Fatalf("want %s, got %s", errConsulAPI, err)
 	}
 }
 
+func TestConsulGetInstancesDraining(t *testing.T) {
+	i, err := infoFromAddr("http.walker.qa.roshi.gg")
+	if err != nil {
+		t.Fatalf("info extraction failed: %s", err)
+	}
+	result := []*api.ServiceEntry{
+		createServiceEntry(i, 8080, "host00.gg.local", "10.2.3.4", nil),
+		createServiceEntry(i, 8081, "host00.gg.local", "10.2.3.4", []*api.HealthCheck{
+			&api.HealthCheck{CheckID: serviceMaintenanceID + "roshi-8081"},
+		}),
+		createServiceEntry(i, 8080, "host01.gg.local", "10.2.3.5", []*api.HealthCheck{
+			&api.HealthCheck{CheckID: nodeMaintenanceID},
+		}),
+	}
+
+	config, server := setupStubConsul(result, t)
+	defer server.Close()
+
+	is, err := newConsulStore(config, log.New(ioutil.Discard, "", 0), 0, nil).getInstances(context.Background(), i)
+	if err != nil {
+		t.Fatalf("getInstances failed: %s", err)
+	}
+	if want, got := 1, len(is); want != got {
+		t.Fatalf("want %d instances, got %d", want, got)
+	}
+	if want, got := uint16(8080), is[0].port; want != got {
+		t.Errorf("want port %d, got %d", want, got)
+	}
+}
+
+func TestConsulGetInstancesByHealth(t *testing.T) {
+	i, err := infoFromAddr("http.walker.qa.roshi.gg")
+	if err != nil {
+		t.Fatalf("info extraction failed: %s", err)
+	}
+	result := []*api.ServiceEntry{
+		createServiceEntry(i, 8080, "host00.gg.local", "10.2.3.4", []*api.HealthCheck{
+			&api.HealthCheck{Status: checkPassing},
+		}),
+		createServiceEntry(i, 8081, "host00.gg.local", "10.2.3.4", []*api.HealthCheck{
+			&api.HealthCheck{Status: checkPassing},
+			&api.HealthCheck{Status: checkWarning},
+		}),
+		createServiceEntry(i, 8082, "host00.gg.local", "10.2.3.4", []*api.HealthCheck{
+			&api.HealthCheck{Status: checkWarning},
+			&api.HealthCheck{Status: checkCritical},
+		}),
+	}
+
+	config, server := setupStubConsul(result, t)
+	defer server.Close()
+
+	store := newConsulStore(config, log.New(ioutil.Discard, "", 0), 0, nil)
+
+	for h, want := range map[health]int{
+		healthWarning: 2,
+		healthAny:     3,
+	} {
+		is, err := store.getInstancesByHealth(context.Background(), i, h)
+		if err != nil {
+			t.Fatalf("getInstancesByHealth failed: %s", err)
+		}
+		if got := len(is); want != got {
+			t.Errorf("%s want %d instances, got %d", h, want, got)
+		}
+	}
+}
+
+func TestConsulGetInstancesPanic(t *testing.T) {
+	i, err := infoFromAddr("http.walker.qa.roshi.gg")
+	if err != nil {
+		t.Fatalf("info extraction failed: %s", err)
+	}
+
+	var (
+		failing = []*api.HealthCheck{&api.HealthCheck{Status: checkCritical}}
+		result  = []*api.ServiceEntry{
+			createServiceEntry(i, 8080, "host00.gg.local", "10.2.3.4", nil),
+			createServiceEntry(i, 8081, "host00.gg.local", "10.2.3.4", failing),
+			createServiceEntry(i, 8082, "host01.gg.local", "10.2.3.5", failing),
+			createServiceEntry(i, 8083, "host01.gg.local", "10.2.3.5", failing),
+		}
+	)
+
+	config, server := setupStubConsul(result, t)
+	defer server.Close()
+
+	for _, test := range []struct {
+		threshold float64
+		want      int
+		panic     bool
+	}{
+		{threshold: 0, want: 1},
+		{threshold: 0.25, want: 1},
+		{threshold: 0.5, want: 4, panic: true},
+	} {
+		var (
+			b     = &bytes.Buffer{}
+			store = newConsulStore(config, log.New(b, "", 0), test.threshold, nil)
+		)
+
+		is, err := store.getInstances(context.Background(), i)
+		if err != nil {
+			t.Fatalf("getInstances failed: %s", err)
+		}
+		if want, got := test.want, len(is); want != got {
+			t.Errorf("threshold %.2f want %d instances, got %d", test.threshold, want, got)
+		}
+		if want, got := test.panic, strings.Contains(b.String(), "panic mode"); want != got {
+			t.Errorf("threshold %.2f want panic logged %t, got %t", test.threshold, want, got)
+		}
+	}
+
+	// The tag takes precedence over the store default.
+	result[0].Service.Tags = append(result[0].Service.Tags, "glimpse:panic=0")
+
+	is, err := newConsulStore(config, log.New(ioutil.Discard, "", 0), 0.5, nil).getInstances(context.Background(), i)
+	if err != nil {
+		t.Fatalf("getInstances failed: %s", err)
+	}
+	if want, got := 1, len(is); want != got {
+		t.Errorf("want %d instances, got %d", want, got)
+	}
+}
+
+func TestPanicThreshold(t *testing.T) {
+	for _, test := range []struct {
+		tags []string
+		want float64
+		ok   bool
+	}{
+		{tags: []string{"glimpse:env=qa"}},
+		{tags: []string{"glimpse:env=qa", "glimpse:panic=30"}, want: 0.3, ok: true},
+		{tags: []string{"glimpse:panic=0"}, want: 0, ok: true},
+		{tags: []string{"glimpse:panic=101"}},
+		{tags: []string{"glimpse:panic=half"}},
+	} {
+		got, ok := panicThreshold(test.tags)
+		if want := test.ok; want != ok {
+			t.Errorf("%v want ok %t, got %t", test.tags, want, ok)
+		}
+		if want := test.want; want != got {
+			t.Errorf("%v want %f, got %f", test.tags, want, got)
+		}
+	}
+}
+
+func TestInfoFromTags(t *testing.T) {
+	want := info{
+		service:  "http",
+		job:      "walker",
+		env:      "qa",
+		product:  "roshi",
+		provider: "harpoon",
+	}
+
+	got, err := infoFromTags(append([]string{"unrelated"}, infoToTags(want)...))
+	if err != nil {
+		t.Fatalf("info extraction failed: %s", err)
+	}
+	if want != got {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+
+	_, err = infoFromTags([]string{"glimpse:env=qa", "glimpse:job=walker"})
+	if err == nil {
+		t.Error("want extraction from incomplete tags to fail")
+	}
+}
+
 // TODO(alx): Test services with non-matching env/service, hence filtering in getInstances.
 
 func TestConsulGetServers(t *testing.T) {
@@ -110,10 +349,10 @@ func TestConsulGetServers(t *testing.T) {
 		&api.AgentMember{Name: "qux.bc"},
 	}
 
-	client, server := setupStubConsul(result, t)
+	config, server := setupStubConsul(result, t)
 	defer server.Close()
 
-	store := newConsulStore(client)
+	store := newConsulStore(config, log.New(ioutil.Discard, "", 0), 0, nil)
 
 	for _, test := range []struct {
 		zone string
@@ -125,7 +364,7 @@ func TestConsulGetServers(t *testing.T) {
 		{zone: "dd", want: []string{}},
 		{zone: "", want: []string{"foo", "bar", "baz", "qux"}},
 	} {
-		s, err := store.getServers(test.zone)
+		s, err := store.getServers(context.Background(), test.zone)
 		if err != nil {
 			t.Fatalf("getServers failed: %s", err)
 		}
@@ -139,3 +378,60 @@ func TestConsulGetServers(t *testing.T) {
 		}
 	}
 }
+
+func TestConsulGetInstancesCancel(t *testing.T) {
+	var (
+		release = make(chan struct{})
+		server  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+	)
+	defer server.Close()
+	defer close(release)
+
+	i, err := infoFromAddr("http.walker.qa.roshi.gg")
+	if err != nil {
+		t.Fatalf("info extraction failed: %s", err)
+	}
+
+	var (
+		store = newConsulStore(&api.Config{
+			Address:    strings.TrimPrefix(server.URL, "http://"),
+			Datacenter: defaultSrvZone,
+		}, log.New(ioutil.Discard, "", 0), 0, nil)
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+		start       = time.Now()
+	)
+	defer cancel()
+
+	_, err = store.getInstances(ctx, i)
+	if !isConsulAPI(err) {
+		t.Errorf("want consul API error, got %v", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("want request cancelled with context, took %s", took)
+	}
+}
+
+func TestViewAddrs(t *testing.T) {
+	var (
+		tags = []string{
+			"glimpse:env=prod",
+			"glimpse:addr.edge=192.0.2.1",
+			"glimpse:addr.vpn=2001:db8::1",
+			"glimpse:addr.broken=nope",
+			"glimpse:addr.novalue",
+		}
+		want = map[string]net.IP{
+			"edge": net.ParseIP("192.0.2.1"),
+			"vpn":  net.ParseIP("2001:db8::1"),
+		}
+	)
+
+	if got := viewAddrs(tags); !reflect.DeepEqual(want, got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if got := viewAddrs(tags[:1]); got != nil {
+		t.Errorf("want no addresses, got %v", got)
+	}
+}
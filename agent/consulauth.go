@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// consulTokenParam carries the ACL token of Consul API requests. Consul 0.5
+// reads the token from the query only, not from a header.
+const consulTokenParam = "token"
+
+// consulToken is the Consul ACL token read from path, which can be reloaded
+// at runtime.
+type consulToken struct {
+	path string
+
+	mu    sync.RWMutex
+	token string
+}
+
+func newConsulToken(path string) (*consulToken, error) {
+	t := &consulToken{path: path}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// load replaces the token with the one read from path. The current token
+// stays in place if the file is empty.
+func (t *consulToken) load() error {
+	b, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return fmt.Errorf("no token in %s", t.path)
+	}
+
+	t.mu.Lock()
+	t.token = token
+	t.mu.Unlock()
+
+	return nil
+}
+
+func (t *consulToken) get() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.token
+}
+
+// tokenTransport adds the current ACL token to all requests. The token is
+// only added to the sent copy of requests, so it doesn't show up in the URLs
+// of errors returned by the HTTP client.
+type tokenTransport struct {
+	token *consulToken
+	next  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request.
+	r2 := r.Clone(r.Context())
+
+	q := r2.URL.Query()
+	q.Set(consulTokenParam, t.token.get())
+	r2.URL.RawQuery = q.Encode()
+
+	return t.next.RoundTrip(r2)
+}
+
+// consulFlags are the flags configuring how Consul API requests are
+// authenticated, shared by the agent and the doctor.
+type consulFlags struct {
+	scheme    *string
+	caFile    *string
+	certFile  *string
+	keyFile   *string
+	tokenFile *string
+}
+
+func newConsulFlags(flags *flag.FlagSet) *consulFlags {
+	return &consulFlags{
+		scheme: flags.String(
+			"consul.scheme",
+			"http",
+			"scheme of the Consul API: http or https",
+		),
+		caFile: flags.String(
+			"consul.ca-file",
+			"",
+			"CA bundle the certificate of the Consul API is verified with, empty uses the system roots",
+		),
+		certFile: flags.String(
+			"consul.cert-file",
+			"",
+			"client certificate file presented to the Consul API",
+		),
+		keyFile: flags.String(
+			"consul.key-file",
+			"",
+			"client key file presented to the Consul API",
+		),
+		tokenFile: flags.String(
+			"consul.token-file",
+			"",
+			"file with the Consul ACL token, reloaded on SIGHUP, empty uses the agent's default token",
+		),
+	}
+}
+
+// httpClient returns the client for Consul API requests, timing out after
+// timeout, and the ACL token it sends, nil if none.
+func (f *consulFlags) httpClient(timeout time.Duration) (*http.Client, *consulToken, error) {
+	if *f.scheme != "http" && *f.scheme != "https" {
+		return nil, nil, fmt.Errorf("invalid scheme: %s", *f.scheme)
+	}
+	if (*f.certFile == "") != (*f.keyFile == "") {
+		return nil, nil, fmt.Errorf("client certificates require a cert and a key file")
+	}
+
+	config := &tls.Config{}
+
+	if *f.caFile != "" {
+		b, err := ioutil.ReadFile(*f.caFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			return nil, nil, fmt.Errorf("no certificates in %s", *f.caFile)
+		}
+	}
+
+	if *f.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(*f.certFile, *f.keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+
+	var (
+		rt    http.RoundTripper = transport
+		token *consulToken
+	)
+	if *f.tokenFile != "" {
+		t, err := newConsulToken(*f.tokenFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		token = t
+		rt = &tokenTransport{token: token, next: rt}
+	}
+
+	return &http.Client{Timeout: timeout, Transport: rt}, token, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestConsulFlagsToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glimpse-consul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(path, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := make(chan url.Values, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := newConsulFlags(flags)
+	if err := flags.Parse([]string{"-consul.token-file", path}); err != nil {
+		t.Fatal(err)
+	}
+
+	hc, token, err := f.httpClient(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := api.NewClient(&api.Config{
+		Address:    strings.TrimPrefix(server.URL, "http://"),
+		HttpClient: hc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"first", "second"} {
+		if err := ioutil.WriteFile(path, []byte(want), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := token.load(); err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err := client.Health().Service("goku", "", false, &api.QueryOptions{Datacenter: "tt"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := <-queries
+		if got := q.Get(consulTokenParam); want != got {
+			t.Errorf("want token %s, got %s", want, got)
+		}
+		if want, got := "tt", q.Get("dc"); want != got {
+			t.Errorf("want datacenter %s kept, got %s", want, got)
+		}
+	}
+
+	if err := ioutil.WriteFile(path, []byte(" \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := token.load(); err == nil {
+		t.Errorf("want error for empty token file")
+	}
+	if want, got := "second", token.get(); want != got {
+		t.Errorf("want previous token %s kept, got %s", want, got)
+	}
+
+	// Errors carry the URL of the request, which must not contain the token.
+	server.Close()
+	if _, err := client.Agent().Members(false); err == nil {
+		t.Errorf("want error with closed server")
+	} else if strings.Contains(err.Error(), "second") {
+		t.Errorf("want token hidden in error, got %s", err)
+	}
+}
+
+func TestConsulFlagsTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glimpse-consul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		ca, _             = writeTestCertificate(t, dir, "ca")
+		certFile, keyFile = writeTestCertificate(t, dir, "client")
+	)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"-consul.scheme", "ftp"}, false},
+		{[]string{"-consul.cert-file", certFile}, false},
+		{[]string{"-consul.ca-file", keyFile}, false},
+		{[]string{"-consul.scheme", "https", "-consul.ca-file", ca, "-consul.cert-file", certFile, "-consul.key-file", keyFile}, true},
+	} {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		f := newConsulFlags(flags)
+		if err := flags.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err := f.httpClient(0)
+		if want, got := test.ok, err == nil; want != got {
+			t.Errorf("%v: want ok %t, got error %v", test.args, want, err)
+		}
+	}
+
+	// The server certificate isn't signed by the configured CA.
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := newConsulFlags(flags)
+	flags.Parse([]string{"-consul.scheme", "https", "-consul.ca-file", ca})
+
+	hc, _, err := f.httpClient(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := api.NewClient(&api.Config{
+		Address:    strings.TrimPrefix(server.URL, "https://"),
+		Scheme:     *f.scheme,
+		HttpClient: hc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Agent().Members(false); err == nil {
+		t.Errorf("want error for untrusted server certificate")
+	}
+}
+
+func TestConsulPermissionDenied(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	i, err := infoFromAddr("http.walker.qa.roshi.gg")
+	if err != nil {
+		t.Fatalf("info extraction failed: %s", err)
+	}
+
+	store := newConsulStore(&api.Config{
+		Address:    strings.TrimPrefix(server.URL, "http://"),
+		Datacenter: defaultSrvZone,
+	}, log.New(ioutil.Discard, "", 0), 0, nil)
+
+	if _, err := store.getInstances(context.Background(), i); !isPermissionDenied(err) {
+		t.Errorf("want permission denied error, got %v", err)
+	}
+	if _, err := store.getServers(context.Background(), "gg"); !isPermissionDenied(err) {
+		t.Errorf("want permission denied error, got %v", err)
+	}
+	if want, got := "permissiondenied", errToLabel(consulError(errors.New("Permission denied"))); want != got {
+		t.Errorf("want label %s, got %s", want, got)
+	}
+}
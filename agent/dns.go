@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"regexp"
@@ -16,6 +17,15 @@ const (
 	// defaultTTL specifies the time in seconds a response can be cached.
 	defaultTTL uint32 = 5
 
+	// degradedPriority is the SRV priority of instances with checks in
+	// warning state, which clients only use if no passing instance is left.
+	degradedPriority uint16 = 10
+
+	// staleTTL specifies the time in seconds an answer served from the
+	// last-known-good snapshot can be cached, so clients pick up fresh
+	// answers soon after the store recovered.
+	staleTTL uint32 = 1
+
 	// defaultInvalidTTL specifies the time in seconds a NXDOMAIN response for
 	// a question format not supported by glimpse-agent can be cached following
 	// https://tools.ietf.org/html/rfc2308#section-5.
@@ -24,6 +34,7 @@ const (
 
 var (
 	serviceQuestionRE = regexp.MustCompile(`^([[:alnum:]\-]+\.){4}[[:alnum:]]{2}$`)
+	healthQuestionRE  = regexp.MustCompile(`^(passing|warning|any)\.([[:alnum:]\-]+\.){4}[[:alnum:]]{2}$`)
 	serverQuestionRE  = regexp.MustCompile(`^(ns[0-9]+|(ns[0-9]+\.)?[[:alnum:]]{2})?$`)
 	nameserverRE      = regexp.MustCompile(`^ns[0-9]+$`)
 )
@@ -31,18 +42,48 @@ var (
 type dnsHandler struct {
 	store  store
 	domain string
+
+	// degraded adds instances in warning state to SRV answers at
+	// degradedPriority.
+	degraded bool
+
+	// budget bounds the time spent in the store per query, so clients get a
+	// SERVFAIL before they give up. Zero means no deadline.
+	budget time.Duration
+
+	// acl refuses queries of clients not allowed to see the answer, if set.
+	acl *acl
+
+	// views selects the addresses and zones answered to a client, if set.
+	views *views
 }
 
-func newDNSHandler(store store, domain string) *dnsHandler {
+func newDNSHandler(
+	store store,
+	domain string,
+	degraded bool,
+	budget time.Duration,
+	acl *acl,
+	views *views,
+) *dnsHandler {
 	return &dnsHandler{
-		store:  store,
-		domain: domain,
+		store:    store,
+		domain:   domain,
+		degraded: degraded,
+		budget:   budget,
+		acl:      acl,
+		views:    views,
 	}
 }
 
 func (h *dnsHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	var res = newResponse(req)
 
+	ctx, cancel := withBudget(context.Background(), h.budget)
+	defer cancel()
+
+	client := net.ParseIP(clientIP(w.RemoteAddr()))
+
 	// http://maradns.samiam.org/multiple.qdcount.html
 	if len(req.Question) > 1 {
 		res.Rcode = dns.RcodeNotImplemented
@@ -68,9 +109,12 @@ func (h *dnsHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 
 	switch {
 	case serviceQuestionRE.MatchString(name):
-		h.serviceResponse(name, q, res)
+		h.serviceResponse(ctx, client, name, healthPassing, q, res)
+	case healthQuestionRE.MatchString(name):
+		i := strings.Index(name, ".")
+		h.serviceResponse(ctx, client, name[i+1:], health(name[:i]), q, res)
 	case serverQuestionRE.MatchString(name):
-		h.serverResponse(name, q, res)
+		h.serverResponse(ctx, client, name, q, res)
 	default:
 		res.Rcode = dns.RcodeNameError
 		res.Extra = append(res.Extra, newSOA(q, h.domain, defaultInvalidTTL))
@@ -79,7 +123,14 @@ func (h *dnsHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	w.WriteMsg(res)
 }
 
-func (h *dnsHandler) serviceResponse(name string, q dns.Question, res *dns.Msg) {
+func (h *dnsHandler) serviceResponse(
+	ctx context.Context,
+	client net.IP,
+	name string,
+	health health,
+	q dns.Question,
+	res *dns.Msg,
+) {
 	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeSRV {
 		return
 	}
@@ -90,7 +141,27 @@ func (h *dnsHandler) serviceResponse(name string, q dns.Question, res *dns.Msg)
 		return
 	}
 
-	instances, err := h.store.getInstances(srv)
+	if !h.acl.allowed("DNS", client, srv, q.Name) {
+		res.Rcode = dns.RcodeRefused
+		return
+	}
+
+	view := h.views.lookup(client)
+	if !view.visible(srv.zone) {
+		res.Rcode = dns.RcodeNameError
+		return
+	}
+
+	if h.degraded && health == healthPassing && q.Qtype == dns.TypeSRV {
+		health = healthWarning
+	}
+
+	var instances instances
+	if health == healthPassing {
+		instances, err = h.store.getInstances(ctx, srv)
+	} else {
+		instances, err = h.store.getInstancesByHealth(ctx, srv, health)
+	}
 	if err != nil {
 		// TODO(ts): Maybe return NoError for registered service without
 		//           instances.
@@ -103,12 +174,24 @@ func (h *dnsHandler) serviceResponse(name string, q dns.Question, res *dns.Msg)
 		return
 	}
 
-	for _, i := range instances {
-		res.Answer = append(res.Answer, newRR(q, i))
+	for _, i := range view.apply(instances) {
+		rr := newRR(q, i)
+
+		if srv, ok := rr.(*dns.SRV); ok && h.degraded && i.degraded() {
+			srv.Priority = degradedPriority
+		}
+
+		res.Answer = append(res.Answer, rr)
 	}
 }
 
-func (h *dnsHandler) serverResponse(name string, q dns.Question, res *dns.Msg) {
+func (h *dnsHandler) serverResponse(
+	ctx context.Context,
+	client net.IP,
+	name string,
+	q dns.Question,
+	res *dns.Msg,
+) {
 	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeNS {
 		return
 	}
@@ -118,7 +201,17 @@ func (h *dnsHandler) serverResponse(name string, q dns.Question, res *dns.Msg) {
 		return
 	}
 
-	servers, err := h.store.getServers(zone)
+	if !h.acl.allowed("DNS", client, info{zone: zone}, q.Name) {
+		res.Rcode = dns.RcodeRefused
+		return
+	}
+
+	if zone != "" && !h.views.lookup(client).visible(zone) {
+		res.Rcode = dns.RcodeNameError
+		return
+	}
+
+	servers, err := h.store.getServers(ctx, zone)
 	if err != nil && !isNoInstances(err) {
 		res.Rcode = dns.RcodeServerFailure
 		return
@@ -177,6 +270,9 @@ func newRR(q dns.Question, i instance) dns.RR {
 		Class:  dns.ClassINET,
 		Ttl:    defaultTTL,
 	}
+	if i.stale {
+		hdr.Ttl = staleTTL
+	}
 
 	switch q.Qtype {
 	case dns.TypeA:
@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -69,9 +70,18 @@ func TestDNSHandler(t *testing.T) {
 			servers: map[string]instances{
 				zone: instances{{host: "foo"}, {host: "bar"}},
 			},
+			unhealthy: map[info]instances{
+				web: instances{
+					{
+						host: "host5",
+						ip:   net.ParseIP("127.0.0.5"),
+						port: uint16(21000),
+					},
+				},
+			},
 		}
 
-		h = newDNSHandler(store, domain)
+		h = newDNSHandler(store, domain, false, 0, nil, nil)
 		w = &testWriter{}
 	)
 
@@ -122,6 +132,27 @@ func TestDNSHandler(t *testing.T) {
 			qtype:   dns.TypeSRV,
 			answers: 2,
 		},
+		{
+			q:       fmt.Sprintf("passing.http.web.prod.harpoon.%s.%s", zone, domain),
+			qtype:   dns.TypeSRV,
+			answers: 2,
+		},
+		{
+			q:       fmt.Sprintf("warning.http.web.prod.harpoon.%s.%s", zone, domain),
+			qtype:   dns.TypeSRV,
+			answers: 3,
+		},
+		{
+			q:       fmt.Sprintf("any.http.web.prod.harpoon.%s.%s", zone, domain),
+			qtype:   dns.TypeA,
+			answers: 3,
+		},
+		{
+			q:        fmt.Sprintf("all.http.web.prod.harpoon.%s.%s", zone, domain),
+			qtype:    dns.TypeA,
+			rcode:    dns.RcodeNameError,
+			soaCache: defaultInvalidTTL,
+		},
 		{
 			q:     fmt.Sprintf("foo.bar.baz.qux.%s.%s", zone, domain),
 			qtype: dns.TypeA,
@@ -263,9 +294,77 @@ func TestDNSHandler(t *testing.T) {
 	}
 }
 
+func TestDNSHandlerDegraded(t *testing.T) {
+	var (
+		api = info{
+			service: "http",
+			job:     "api",
+			env:     "prod",
+			product: "harpoon",
+			zone:    "tt",
+		}
+		store = &testStore{
+			instances: map[info]instances{
+				api: instances{
+					{
+						host:   "host1",
+						ip:     net.ParseIP("127.0.0.1"),
+						port:   uint16(20000),
+						status: checkPassing,
+					},
+				},
+			},
+			unhealthy: map[info]instances{
+				api: instances{
+					{
+						host:   "host2",
+						ip:     net.ParseIP("127.0.0.2"),
+						port:   uint16(20000),
+						status: checkWarning,
+					},
+				},
+			},
+		}
+		w = &testWriter{}
+		q = "http.api.prod.harpoon.tt.test.glimpse.io."
+	)
+
+	for _, test := range []struct {
+		degraded   bool
+		qtype      uint16
+		priorities []uint16
+	}{
+		{degraded: false, qtype: dns.TypeSRV, priorities: []uint16{0}},
+		{degraded: true, qtype: dns.TypeSRV, priorities: []uint16{0, degradedPriority}},
+		{degraded: true, qtype: dns.TypeA, priorities: []uint16{0}},
+	} {
+		var (
+			h = newDNSHandler(store, dns.Fqdn("test.glimpse.io"), test.degraded, 0, nil, nil)
+			m = &dns.Msg{}
+		)
+
+		m.SetQuestion(q, test.qtype)
+		h.ServeDNS(w, m)
+
+		if want, got := len(test.priorities), len(w.msg.Answer); want != got {
+			t.Fatalf("degraded %t want %d answers, got %d", test.degraded, want, got)
+		}
+
+		for i, rr := range w.msg.Answer {
+			srv, ok := rr.(*dns.SRV)
+			if !ok {
+				continue
+			}
+			if want, got := test.priorities[i], srv.Priority; want != got {
+				t.Errorf("degraded %t want priority %d, got %d", test.degraded, want, got)
+			}
+		}
+	}
+}
+
 func TestDNSHandlerMultiQuestions(t *testing.T) {
 	var (
-		h = newDNSHandler(&testStore{}, dns.Fqdn("test.glimpse.io"))
+		h = newDNSHandler(&testStore{}, dns.Fqdn("test.glimpse.io"), false, 0, nil, nil)
 		m = &dns.Msg{}
 		w = &testWriter{}
 	)
@@ -295,7 +394,7 @@ func TestDNSHandlerMultiQuestions(t *testing.T) {
 
 func TestDNSHandlerBrokenStore(t *testing.T) {
 	var (
-		h = newDNSHandler(&brokenStore{}, dns.Fqdn("test.glimpse.io"))
+		h = newDNSHandler(&brokenStore{}, dns.Fqdn("test.glimpse.io"), false, 0, nil, nil)
 		m = &dns.Msg{}
 		w = &testWriter{}
 	)
@@ -313,6 +412,29 @@ func TestDNSHandlerBrokenStore(t *testing.T) {
 	}
 }
 
+func TestDNSHandlerBudget(t *testing.T) {
+	var (
+		h     = newDNSHandler(&hangingStore{}, dns.Fqdn("test.glimpse.io"), false, 10*time.Millisecond, nil, nil)
+		m     = &dns.Msg{}
+		w     = &testWriter{}
+		start = time.Now()
+	)
+
+	m.SetQuestion("http.api.prod.harpoon.tt.test.glimpse.io.", dns.TypeSRV)
+	h.ServeDNS(w, m)
+
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("want answer within budget, took %s", took)
+	}
+	if want, got := dns.RcodeServerFailure, w.msg.Rcode; want != got {
+		t.Errorf(
+			"want rcode %s, got %s",
+			dns.RcodeToString[want],
+			dns.RcodeToString[got],
+		)
+	}
+}
+
 func TestProtocolHandler(t *testing.T) {
 	var (
 		answers     = rand.Intn(12) + 3
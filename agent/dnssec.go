@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	"github.com/miekg/dns"
+)
+
+const (
+	// dnskeyTTL specifies the time in seconds the DNSKEY RRset can be cached.
+	dnskeyTTL uint32 = 3600
+
+	// dnssecSkew backdates the inception of signatures to cover resolvers
+	// with clocks running late.
+	dnssecSkew = time.Hour
+
+	// dnssecCacheSize bounds the number of cached RRset signatures.
+	dnssecCacheSize = 10000
+
+	// dnssecSignAttempts bounds the attempts to sign an RRset with a well
+	// formed ECDSA signature.
+	dnssecSignAttempts = 8
+)
+
+// ecdsaSignatureSizes are the sizes of ECDSA signatures by algorithm. The dns
+// package doesn't pad their components to the curve size, so roughly every
+// 128th signature is too short and fails validation.
+var ecdsaSignatureSizes = map[uint8]int{
+	dns.ECDSAP256SHA256: 64,
+	dns.ECDSAP384SHA384: 96,
+}
+
+// nodataTypes are the types announced by NSEC records denying the queried
+// type of an existing name. Only types answered by glimpse are listed, so
+// resolvers caching the NSEC record aggressively never deny one of them.
+var nodataTypes = []uint16{
+	dns.TypeA,
+	dns.TypeNS,
+	dns.TypeSOA,
+	dns.TypeSRV,
+	dns.TypeRRSIG,
+	dns.TypeNSEC,
+	dns.TypeDNSKEY,
+}
+
+// dnssecKey is a DNSKEY with its private key.
+type dnssecKey struct {
+	dnskey  *dns.DNSKEY
+	private dns.PrivateKey
+}
+
+// readDNSSECKey reads the key from the files <prefix>.key and
+// <prefix>.private as written by dnssec-keygen.
+func readDNSSECKey(prefix string) (*dnssecKey, error) {
+	b, err := ioutil.ReadFile(prefix + ".key")
+	if err != nil {
+		return nil, err
+	}
+
+	rr, err := dns.NewRR(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %s.key: %s", prefix, err)
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("invalid key %s.key: no DNSKEY record", prefix)
+	}
+
+	f, err := os.Open(prefix + ".private")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	private, err := dnskey.ReadPrivateKey(f, prefix+".private")
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %s.private: %s", prefix, err)
+	}
+
+	return &dnssecKey{dnskey: dnskey, private: private}, nil
+}
+
+// signer signs the responses of the zone online. The DNSKEY RRset is signed
+// with the KSK, all other RRsets with the ZSK. Signatures are valid for
+// validity and cached until half of it passed.
+type signer struct {
+	zone     string
+	ksk      *dnssecKey
+	zsk      *dnssecKey
+	validity time.Duration
+
+	now   func() time.Time
+	cache *lru.Cache
+
+	// signRRSIG signs an RRset, see dns.RRSIG.Sign.
+	signRRSIG func(sig *dns.RRSIG, k dns.PrivateKey, rrset []dns.RR) error
+}
+
+// newSigner returns a signer for zone. With a nil ksk the zsk signs all
+// RRsets.
+func newSigner(
+	zone string,
+	ksk, zsk *dnssecKey,
+	validity time.Duration,
+) (*signer, error) {
+	if ksk == nil {
+		ksk = zsk
+	}
+
+	for _, k := range []*dnssecKey{ksk, zsk} {
+		if !strings.EqualFold(k.dnskey.Hdr.Name, zone) {
+			return nil, fmt.Errorf(
+				"key %d is for %s, not %s",
+				k.dnskey.KeyTag(),
+				k.dnskey.Hdr.Name,
+				zone,
+			)
+		}
+	}
+
+	cache, err := lru.New(dnssecCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &signer{
+		zone:      zone,
+		ksk:       ksk,
+		zsk:       zsk,
+		validity:  validity,
+		now:       time.Now,
+		cache:     cache,
+		signRRSIG: (*dns.RRSIG).Sign,
+	}, nil
+}
+
+// dnskeys returns the DNSKEY RRset of the zone apex.
+func (s *signer) dnskeys() []dns.RR {
+	keys := []*dnssecKey{s.ksk}
+	if s.zsk != s.ksk {
+		keys = append(keys, s.zsk)
+	}
+
+	rrs := make([]dns.RR, 0, len(keys))
+	for _, k := range keys {
+		dnskey := *k.dnskey
+		dnskey.Hdr.Name = s.zone
+		dnskey.Hdr.Ttl = dnskeyTTL
+		rrs = append(rrs, &dnskey)
+	}
+
+	return rrs
+}
+
+// secure adds authenticated denial to negative responses and signs the
+// RRsets of the answer and authority sections. Responses from outside of the
+// zone are left alone.
+func (s *signer) secure(res *dns.Msg) error {
+	if !res.Authoritative || len(res.Question) == 0 {
+		return nil
+	}
+
+	if res.Rcode == dns.RcodeNameError ||
+		(res.Rcode == dns.RcodeSuccess && len(res.Answer) == 0) {
+		s.deny(res)
+	}
+
+	var err error
+	if res.Answer, err = s.signSection(res.Answer); err != nil {
+		return err
+	}
+	if res.Ns, err = s.signSection(res.Ns); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// deny turns a negative response into a NODATA response with an NSEC
+// record covering only the queried name, known as black lies
+// (https://tools.ietf.org/html/draft-valsorda-dnsop-black-lies). Denials of
+// non-existent names announce no types but RRSIG and NSEC, so no zone walk
+// is possible and no signed NSEC chain needs to exist.
+func (s *signer) deny(res *dns.Msg) {
+	var (
+		q     = res.Question[0]
+		ttl   = defaultTTL
+		types = []uint16{}
+		extra = []dns.RR{}
+	)
+
+	// Keep the TTL of an SOA added by the handler, which moves to the
+	// authority section.
+	for _, rr := range res.Extra {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = soa.Hdr.Ttl
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	res.Extra = extra
+
+	if res.Rcode == dns.RcodeNameError {
+		types = append(types, dns.TypeRRSIG, dns.TypeNSEC)
+	} else {
+		for _, t := range nodataTypes {
+			if t != q.Qtype {
+				types = append(types, t)
+			}
+		}
+	}
+
+	// The next domain isn't lowercased in the canonical form of NSEC records,
+	// so it's lowercased here to share signatures across query cases.
+	name := strings.ToLower(q.Name)
+
+	res.Rcode = dns.RcodeSuccess
+	res.Ns = append(
+		res.Ns,
+		newSOA(dns.Question{Name: s.zone}, s.zone, ttl),
+		&dns.NSEC{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeNSEC,
+				Class:  dns.ClassINET,
+				Ttl:    defaultTTL,
+			},
+			NextDomain: `\000.` + name,
+			TypeBitMap: types,
+		},
+	)
+}
+
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+// signSection appends the signatures of all RRsets in rrs.
+func (s *signer) signSection(rrs []dns.RR) ([]dns.RR, error) {
+	var (
+		sets  = map[rrsetKey][]dns.RR{}
+		order = []rrsetKey{}
+	)
+
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG {
+			continue
+		}
+
+		key := rrsetKey{name: strings.ToLower(h.Name), rrtype: h.Rrtype}
+		if _, ok := sets[key]; !ok {
+			order = append(order, key)
+		}
+		sets[key] = append(sets[key], rr)
+	}
+
+	for _, key := range order {
+		sig, err := s.sign(sets[key])
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, sig)
+	}
+
+	return rrs, nil
+}
+
+// sign returns the signature of the RRset, from the cache if it's valid for
+// at least half of the validity.
+func (s *signer) sign(rrset []dns.RR) (*dns.RRSIG, error) {
+	k := s.zsk
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		k = s.ksk
+	}
+
+	var (
+		now = s.now()
+		key = rrsetCacheKey(k.dnskey.KeyTag(), rrset)
+	)
+
+	if v, ok := s.cache.Get(key); ok {
+		cached := v.(*dns.RRSIG)
+		if now.Add(s.validity / 2).Before(time.Unix(int64(cached.Expiration), 0)) {
+			dnssecSignatures.WithLabelValues("cached").Inc()
+			return withOwner(cached, rrset[0].Header().Name), nil
+		}
+	}
+
+	sig := &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Ttl: rrset[0].Header().Ttl,
+		},
+		Algorithm:  k.dnskey.Algorithm,
+		KeyTag:     k.dnskey.KeyTag(),
+		SignerName: s.zone,
+		Inception:  uint32(now.Add(-dnssecSkew).Unix()),
+		Expiration: uint32(now.Add(s.validity).Unix()),
+	}
+	if err := s.signRRset(sig, k.private, rrset); err != nil {
+		dnssecSignatures.WithLabelValues("failed").Inc()
+		return nil, err
+	}
+	dnssecSignatures.WithLabelValues("signed").Inc()
+
+	s.cache.Add(key, sig)
+
+	return withOwner(sig, sig.Hdr.Name), nil
+}
+
+// signRRset signs the RRset, signing again while ECDSA signatures come out
+// too short. ECDSA signatures are randomized, so a retry yields another one.
+func (s *signer) signRRset(sig *dns.RRSIG, k dns.PrivateKey, rrset []dns.RR) error {
+	size, ok := ecdsaSignatureSizes[sig.Algorithm]
+
+	for i := 0; i < dnssecSignAttempts; i++ {
+		if err := s.signRRSIG(sig, k, rrset); err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if b, err := base64.StdEncoding.DecodeString(sig.Signature); err == nil && len(b) == size {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no well formed signature after %d attempts", dnssecSignAttempts)
+}
+
+// withOwner returns a copy of the signature for the owner name, which differs
+// from the cached one in case only.
+func withOwner(sig *dns.RRSIG, owner string) *dns.RRSIG {
+	s := *sig
+	s.Hdr.Name = owner
+	return &s
+}
+
+// rrsetCacheKey identifies the signature of an RRset by the key and the
+// canonical RRset, which doesn't depend on the order or case of the records.
+func rrsetCacheKey(keyTag uint16, rrset []dns.RR) string {
+	rrs := make([]string, 0, len(rrset))
+	for _, rr := range rrset {
+		rrs = append(rrs, strings.ToLower(rr.String()))
+	}
+	sort.Strings(rrs)
+
+	return strconv.Itoa(int(keyTag)) + "\n" + strings.Join(rrs, "\n")
+}
+
+// isBlackLie reports whether res denies the existence of the queried name
+// with an NSEC black lie instead of NXDOMAIN.
+func isBlackLie(res *dns.Msg) bool {
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) > 0 {
+		return false
+	}
+
+	for _, rr := range res.Ns {
+		if nsec, ok := rr.(*dns.NSEC); ok && len(nsec.TypeBitMap) == 2 &&
+			nsec.TypeBitMap[0] == dns.TypeRRSIG && nsec.TypeBitMap[1] == dns.TypeNSEC {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dnssecHandler answers DNSKEY queries at the zone apex and signs the
+// responses of next to queries with the DO bit set.
+func dnssecHandler(s *signer, next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		opt := req.IsEdns0()
+		if opt != nil && opt.Do() {
+			w = &dnssecWriter{ResponseWriter: w, signer: s, udpSize: opt.UDPSize()}
+		}
+
+		if len(req.Question) == 1 &&
+			req.Question[0].Qtype == dns.TypeDNSKEY &&
+			strings.EqualFold(req.Question[0].Name, s.zone) {
+			res := newResponse(req)
+			res.Authoritative = true
+			res.Answer = s.dnskeys()
+			w.WriteMsg(res)
+			return
+		}
+
+		next.ServeDNS(w, req)
+	})
+}
+
+type dnssecWriter struct {
+	dns.ResponseWriter
+
+	signer  *signer
+	udpSize uint16
+}
+
+func (w *dnssecWriter) WriteMsg(res *dns.Msg) error {
+	if err := w.signer.secure(res); err != nil {
+		logger.Printf("DNS signing %s failed: %s", res.Question[0].Name, err)
+
+		fail := &dns.Msg{}
+		fail.SetRcode(res, dns.RcodeServerFailure)
+		res = fail
+	}
+
+	if res.IsEdns0() == nil {
+		res.SetEdns0(w.udpSize, true)
+	}
+
+	// Signatures are added after protocolHandler truncated the response,
+	// so it's checked against the buffer size of UDP clients again. Signed
+	// RRsets can't be cut, so oversized responses are truncated entirely
+	// and clients retry over TCP.
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP && res.Len() > w.maxSize() {
+		res.Answer = nil
+		res.Ns = nil
+		res.Extra = []dns.RR{res.IsEdns0()}
+		res.Truncated = true
+	}
+
+	return w.ResponseWriter.WriteMsg(res)
+}
+
+// maxSize returns the size of UDP responses the client accepts.
+func (w *dnssecWriter) maxSize() int {
+	if w.udpSize < dns.MinMsgSize {
+		return dns.MinMsgSize
+	}
+
+	return int(w.udpSize)
+}
+
+// loadSigner returns a signer for zone with the keys read from the kskPrefix
+// and zskPrefix files. An empty kskPrefix makes the ZSK sign all RRsets.
+func loadSigner(
+	zone, kskPrefix, zskPrefix string,
+	validity time.Duration,
+) (*signer, error) {
+	zsk, err := readDNSSECKey(zskPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var ksk *dnssecKey
+	if kskPrefix != "" {
+		if ksk, err = readDNSSECKey(kskPrefix); err != nil {
+			return nil, err
+		}
+	}
+
+	return newSigner(zone, ksk, zsk, validity)
+}
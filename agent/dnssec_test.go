@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testDNSSECZone = "test.glimpse.io."
+
+func generateDNSSECKey(t *testing.T, flags uint16) *dnssecKey {
+	k := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   testDNSSECZone,
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    dnskeyTTL,
+		},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	// Like signatures, the dns package doesn't pad generated public keys,
+	// which are rejected when read back.
+	for {
+		private, err := k.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b, err := base64.StdEncoding.DecodeString(k.PublicKey); err == nil && len(b) == 64 {
+			return &dnssecKey{dnskey: k, private: private}
+		}
+	}
+}
+
+func TestSignRRsetPadding(t *testing.T) {
+	var (
+		k     = generateDNSSECKey(t, 256)
+		rrset = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "a." + testDNSSECZone, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30},
+			A:   net.ParseIP("10.0.0.1"),
+		}}
+	)
+
+	s, err := newSigner(testDNSSECZone, nil, k, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// short signs like the dns package does when a component of the
+	// signature has a leading zero byte, for the first n signatures.
+	short := func(n int) (*int, func(*dns.RRSIG, dns.PrivateKey, []dns.RR) error) {
+		calls := 0
+		return &calls, func(sig *dns.RRSIG, k dns.PrivateKey, rrset []dns.RR) error {
+			calls++
+			if err := sig.Sign(k, rrset); err != nil {
+				return err
+			}
+			if calls <= n {
+				b, _ := base64.StdEncoding.DecodeString(sig.Signature)
+				sig.Signature = base64.StdEncoding.EncodeToString(b[1:])
+			}
+			return nil
+		}
+	}
+
+	newSig := func() *dns.RRSIG {
+		return &dns.RRSIG{
+			Algorithm:  k.dnskey.Algorithm,
+			KeyTag:     k.dnskey.KeyTag(),
+			SignerName: testDNSSECZone,
+			Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+			Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		}
+	}
+
+	calls, sign := short(2)
+	s.signRRSIG = sign
+	sig := newSig()
+	if err := s.signRRset(sig, k.private, rrset); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 3, *calls; want != got {
+		t.Errorf("want %d signing attempts, got %d", want, got)
+	}
+	if err := sig.Verify(k.dnskey, rrset); err != nil {
+		t.Errorf("want verified signature, got %s", err)
+	}
+
+	calls, sign = short(dnssecSignAttempts)
+	s.signRRSIG = sign
+	if err := s.signRRset(newSig(), k.private, rrset); err == nil {
+		t.Errorf("want error for only short signatures")
+	}
+	if want, got := dnssecSignAttempts, *calls; want != got {
+		t.Errorf("want %d signing attempts, got %d", want, got)
+	}
+}
+
+func signedQuery(h dns.Handler, name string, qtype uint16) *dns.Msg {
+	var (
+		w = &testWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.0.0.1")}}
+		m = &dns.Msg{}
+	)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(4096, true)
+	h.ServeDNS(w, m)
+
+	return w.msg
+}
+
+// verifySection verifies the signatures of all RRsets in rrs and returns the
+// number of verified RRsets.
+func verifySection(t *testing.T, s *signer, rrs []dns.RR) int {
+	verified := 0
+
+	for _, rr := range rrs {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+
+		rrset := []dns.RR{}
+		for _, r := range rrs {
+			if r.Header().Rrtype == sig.TypeCovered && r.Header().Name == sig.Hdr.Name {
+				rrset = append(rrset, r)
+			}
+		}
+
+		k := s.zsk
+		if sig.TypeCovered == dns.TypeDNSKEY {
+			k = s.ksk
+		}
+		if err := sig.Verify(k.dnskey, rrset); err != nil {
+			t.Errorf("want valid signature of %s %s: %s", sig.Hdr.Name, dns.TypeToString[sig.TypeCovered], err)
+			continue
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			t.Errorf("want signature of %s valid now", sig.Hdr.Name)
+		}
+		verified++
+	}
+
+	return verified
+}
+
+func TestDNSSECHandler(t *testing.T) {
+	var (
+		ksk   = generateDNSSECKey(t, 257)
+		zsk   = generateDNSSECKey(t, 256)
+		i     = info{service: "http", job: "api", env: "prod", product: "harpoon", zone: "gg"}
+		store = &testStore{instances: map[info]instances{i: generateInstancesFromInfo(i)}}
+	)
+
+	s, err := newSigner(testDNSSECZone, ksk, zsk, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := dnssecHandler(s, newDNSHandler(store, testDNSSECZone, false, 0, nil, nil))
+
+	r := signedQuery(h, testDNSSECZone, dns.TypeDNSKEY)
+	if want, got := 3, len(r.Answer); want != got {
+		t.Fatalf("want %d DNSKEY answers with signature, got %d", want, got)
+	}
+	if want, got := 1, verifySection(t, s, r.Answer); want != got {
+		t.Errorf("want %d verified RRsets, got %d", want, got)
+	}
+	if opt := r.IsEdns0(); opt == nil || !opt.Do() {
+		t.Errorf("want DO bit in response")
+	}
+
+	r = signedQuery(h, "http.api.prod.harpoon.gg."+testDNSSECZone, dns.TypeA)
+	if want, got := 1, verifySection(t, s, r.Answer); want != got {
+		t.Errorf("want %d verified RRsets, got %d", want, got)
+	}
+	first := r.Answer[len(r.Answer)-1].(*dns.RRSIG)
+
+	r = signedQuery(h, "http.api.prod.harpoon.gg."+testDNSSECZone, dns.TypeA)
+	if want, got := 1, verifySection(t, s, r.Answer); want != got {
+		t.Errorf("want %d verified RRsets, got %d", want, got)
+	}
+	if want, got := first.Signature, r.Answer[len(r.Answer)-1].(*dns.RRSIG).Signature; want != got {
+		t.Errorf("want cached signature %s, got %s", want, got)
+	}
+
+	// Queries without the DO bit stay unsigned.
+	w := &testWriter{remoteAddr: &net.UDPAddr{}}
+	m := &dns.Msg{}
+	m.SetQuestion("http.api.prod.harpoon.gg."+testDNSSECZone, dns.TypeA)
+	h.ServeDNS(w, m)
+	for _, rr := range w.msg.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			t.Errorf("want unsigned answer without DO bit, got %s", rr)
+		}
+	}
+}
+
+func TestDNSSECTruncation(t *testing.T) {
+	s, err := newSigner(testDNSSECZone, nil, generateDNSSECKey(t, 257), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		name = "http.api.prod.harpoon.gg." + testDNSSECZone
+		h    = dnssecHandler(s, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			res := newResponse(req)
+			res.Authoritative = true
+			for j := 0; j < 30; j++ {
+				res.Answer = append(res.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30},
+					A:   net.IPv4(10, 0, 0, byte(j+1)),
+				})
+			}
+			w.WriteMsg(res)
+		}))
+		udp = &net.UDPAddr{IP: net.ParseIP("10.0.0.1")}
+		tcp = &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}
+	)
+
+	for _, test := range []struct {
+		addr      net.Addr
+		size      uint16
+		truncated bool
+	}{
+		{addr: udp, size: 512, truncated: true},
+		{addr: udp, size: 4096},
+		{addr: tcp, size: 512},
+	} {
+		var (
+			w = &testWriter{remoteAddr: test.addr}
+			m = &dns.Msg{}
+		)
+		m.SetQuestion(name, dns.TypeA)
+		m.SetEdns0(test.size, true)
+		h.ServeDNS(w, m)
+
+		r := w.msg
+		if want, got := test.truncated, r.Truncated; want != got {
+			t.Errorf("%s/%d: want truncated %t, got %t", test.addr.Network(), test.size, want, got)
+		}
+		if r.IsEdns0() == nil {
+			t.Errorf("%s/%d: want OPT record", test.addr.Network(), test.size)
+		}
+
+		if test.truncated {
+			if want, got := 0, len(r.Answer); want != got {
+				t.Errorf("%s/%d: want %d answers, got %d", test.addr.Network(), test.size, want, got)
+			}
+			b, err := r.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) > int(test.size) {
+				t.Errorf("%s/%d: want at most %d bytes, got %d", test.addr.Network(), test.size, test.size, len(b))
+			}
+			continue
+		}
+
+		if want, got := 1, verifySection(t, s, r.Answer); want != got {
+			t.Errorf("%s/%d: want %d verified RRsets, got %d", test.addr.Network(), test.size, want, got)
+		}
+	}
+}
+
+func TestDNSSECDenial(t *testing.T) {
+	s, err := newSigner(testDNSSECZone, nil, generateDNSSECKey(t, 257), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := dnssecHandler(s, newDNSHandler(&testStore{}, testDNSSECZone, false, 0, nil, nil))
+
+	for _, test := range []struct {
+		name  string
+		qtype uint16
+		nx    bool
+	}{
+		{"http.api.prod.harpoon.gg." + testDNSSECZone, dns.TypeA, true},
+		{"invalid." + testDNSSECZone, dns.TypeA, true},
+		{"http.api.prod.harpoon.gg." + testDNSSECZone, dns.TypeTXT, false},
+	} {
+		r := signedQuery(h, test.name, test.qtype)
+
+		if want, got := dns.RcodeSuccess, r.Rcode; want != got {
+			t.Errorf("%s: want rcode %s, got %s", test.name, dns.RcodeToString[want], dns.RcodeToString[got])
+		}
+		if want, got := test.nx, isBlackLie(r); want != got {
+			t.Errorf("%s: want black lie %t, got %t", test.name, want, got)
+		}
+		if want, got := 2, verifySection(t, s, r.Ns); want != got {
+			t.Errorf("%s: want %d verified RRsets, got %d", test.name, want, got)
+		}
+
+		// The denial survives the wire format.
+		b, err := r.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpacked := &dns.Msg{}
+		if err := unpacked.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+		for _, rr := range unpacked.Ns {
+			nsec, ok := rr.(*dns.NSEC)
+			if !ok {
+				continue
+			}
+			for _, typ := range nsec.TypeBitMap {
+				if typ == test.qtype {
+					t.Errorf("%s: want %s denied, got %s", test.name, dns.TypeToString[typ], nsec)
+				}
+			}
+		}
+		if want, got := 2, verifySection(t, s, unpacked.Ns); want != got {
+			t.Errorf("%s: want %d verified RRsets after unpacking, got %d", test.name, want, got)
+		}
+	}
+}
+
+func TestReadDNSSECKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glimpse-dnssec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		k      = generateDNSSECKey(t, 257)
+		prefix = filepath.Join(dir, "Ktest.glimpse.io.+013+00001")
+	)
+
+	if err := ioutil.WriteFile(prefix+".key", []byte(k.dnskey.String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(prefix+".private", []byte(k.dnskey.PrivateKeyString(k.private)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := loadSigner(testDNSSECZone, "", prefix, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := k.dnskey.KeyTag(), s.ksk.dnskey.KeyTag(); want != got {
+		t.Errorf("want key tag %d, got %d", want, got)
+	}
+
+	if _, err := loadSigner("other.glimpse.io.", "", prefix, time.Hour); err == nil {
+		t.Errorf("want error for key of another zone")
+	}
+}
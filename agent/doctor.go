@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/hashicorp/consul/api"
+)
+
+var (
+	// glimpseTags lists all tags providers are expected to set.
+	glimpseTags = []string{"env", "job", "product", "provider", "service"}
+
+	// optionalGlimpseTags lists tags providers may set.
+	optionalGlimpseTags = []string{"panic"}
+
+	// viewAddrTag prefixes the tags setting the address of a view.
+	viewAddrTag = strings.TrimPrefix(addrTagPrefix, "glimpse:")
+)
+
+// finding describes a glimpse-tagged service instance which is not
+// addressable, ambiguous or inconsistent.
+type finding struct {
+	Zone    string `json:"zone"`
+	Node    string `json:"node"`
+	ID      string `json:"id"`
+	Service string `json:"service"`
+	Addr    string `json:"addr,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+type findings []finding
+
+func (fs findings) Len() int      { return len(fs) }
+func (fs findings) Swap(i, j int) { fs[i], fs[j] = fs[j], fs[i] }
+func (fs findings) Less(i, j int) bool {
+	a, b := fs[i], fs[j]
+
+	switch {
+	case a.Zone != b.Zone:
+		return a.Zone < b.Zone
+	case a.Node != b.Node:
+		return a.Node < b.Node
+	case a.ID != b.ID:
+		return a.ID < b.ID
+	default:
+		return a.Reason < b.Reason
+	}
+}
+
+// runDoctor implements the doctor subcommand, which walks the catalog of all
+// zones and reports every finding. It returns the exit code, which is non-zero
+// if there are findings.
+func runDoctor(args []string, out io.Writer) int {
+	var (
+		flags      = flag.NewFlagSet("doctor", flag.ExitOnError)
+		consulAddr = flags.String("consul.addr", "127.0.0.1:8500", "consul lookup address")
+		format     = flags.String("format", "text", "output format: text or json")
+		consulAuth = newConsulFlags(flags)
+	)
+	flags.Parse(args)
+
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "invalid format: %s\n", *format)
+		return 2
+	}
+
+	hc, _, err := consulAuth.httpClient(0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "configuring consul client failed: %s\n", err)
+		return 2
+	}
+
+	client, err := api.NewClient(&api.Config{
+		Address:    *consulAddr,
+		Scheme:     *consulAuth.scheme,
+		HttpClient: hc,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "consul connection failed: %s\n", err)
+		return 2
+	}
+
+	fs, err := diagnose(client)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "doctor failed: %s\n", err)
+		return 2
+	}
+
+	switch *format {
+	case "json":
+		if err := json.NewEncoder(out).Encode(fs); err != nil {
+			fmt.Fprintf(os.Stderr, "encoding findings failed: %s\n", err)
+			return 2
+		}
+	default:
+		w := tabwriter.NewWriter(out, 0, 8, 1, ' ', 0)
+		fmt.Fprintln(w, "ZONE\tNODE\tID\tADDR\tREASON")
+		for _, f := range fs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", f.Zone, f.Node, f.ID, f.Addr, f.Reason)
+		}
+		w.Flush()
+	}
+
+	if len(fs) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// diagnose checks all glimpse-tagged services in the catalogs of all zones.
+func diagnose(client *api.Client) (findings, error) {
+	zones, err := client.Catalog().Datacenters()
+	if err != nil {
+		return nil, consulError(err)
+	}
+
+	fs := findings{}
+
+	for _, zone := range zones {
+		if !rZone.MatchString(zone) {
+			fs = append(fs, finding{
+				Zone:   zone,
+				Reason: fmt.Sprintf("zone %q is not addressable", zone),
+			})
+			continue
+		}
+
+		opts := &api.QueryOptions{AllowStale: true, Datacenter: zone}
+
+		services, _, err := client.Catalog().Services(opts)
+		if err != nil {
+			return nil, consulError(err)
+		}
+
+		entries := []*api.ServiceEntry{}
+		for name, tags := range services {
+			if !hasGlimpseTag(tags) {
+				continue
+			}
+
+			es, _, err := client.Health().Service(name, "", false, opts)
+			if err != nil {
+				return nil, consulError(err)
+			}
+			entries = append(entries, es...)
+		}
+
+		fs = append(fs, checkEntries(zone, entries)...)
+	}
+
+	sort.Sort(fs)
+
+	return fs, nil
+}
+
+// checkEntries reports the findings for the service entries of a zone.
+func checkEntries(zone string, entries []*api.ServiceEntry) findings {
+	var (
+		fs    = findings{}
+		ports = map[string]*api.ServiceEntry{}
+	)
+
+	for _, e := range entries {
+		if !hasGlimpseTag(e.Service.Tags) {
+			continue
+		}
+
+		var (
+			tags    = map[string][]string{}
+			reasons = []string{}
+			report  = func(format string, args ...interface{}) {
+				reasons = append(reasons, fmt.Sprintf(format, args...))
+			}
+		)
+
+		for _, tag := range e.Service.Tags {
+			if !strings.HasPrefix(tag, "glimpse:") {
+				continue
+			}
+
+			kv := strings.SplitN(strings.TrimPrefix(tag, "glimpse:"), "=", 2)
+			if len(kv) != 2 {
+				report("malformed tag %q", tag)
+				continue
+			}
+
+			tags[kv[0]] = append(tags[kv[0]], kv[1])
+		}
+
+		valid := true
+		for _, name := range glimpseTags {
+			vs := tags[name]
+
+			switch {
+			case len(vs) == 0:
+				report("missing tag glimpse:%s", name)
+				valid = false
+			case len(vs) > 1:
+				report("ambiguous tag glimpse:%s=%s", name, strings.Join(vs, ","))
+				valid = false
+			case !rField.MatchString(vs[0]):
+				report("%s %q is invalid", name, vs[0])
+				valid = false
+			}
+		}
+		for name := range tags {
+			if !isGlimpseTag(name) {
+				report("unknown tag glimpse:%s", name)
+			}
+		}
+		if vs, ok := tags["panic"]; ok {
+			if _, ok := panicThreshold(e.Service.Tags); !ok || len(vs) > 1 {
+				report("invalid panic threshold %s", strings.Join(vs, ","))
+			}
+		}
+		for name, vs := range tags {
+			if !strings.HasPrefix(name, viewAddrTag) {
+				continue
+			}
+
+			view := strings.TrimPrefix(name, viewAddrTag)
+			switch {
+			case !rField.MatchString(view):
+				report("view %q is invalid", view)
+			case len(vs) > 1:
+				report("ambiguous tag glimpse:%s=%s", name, strings.Join(vs, ","))
+			case net.ParseIP(vs[0]) == nil:
+				report("address %q of view %s is invalid", vs[0], view)
+			}
+		}
+
+		if valid && tags["product"][0] != e.Service.Service {
+			report(
+				"product %q differs from service name %q",
+				tags["product"][0],
+				e.Service.Service,
+			)
+		}
+
+		if _, err := entryIP(e); err != nil {
+			if e.Service.Address != "" {
+				report("service address %q is invalid", e.Service.Address)
+			} else {
+				report("node address %q is invalid", e.Node.Address)
+			}
+		}
+
+		key := fmt.Sprintf("%s:%d", e.Node.Node, e.Service.Port)
+		if other, ok := ports[key]; ok {
+			report("port %d also used by %s", e.Service.Port, other.Service.ID)
+		} else {
+			ports[key] = e
+		}
+
+		addr := ""
+		if valid {
+			addr = info{
+				env:     tags["env"][0],
+				job:     tags["job"][0],
+				product: tags["product"][0],
+				service: tags["service"][0],
+				zone:    zone,
+			}.addr()
+		}
+
+		for _, r := range reasons {
+			fs = append(fs, finding{
+				Zone:    zone,
+				Node:    e.Node.Node,
+				ID:      e.Service.ID,
+				Service: e.Service.Service,
+				Addr:    addr,
+				Reason:  r,
+			})
+		}
+	}
+
+	return fs
+}
+
+func hasGlimpseTag(tags []string) bool {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, "glimpse:") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isGlimpseTag(name string) bool {
+	if strings.HasPrefix(name, viewAddrTag) {
+		return true
+	}
+
+	for _, n := range append(glimpseTags, optionalGlimpseTags...) {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
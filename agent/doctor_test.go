@@ -0,0 +1,163 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestCheckEntries(t *testing.T) {
+	var (
+		i = info{
+			service:  "http",
+			job:      "stream",
+			env:      "prod",
+			product:  "goku",
+			provider: "harpoon",
+		}
+		entry = func(id, node, addr string, port int, tags ...string) *api.ServiceEntry {
+			return &api.ServiceEntry{
+				Node: &api.Node{Node: node, Address: addr},
+				Service: &api.AgentService{
+					ID:      id,
+					Service: "goku",
+					Tags:    tags,
+					Port:    port,
+				},
+			}
+		}
+		serviceEntry = func(id, node, addr, serviceAddr string, port int, tags ...string) *api.ServiceEntry {
+			e := entry(id, node, addr, port, tags...)
+			e.Service.Address = serviceAddr
+			return e
+		}
+		tags = infoToTags(i)
+	)
+
+	fs := checkEntries("cz", []*api.ServiceEntry{
+		entry("ok", "host0", "10.0.0.1", 8000, tags...),
+		entry("untagged", "host0", "10.0.0.1", 8000, "redis"),
+		entry("dup", "host0", "10.0.0.1", 8000, tags...),
+		entry("noenv", "host1", "10.0.0.2", 8000, tags[1:]...),
+		entry("twoenvs", "host1", "10.0.0.2", 8001, append(tags, "glimpse:env=qa")...),
+		entry("invalid", "host1", "10.0.0.2", 8002, append(tags[:4:4], "glimpse:service=ht_tp")...),
+		entry("badip", "host2", "10.0.0", 8000, append(tags, "glimpse:foo")...),
+		entry("view", "host3", "10.0.0.4", 8000, append(tags, "glimpse:addr.edge=192.0.2.1")...),
+		entry("badview", "host3", "10.0.0.4", 8001, append(tags, "glimpse:addr.edge=nope")...),
+		serviceEntry("svcaddr", "host4", "10.0.0.5", "10.1.0.5", 8000, tags...),
+		serviceEntry("badsvcaddr", "host4", "10.0.0.5", "10.1.0", 8001, tags...),
+		serviceEntry("badnodeaddr", "host5", "host5.local", "10.1.0.6", 8000, tags...),
+	})
+
+	want := []string{
+		"dup port 8000 also used by ok",
+		"noenv missing tag glimpse:env",
+		"twoenvs ambiguous tag glimpse:env=prod,qa",
+		"invalid service \"ht_tp\" is invalid",
+		"badip malformed tag \"glimpse:foo\"",
+		"badip node address \"10.0.0\" is invalid",
+		"badview address \"nope\" of view edge is invalid",
+		"badsvcaddr service address \"10.1.0\" is invalid",
+	}
+	got := []string{}
+	for _, f := range fs {
+		got = append(got, f.ID+" "+f.Reason)
+	}
+
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want findings\n%q\ngot\n%q", want, got)
+	}
+
+	if want, got := "http.stream.prod.goku.cz", fs[0].Addr; want != got {
+		t.Errorf("want addr %s, got %s", want, got)
+	}
+	if want, got := "", fs[1].Addr; want != got {
+		t.Errorf("want no addr for invalid tags, got %s", got)
+	}
+}
+
+func TestCheckEntriesProductMismatch(t *testing.T) {
+	i := info{
+		service:  "http",
+		job:      "stream",
+		env:      "prod",
+		product:  "goku",
+		provider: "harpoon",
+	}
+
+	fs := checkEntries("cz", []*api.ServiceEntry{
+		&api.ServiceEntry{
+			Node: &api.Node{Node: "host0", Address: "10.0.0.1"},
+			Service: &api.AgentService{
+				ID:      "roshi-8000",
+				Service: "roshi",
+				Tags:    infoToTags(i),
+				Port:    8000,
+			},
+		},
+	})
+
+	if want, got := 1, len(fs); want != got {
+		t.Fatalf("want %d findings, got %d", want, got)
+	}
+	if want, got := `product "goku" differs from service name "roshi"`, fs[0].Reason; want != got {
+		t.Errorf("want reason %s, got %s", want, got)
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	i := info{
+		service:  "http",
+		job:      "stream",
+		env:      "prod",
+		product:  "goku",
+		provider: "harpoon",
+	}
+
+	client, stub := setupStubConsulRoutes(map[string]interface{}{
+		"/v1/catalog/datacenters": []string{"cz", "invalid"},
+		"/v1/catalog/services": map[string][]string{
+			"consul": []string{},
+			"goku":   infoToTags(i),
+		},
+		"/v1/health/service/goku": []*api.ServiceEntry{
+			&api.ServiceEntry{
+				Node: &api.Node{Node: "host0", Address: "10.0.0.1"},
+				Service: &api.AgentService{
+					ID:      "goku-8000",
+					Service: "goku",
+					Tags:    infoToTags(i)[1:],
+					Port:    8000,
+				},
+			},
+		},
+	}, t)
+	defer stub.Close()
+
+	fs, err := diagnose(client)
+	if err != nil {
+		t.Fatalf("diagnose failed: %s", err)
+	}
+
+	want := findings{
+		{
+			Zone:    "cz",
+			Node:    "host0",
+			ID:      "goku-8000",
+			Service: "goku",
+			Reason:  "missing tag glimpse:env",
+		},
+		{
+			Zone:   "invalid",
+			Reason: `zone "invalid" is not addressable`,
+		},
+	}
+	if !reflect.DeepEqual(want, fs) {
+		t.Errorf("want\n%+v\ngot\n%+v", want, fs)
+	}
+
+	if want, got := 0, len(stub.requested("/v1/health/service/consul")); want != got {
+		t.Errorf("want untagged services to be skipped, got %d requests", got)
+	}
+}
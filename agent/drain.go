@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// drainNotePrefix marks maintenance reasons set through glimpse-agent. The
+// expiry is encoded in the note, so it survives restarts of both agents.
+const drainNotePrefix = "glimpse:drain"
+
+// drain describes a maintenance mode set on the local consul-agent, either for
+// a single service instance or for the whole host.
+type drain struct {
+	ID       string     `json:"id,omitempty"`
+	Addr     string     `json:"addr,omitempty"`
+	Port     int        `json:"port,omitempty"`
+	Provider string     `json:"provider,omitempty"`
+	Reason   string     `json:"reason"`
+	Until    *time.Time `json:"until,omitempty"`
+}
+
+type drains struct {
+	Host      *drain  `json:"host"`
+	Instances []drain `json:"instances"`
+}
+
+// drainer takes instances of the local host out of rotation by putting them
+// into consul maintenance mode. Draining instances stay registered but are
+// filtered by every store.
+type drainer struct {
+	agent  *api.Agent
+	logger *log.Logger
+
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+func newDrainer(agent *api.Agent, logger *log.Logger) *drainer {
+	return &drainer{
+		agent:  agent,
+		logger: logger,
+		timers: map[string]*time.Timer{},
+	}
+}
+
+func (d *drainer) drainInstance(id, reason string, until time.Time) error {
+	services, err := d.agent.Services()
+	if err != nil {
+		return consulError(err)
+	}
+	if _, ok := services[id]; !ok {
+		return newError(errNoInstances, "found for id %s", id)
+	}
+
+	return d.enable(id, reason, until)
+}
+
+func (d *drainer) drainProvider(provider, reason string, until time.Time) error {
+	ids, err := d.providerServices(provider)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := d.enable(id, reason, until); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *drainer) drainHost(reason string, until time.Time) error {
+	return d.enable("", reason, until)
+}
+
+func (d *drainer) undrainInstance(id string) error {
+	services, err := d.agent.Services()
+	if err != nil {
+		return consulError(err)
+	}
+	if _, ok := services[id]; !ok {
+		return newError(errNoInstances, "found for id %s", id)
+	}
+
+	return d.disable(id)
+}
+
+func (d *drainer) undrainProvider(provider string) error {
+	ids, err := d.providerServices(provider)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := d.disable(id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *drainer) undrainHost() error {
+	return d.disable("")
+}
+
+// drains returns all maintenance modes currently set on the local
+// consul-agent.
+func (d *drainer) drains() (drains, error) {
+	ds := drains{Instances: []drain{}}
+
+	checks, err := d.agent.Checks()
+	if err != nil {
+		return ds, consulError(err)
+	}
+	services, err := d.agent.Services()
+	if err != nil {
+		return ds, consulError(err)
+	}
+
+	for id, c := range checks {
+		reason, until := parseDrainNote(c.Notes)
+		dr := drain{Reason: reason}
+		if !until.IsZero() {
+			dr.Until = &until
+		}
+
+		switch {
+		case id == nodeMaintenanceID:
+			ds.Host = &dr
+		case strings.HasPrefix(id, serviceMaintenanceID):
+			dr.ID = strings.TrimPrefix(id, serviceMaintenanceID)
+
+			if s, ok := services[dr.ID]; ok {
+				dr.Port = s.Port
+
+				if i, err := infoFromTags(s.Tags); err == nil {
+					dr.Addr = i.addr()
+					dr.Provider = i.provider
+				}
+			}
+
+			ds.Instances = append(ds.Instances, dr)
+		}
+	}
+
+	sort.Sort(drainsByID(ds.Instances))
+
+	return ds, nil
+}
+
+// restore rearms the expiry of maintenance modes set before a restart.
+func (d *drainer) restore() error {
+	checks, err := d.agent.Checks()
+	if err != nil {
+		return consulError(err)
+	}
+
+	for id, c := range checks {
+		_, until := parseDrainNote(c.Notes)
+		if until.IsZero() {
+			continue
+		}
+
+		switch {
+		case id == nodeMaintenanceID:
+			d.expire("", until)
+		case strings.HasPrefix(id, serviceMaintenanceID):
+			d.expire(strings.TrimPrefix(id, serviceMaintenanceID), until)
+		}
+	}
+
+	return nil
+}
+
+func (d *drainer) providerServices(provider string) ([]string, error) {
+	services, err := d.agent.Services()
+	if err != nil {
+		return nil, consulError(err)
+	}
+
+	var (
+		tag = fmt.Sprintf("glimpse:provider=%s", provider)
+		ids = []string{}
+	)
+
+	for id, s := range services {
+		for _, t := range s.Tags {
+			if t == tag {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, newError(errNoInstances, "found for provider %s", provider)
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// enable sets maintenance mode for the given service id or for the host if
+// the id is empty.
+func (d *drainer) enable(id, reason string, until time.Time) error {
+	var (
+		note = formatDrainNote(reason, until)
+		err  error
+	)
+
+	if id == "" {
+		err = d.agent.EnableNodeMaintenance(note)
+	} else {
+		err = d.agent.EnableServiceMaintenance(id, note)
+	}
+	if err != nil {
+		return consulError(err)
+	}
+
+	d.expire(id, until)
+
+	return nil
+}
+
+// disable unsets maintenance mode for the given service id or for the host if
+// the id is empty.
+func (d *drainer) disable(id string) error {
+	var err error
+
+	if id == "" {
+		err = d.agent.DisableNodeMaintenance()
+	} else {
+		err = d.agent.DisableServiceMaintenance(id)
+	}
+	if err != nil {
+		return consulError(err)
+	}
+
+	d.expire(id, time.Time{})
+
+	return nil
+}
+
+// expire replaces the pending expiry for the given id. A zero until only
+// clears it.
+func (d *drainer) expire(id string, until time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if t, ok := d.timers[id]; ok {
+		t.Stop()
+		delete(d.timers, id)
+	}
+
+	if until.IsZero() {
+		return
+	}
+
+	d.timers[id] = time.AfterFunc(until.Sub(time.Now()), func() {
+		if err := d.disable(id); err != nil {
+			d.logger.Printf("DRAIN expiry of %q failed: %s", id, err)
+			return
+		}
+
+		d.logger.Printf("DRAIN expired %q", id)
+	})
+}
+
+func formatDrainNote(reason string, until time.Time) string {
+	fields := []string{drainNotePrefix}
+
+	if !until.IsZero() {
+		fields = append(fields, "until="+until.UTC().Format(time.RFC3339))
+	}
+	if reason != "" {
+		fields = append(fields, reason)
+	}
+
+	return strings.Join(fields, " ")
+}
+
+func parseDrainNote(note string) (reason string, until time.Time) {
+	if !strings.HasPrefix(note, drainNotePrefix) {
+		return note, time.Time{}
+	}
+
+	reason = strings.TrimSpace(strings.TrimPrefix(note, drainNotePrefix))
+
+	if strings.HasPrefix(reason, "until=") {
+		fields := strings.SplitN(strings.TrimPrefix(reason, "until="), " ", 2)
+
+		t, err := time.Parse(time.RFC3339, fields[0])
+		if err == nil {
+			until = t
+		}
+
+		reason = ""
+		if len(fields) == 2 {
+			reason = fields[1]
+		}
+	}
+
+	return reason, until
+}
+
+type drainsByID []drain
+
+func (ds drainsByID) Len() int           { return len(ds) }
+func (ds drainsByID) Swap(i, j int)      { ds[i], ds[j] = ds[j], ds[i] }
+func (ds drainsByID) Less(i, j int) bool { return ds[i].ID < ds[j].ID }
+
+// drainHandler exposes the drainer under /v1/drain:
+//
+//	GET           /v1/drain                  list current drains
+//	PUT, DELETE   /v1/drain/host             drain the host
+//	PUT, DELETE   /v1/drain/provider/<name>  drain all instances of a provider
+//	PUT, DELETE   /v1/drain/instance/<id>    drain a single instance
+//
+// PUT accepts the optional query parameters reason and expiry, the latter as
+// a duration like 15m.
+func drainHandler(d *drainer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			path   = strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/drain"), "/")
+			fields = strings.SplitN(path, "/", 2)
+			kind   = fields[0]
+			name   = ""
+			err    error
+		)
+
+		if len(fields) == 2 {
+			name = fields[1]
+		}
+
+		if kind == "" {
+			if r.Method != "GET" {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			ds, err := d.drains()
+			if err != nil {
+				httpError(w, err)
+				return
+			}
+
+			httpJSON(w, ds)
+			return
+		}
+
+		if (kind == "host") != (name == "") {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case "PUT":
+			var until time.Time
+
+			if expiry := r.URL.Query().Get("expiry"); expiry != "" {
+				dur, err := time.ParseDuration(expiry)
+				if err != nil || dur <= 0 {
+					http.Error(w, fmt.Sprintf("invalid expiry %q", expiry), http.StatusBadRequest)
+					return
+				}
+				until = time.Now().Add(dur)
+			}
+
+			reason := r.URL.Query().Get("reason")
+
+			switch kind {
+			case "host":
+				err = d.drainHost(reason, until)
+			case "provider":
+				err = d.drainProvider(name, reason, until)
+			case "instance":
+				err = d.drainInstance(name, reason, until)
+			default:
+				http.NotFound(w, r)
+				return
+			}
+		case "DELETE":
+			switch kind {
+			case "host":
+				err = d.undrainHost()
+			case "provider":
+				err = d.undrainProvider(name)
+			case "instance":
+				err = d.undrainInstance(name)
+			default:
+				http.NotFound(w, r)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestDrainNote(t *testing.T) {
+	until := time.Date(2015, 4, 1, 12, 30, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		reason string
+		until  time.Time
+		note   string
+	}{
+		{reason: "", note: "glimpse:drain"},
+		{reason: "deploy 42", note: "glimpse:drain deploy 42"},
+		{
+			reason: "deploy 42",
+			until:  until,
+			note:   "glimpse:drain until=2015-04-01T12:30:00Z deploy 42",
+		},
+		{until: until, note: "glimpse:drain until=2015-04-01T12:30:00Z"},
+	} {
+		note := formatDrainNote(test.reason, test.until)
+		if want, got := test.note, note; want != got {
+			t.Errorf("want note %q, got %q", want, got)
+		}
+
+		reason, until := parseDrainNote(note)
+		if want, got := test.reason, reason; want != got {
+			t.Errorf("want reason %q, got %q", want, got)
+		}
+		if want, got := test.until, until; !want.Equal(got) {
+			t.Errorf("want until %s, got %s", want, got)
+		}
+	}
+
+	reason, until := parseDrainNote("set by consul maint")
+	if want, got := "set by consul maint", reason; want != got {
+		t.Errorf("want reason %q, got %q", want, got)
+	}
+	if !until.IsZero() {
+		t.Errorf("want no expiry for foreign note, got %s", until)
+	}
+}
+
+func TestDrainerDrainProvider(t *testing.T) {
+	client, stub := setupStubConsulRoutes(map[string]interface{}{
+		"/v1/agent/services": testDrainServices(),
+	}, t)
+	defer stub.Close()
+
+	d := newDrainer(client.Agent(), log.New(&bytes.Buffer{}, "", 0))
+
+	if err := d.drainProvider("harpoon", "deploy", time.Time{}); err != nil {
+		t.Fatalf("drainProvider failed: %s", err)
+	}
+
+	want := []string{
+		"PUT /v1/agent/service/maintenance/goku-8000?dc=gg&enable=true&reason=glimpse%3Adrain+deploy",
+		"PUT /v1/agent/service/maintenance/goku-8001?dc=gg&enable=true&reason=glimpse%3Adrain+deploy",
+	}
+	if got := stub.requested("/v1/agent/service/maintenance"); !reflect.DeepEqual(want, got) {
+		t.Errorf("want requests\n%v\ngot\n%v", want, got)
+	}
+
+	err := d.drainProvider("bazooka", "deploy", time.Time{})
+	if !isNoInstances(err) {
+		t.Errorf("want %s, got %s", errNoInstances, err)
+	}
+
+	err = d.drainInstance("unknown-1234", "", time.Time{})
+	if !isNoInstances(err) {
+		t.Errorf("want %s, got %s", errNoInstances, err)
+	}
+}
+
+func TestDrainerExpiry(t *testing.T) {
+	client, stub := setupStubConsulRoutes(map[string]interface{}{}, t)
+	defer stub.Close()
+
+	d := newDrainer(client.Agent(), log.New(&bytes.Buffer{}, "", 0))
+
+	if err := d.drainHost("", time.Now().Add(10*time.Millisecond)); err != nil {
+		t.Fatalf("drainHost failed: %s", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	reqs := stub.requested("/v1/agent/maintenance")
+	if want, got := 2, len(reqs); want != got {
+		t.Fatalf("want %d requests, got %d: %v", want, got, reqs)
+	}
+	if want, got := "PUT /v1/agent/maintenance?dc=gg&enable=false", reqs[1]; want != got {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
+
+func TestDrainHandler(t *testing.T) {
+	client, stub := setupStubConsulRoutes(map[string]interface{}{
+		"/v1/agent/services": testDrainServices(),
+		"/v1/agent/checks": map[string]*api.AgentCheck{
+			nodeMaintenanceID: &api.AgentCheck{
+				CheckID: nodeMaintenanceID,
+				Notes:   "glimpse:drain reboot",
+			},
+			serviceMaintenanceID + "goku-8001": &api.AgentCheck{
+				CheckID: serviceMaintenanceID + "goku-8001",
+				Notes:   "glimpse:drain until=2015-04-01T12:30:00Z deploy",
+			},
+			"service:goku-8000": &api.AgentCheck{
+				CheckID: "service:goku-8000",
+			},
+		},
+	}, t)
+	defer stub.Close()
+
+	h := drainHandler(newDrainer(client.Agent(), log.New(&bytes.Buffer{}, "", 0)))
+
+	for _, test := range []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{method: "PUT", path: "/v1/drain/host?reason=reboot", code: http.StatusNoContent},
+		{method: "DELETE", path: "/v1/drain/host", code: http.StatusNoContent},
+		{method: "PUT", path: "/v1/drain/host/foo", code: http.StatusNotFound},
+		{method: "PUT", path: "/v1/drain/provider", code: http.StatusNotFound},
+		{method: "PUT", path: "/v1/drain/provider/bazooka", code: http.StatusNotFound},
+		{method: "PUT", path: "/v1/drain/instance/goku-8000?expiry=1h", code: http.StatusNoContent},
+		{method: "PUT", path: "/v1/drain/instance/goku-8000?expiry=-1h", code: http.StatusBadRequest},
+		{method: "DELETE", path: "/v1/drain/instance/goku-8000", code: http.StatusNoContent},
+		{method: "POST", path: "/v1/drain", code: http.StatusMethodNotAllowed},
+		{method: "GET", path: "/v1/drain/nonsense/foo", code: http.StatusMethodNotAllowed},
+	} {
+		var (
+			w      = httptest.NewRecorder()
+			r, err = http.NewRequest(test.method, test.path, nil)
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h.ServeHTTP(w, r)
+
+		if want, got := test.code, w.Code; want != got {
+			t.Errorf("%s %s want code %d, got %d", test.method, test.path, want, got)
+		}
+	}
+
+	var (
+		w      = httptest.NewRecorder()
+		r, err = http.NewRequest("GET", "/v1/drain", nil)
+		ds     = drains{}
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.ServeHTTP(w, r)
+
+	if want, got := http.StatusOK, w.Code; want != got {
+		t.Fatalf("want code %d, got %d", want, got)
+	}
+	if err := json.NewDecoder(w.Body).Decode(&ds); err != nil {
+		t.Fatalf("decoding drains failed: %s", err)
+	}
+
+	if ds.Host == nil {
+		t.Fatal("want host to be drained")
+	}
+	if want, got := "reboot", ds.Host.Reason; want != got {
+		t.Errorf("want host reason %q, got %q", want, got)
+	}
+	if want, got := 1, len(ds.Instances); want != got {
+		t.Fatalf("want %d drained instances, got %d", want, got)
+	}
+
+	until := time.Date(2015, 4, 1, 12, 30, 0, 0, time.UTC)
+	want := drain{
+		ID:       "goku-8001",
+		Addr:     "http.stream.prod.goku",
+		Port:     8001,
+		Provider: "harpoon",
+		Reason:   "deploy",
+		Until:    &until,
+	}
+	got := ds.Instances[0]
+	if !want.Until.Equal(*got.Until) {
+		t.Errorf("want until %s, got %s", want.Until, got.Until)
+	}
+	want.Until, got.Until = nil, nil
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+}
+
+func testDrainServices() map[string]*api.AgentService {
+	i := info{
+		service:  "http",
+		job:      "stream",
+		env:      "prod",
+		product:  "goku",
+		provider: "harpoon",
+	}
+
+	return map[string]*api.AgentService{
+		"goku-8000": &api.AgentService{
+			ID:      "goku-8000",
+			Service: i.product,
+			Tags:    infoToTags(i),
+			Port:    8000,
+		},
+		"goku-8001": &api.AgentService{
+			ID:      "goku-8001",
+			Service: i.product,
+			Tags:    infoToTags(i),
+			Port:    8001,
+		},
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// dotIdleTimeout is the time a DoT connection is kept open without
+	// queries, see https://tools.ietf.org/html/rfc7858#section-3.4.
+	dotIdleTimeout = 10 * time.Second
+
+	// dohPath is the path of the DoH endpoint.
+	dohPath = "/dns-query"
+
+	dohContentType = "application/dns-message"
+)
+
+// Protocols of the encrypted listeners, used as the protocol label of the
+// DNS metrics.
+const (
+	protocolDoT = "dot"
+	protocolDoH = "doh"
+)
+
+// encryptedAddr is the address of a DoT or DoH client. Its network is the
+// protocol, so the handlers can tell them apart from plain TCP.
+type encryptedAddr struct {
+	*net.TCPAddr
+
+	protocol string
+}
+
+func (a encryptedAddr) Network() string { return a.protocol }
+
+// encryptedWriter implements the dns.ResponseWriter interface for the DoT
+// and DoH listeners.
+type encryptedWriter struct {
+	local  net.Addr
+	remote net.Addr
+	write  func(*dns.Msg) error
+}
+
+func (w *encryptedWriter) WriteMsg(m *dns.Msg) error { return w.write(m) }
+func (w *encryptedWriter) LocalAddr() net.Addr       { return w.local }
+func (w *encryptedWriter) RemoteAddr() net.Addr      { return w.remote }
+func (w *encryptedWriter) Close() error              { return nil }
+func (w *encryptedWriter) TsigStatus() error         { return nil }
+func (w *encryptedWriter) TsigTimersOnly(bool)       {}
+func (w *encryptedWriter) Hijack()                   {}
+
+func (w *encryptedWriter) Write(b []byte) (int, error) {
+	m := &dns.Msg{}
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+
+	return len(b), w.write(m)
+}
+
+// dotServer serves DNS over TLS (https://tools.ietf.org/html/rfc7858).
+// Queries on a connection are answered concurrently, in the order their
+// answers are ready.
+type dotServer struct {
+	addr    string
+	config  *tls.Config
+	handler dns.Handler
+}
+
+func (s *dotServer) ListenAndServe() error {
+	l, err := tls.Listen("tcp", s.addr, s.config)
+	if err != nil {
+		return err
+	}
+
+	return s.serve(l)
+}
+
+func (s *dotServer) serve(l net.Listener) error {
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+func (s *dotServer) serveConn(conn net.Conn) {
+	var (
+		mu sync.Mutex // guards writes to conn
+		wg sync.WaitGroup
+		w  = &encryptedWriter{
+			local: conn.LocalAddr(),
+			write: func(m *dns.Msg) error {
+				b, err := m.Pack()
+				if err != nil {
+					return err
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				_, err = conn.Write(append([]byte{byte(len(b) >> 8), byte(len(b))}, b...))
+				return err
+			},
+		}
+	)
+	defer conn.Close()
+	defer wg.Wait()
+
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		w.remote = encryptedAddr{TCPAddr: addr, protocol: protocolDoT}
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(dotIdleTimeout))
+
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+
+		b := make([]byte, length)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+
+		req := &dns.Msg{}
+		if err := req.Unpack(b); err != nil {
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handler.ServeDNS(w, req)
+		}()
+	}
+}
+
+// dohHandler serves DNS over HTTPS (https://tools.ietf.org/html/rfc8484)
+// with GET and POST requests.
+func dohHandler(next dns.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			b   []byte
+			err error
+		)
+
+		switch r.Method {
+		case "GET":
+			b, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case "POST":
+			if r.Header.Get("Content-Type") != dohContentType {
+				http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+				return
+			}
+			b, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil || len(b) == 0 {
+			http.Error(w, "invalid DNS message", http.StatusBadRequest)
+			return
+		}
+
+		req := &dns.Msg{}
+		if err := req.Unpack(b); err != nil {
+			http.Error(w, fmt.Sprintf("invalid DNS message: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		var (
+			res *dns.Msg
+			dw  = &encryptedWriter{
+				write: func(m *dns.Msg) error {
+					res = m
+					return nil
+				},
+			}
+		)
+		if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+			dw.remote = encryptedAddr{TCPAddr: addr, protocol: protocolDoH}
+		}
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			dw.local = addr
+		}
+
+		next.ServeDNS(dw, req)
+
+		// Shed queries are dropped without an answer.
+		if res == nil {
+			http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		out, err := res.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", dohContentType)
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(minTTL(res))))
+		w.Write(out)
+	})
+}
+
+// minTTL returns the lowest TTL of the records in res, which bounds the time
+// HTTP caches may keep the response.
+func minTTL(res *dns.Msg) uint32 {
+	var (
+		ttl   uint32
+		found bool
+	)
+
+	for _, section := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !found || h.Ttl < ttl {
+				ttl = h.Ttl
+				found = true
+			}
+		}
+	}
+
+	return ttl
+}
+
+// runDoHServer serves DoH on addr with handler, using the TLS
+// configuration.
+func runDoHServer(addr string, config *tls.Config, handler dns.Handler, errc chan error) {
+	mux := http.NewServeMux()
+	mux.Handle(dohPath, dohHandler(handler))
+
+	server := &http.Server{Addr: addr, Handler: mux, TLSConfig: config}
+
+	logger.Printf("DNS/%s listening on %s\n", protocolDoH, addr)
+	errc <- fmt.Errorf(
+		"[error] DNS/%s - server failed: %s", protocolDoH,
+		server.ListenAndServeTLS("", ""),
+	)
+}
+
+// runDoTServer serves DoT on addr with handler, using the TLS
+// configuration.
+func runDoTServer(addr string, config *tls.Config, handler dns.Handler, errc chan error) {
+	server := &dotServer{addr: addr, config: config, handler: handler}
+
+	logger.Printf("DNS/%s listening on %s\n", protocolDoT, addr)
+	errc <- fmt.Errorf(
+		"[error] DNS/%s - server failed: %s", protocolDoT,
+		server.ListenAndServe(),
+	)
+}
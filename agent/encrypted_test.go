@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// networkEcho answers with the protocol and address of the client in a TXT
+// record.
+var networkEcho = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+	res := newResponse(req)
+	res.Answer = append(res.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   req.Question[0].Name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTTL,
+		},
+		Txt: []string{w.RemoteAddr().Network(), clientIP(w.RemoteAddr())},
+	})
+	w.WriteMsg(res)
+})
+
+func TestDoTServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glimpse-dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, err := newCertificate(writeTestCertificate(t, dir, "dot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cert.tlsConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go (&dotServer{handler: networkEcho}).serve(l)
+
+	leaf, err := x509.ParseCertificate(cert.cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Pipelined queries on one connection.
+	names := map[string]bool{"a.test.glimpse.io.": true, "b.test.glimpse.io.": true}
+	for name := range names {
+		m := &dns.Msg{}
+		m.SetQuestion(name, dns.TypeTXT)
+		b, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := binary.Write(conn, binary.BigEndian, uint16(len(b))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for range names {
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, length)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatal(err)
+		}
+
+		res := &dns.Msg{}
+		if err := res.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+		if !names[res.Question[0].Name] {
+			t.Errorf("want answer to a pending query, got %s", res.Question[0].Name)
+		}
+		delete(names, res.Question[0].Name)
+
+		txt := res.Answer[0].(*dns.TXT).Txt
+		if want, got := protocolDoT, txt[0]; want != got {
+			t.Errorf("want protocol %s, got %s", want, got)
+		}
+		if want, got := "127.0.0.1", txt[1]; want != got {
+			t.Errorf("want client %s, got %s", want, got)
+		}
+	}
+}
+
+func TestDoHHandler(t *testing.T) {
+	m := &dns.Msg{}
+	m.SetQuestion("a.test.glimpse.io.", dns.TypeTXT)
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest("GET", dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(b), nil),
+		httptest.NewRequest("POST", dohPath, bytes.NewReader(b)),
+	} {
+		r.Header.Set("Content-Type", dohContentType)
+		r.RemoteAddr = "10.0.0.1:4321"
+
+		rec := httptest.NewRecorder()
+		dohHandler(networkEcho).ServeHTTP(rec, r)
+
+		if want, got := http.StatusOK, rec.Code; want != got {
+			t.Fatalf("%s: want status %d, got %d: %s", r.Method, want, got, rec.Body)
+		}
+		if want, got := dohContentType, rec.Header().Get("Content-Type"); want != got {
+			t.Errorf("%s: want content type %s, got %s", r.Method, want, got)
+		}
+		if want, got := "max-age=5", rec.Header().Get("Cache-Control"); want != got {
+			t.Errorf("%s: want cache control %s, got %s", r.Method, want, got)
+		}
+
+		res := &dns.Msg{}
+		if err := res.Unpack(rec.Body.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		txt := res.Answer[0].(*dns.TXT).Txt
+		if want, got := protocolDoH, txt[0]; want != got {
+			t.Errorf("%s: want protocol %s, got %s", r.Method, want, got)
+		}
+		if want, got := "10.0.0.1", txt[1]; want != got {
+			t.Errorf("%s: want client %s, got %s", r.Method, want, got)
+		}
+	}
+
+	for _, test := range []struct {
+		r    *http.Request
+		want int
+	}{
+		{httptest.NewRequest("GET", dohPath+"?dns=!", nil), http.StatusBadRequest},
+		{httptest.NewRequest("POST", dohPath, bytes.NewReader(b)), http.StatusUnsupportedMediaType},
+		{httptest.NewRequest("PUT", dohPath, bytes.NewReader(b)), http.StatusMethodNotAllowed},
+	} {
+		rec := httptest.NewRecorder()
+		dohHandler(networkEcho).ServeHTTP(rec, test.r)
+
+		if test.want != rec.Code {
+			t.Errorf("%s %s: want status %d, got %d", test.r.Method, test.r.URL, test.want, rec.Code)
+		}
+	}
+
+	// Dropped queries have no answer.
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	dohHandler(dns.HandlerFunc(func(dns.ResponseWriter, *dns.Msg) {})).ServeHTTP(rec, r)
+	if want, got := http.StatusServiceUnavailable, rec.Code; want != got {
+		t.Errorf("want status %d, got %d", want, got)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// consulProbePath is requested to probe Consul endpoints. It's answered by
+// agents and servers without an ACL token.
+const consulProbePath = "/v1/status/leader"
+
+// parseEndpoints parses a comma separated list of Consul endpoints in the
+// order of preference, e.g. "127.0.0.1:8500,10.0.0.1:8500".
+func parseEndpoints(s string) ([]string, error) {
+	var (
+		es   = []string{}
+		seen = map[string]bool{}
+	)
+
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			return nil, fmt.Errorf("empty endpoint in %q", s)
+		}
+		if seen[e] {
+			return nil, fmt.Errorf("endpoint %s defined twice", e)
+		}
+		seen[e] = true
+
+		es = append(es, e)
+	}
+
+	return es, nil
+}
+
+// failover sends Consul API requests to the active one of an ordered list of
+// endpoints. Requests failing to connect are retried with the next healthy
+// endpoint, which becomes active. Probes mark endpoints healthy again, and
+// the first healthy endpoint is always preferred.
+type failover struct {
+	scheme    string
+	endpoints []string
+	next      http.RoundTripper
+
+	// changed is called whenever the active endpoint changes.
+	changed func(from, to string)
+
+	mu      sync.RWMutex
+	healthy []bool
+	active  int
+}
+
+func newFailover(
+	scheme string,
+	endpoints []string,
+	next http.RoundTripper,
+	changed func(from, to string),
+) *failover {
+	f := &failover{
+		scheme:    scheme,
+		endpoints: endpoints,
+		next:      next,
+		changed:   changed,
+		healthy:   make([]bool, len(endpoints)),
+	}
+	for i, e := range endpoints {
+		f.healthy[i] = true
+		consulEndpointHealthy.WithLabelValues(e).Set(1)
+		consulEndpointActive.WithLabelValues(e).Set(0)
+	}
+	consulEndpointActive.WithLabelValues(endpoints[0]).Set(1)
+
+	return f
+}
+
+func (f *failover) RoundTrip(r *http.Request) (*http.Response, error) {
+	tried := make([]bool, len(f.endpoints))
+
+	f.mu.RLock()
+	i := f.active
+	f.mu.RUnlock()
+
+	for {
+		tried[i] = true
+
+		req, err := f.request(r, f.endpoints[i])
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := f.next.RoundTrip(req)
+		if err == nil || !isConnectError(err) || r.Context().Err() != nil {
+			return res, err
+		}
+
+		next, ok := f.fail(i, tried)
+		// Requests with bodies which can't be replayed aren't retried.
+		if !ok || (r.Body != nil && r.GetBody == nil) {
+			return nil, err
+		}
+		i = next
+	}
+}
+
+// request returns a copy of r sent to endpoint.
+func (f *failover) request(r *http.Request, endpoint string) (*http.Request, error) {
+	req := r.Clone(r.Context())
+	req.URL.Host = endpoint
+	req.Host = endpoint
+
+	if r.Body != nil && r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = body
+	}
+
+	return req, nil
+}
+
+// fail marks endpoint i unhealthy and returns the first healthy endpoint not
+// tried yet, which becomes active, and false if there is none.
+func (f *failover) fail(i int, tried []bool) (int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.setHealthy(i, false)
+
+	for j, ok := range f.healthy {
+		if ok && !tried[j] {
+			f.activate(j)
+			return j, true
+		}
+	}
+
+	return i, false
+}
+
+// probe checks the health of all endpoints and activates the first healthy
+// one. The active endpoint is kept if none is healthy.
+func (f *failover) probe(timeout time.Duration) {
+	healthy := make([]bool, len(f.endpoints))
+	for i, e := range f.endpoints {
+		healthy[i] = f.check(e, timeout) == nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, ok := range healthy {
+		f.setHealthy(i, ok)
+	}
+	for i, ok := range healthy {
+		if ok {
+			f.activate(i)
+			break
+		}
+	}
+}
+
+func (f *failover) check(endpoint string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", f.scheme+"://"+endpoint+consulProbePath, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := f.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	ioutil.ReadAll(res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return nil
+}
+
+// run probes all endpoints every interval.
+func (f *failover) run(interval, timeout time.Duration) {
+	for range time.Tick(interval) {
+		f.probe(timeout)
+	}
+}
+
+// setHealthy must be called with mu held.
+func (f *failover) setHealthy(i int, ok bool) {
+	f.healthy[i] = ok
+
+	v := 0.0
+	if ok {
+		v = 1
+	}
+	consulEndpointHealthy.WithLabelValues(f.endpoints[i]).Set(v)
+}
+
+// activate must be called with mu held.
+func (f *failover) activate(i int) {
+	if f.active == i {
+		return
+	}
+
+	from, to := f.endpoints[f.active], f.endpoints[i]
+	f.active = i
+
+	consulEndpointActive.WithLabelValues(from).Set(0)
+	consulEndpointActive.WithLabelValues(to).Set(1)
+	consulFailovers.Inc()
+
+	if f.changed != nil {
+		f.changed(from, to)
+	}
+}
+
+// consulEndpoint is the state of a Consul endpoint as exposed by
+// statusHandler.
+type consulEndpoint struct {
+	Address string `json:"address"`
+	Healthy bool   `json:"healthy"`
+	Active  bool   `json:"active"`
+}
+
+func (f *failover) status() []consulEndpoint {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	es := make([]consulEndpoint, len(f.endpoints))
+	for i, e := range f.endpoints {
+		es[i] = consulEndpoint{
+			Address: e,
+			Healthy: f.healthy[i],
+			Active:  i == f.active,
+		}
+	}
+
+	return es
+}
+
+// isConnectError reports whether err happened before the request was sent,
+// which makes it safe to retry with another endpoint.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
+
+// agentStatus is the answer of statusHandler.
+type agentStatus struct {
+	Version string           `json:"version"`
+	Store   string           `json:"store"`
+	Consul  []consulEndpoint `json:"consul,omitempty"`
+}
+
+// statusHandler answers GET /v1/status with the agent version, the kind of
+// store and the state of the Consul endpoints, if the store uses Consul.
+func statusHandler(kind string, f *failover) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		status := agentStatus{Version: version, Store: kind}
+		if f != nil {
+			status.Consul = f.status()
+		}
+
+		httpJSON(w, status)
+	})
+}
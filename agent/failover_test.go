@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEndpoints(t *testing.T) {
+	es, err := parseEndpoints("127.0.0.1:8500, 10.0.0.1:8500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"127.0.0.1:8500", "10.0.0.1:8500"}; !reflect.DeepEqual(want, es) {
+		t.Errorf("want endpoints %v, got %v", want, es)
+	}
+
+	for _, in := range []string{"", "127.0.0.1:8500,", "127.0.0.1:8500,127.0.0.1:8500"} {
+		if _, err := parseEndpoints(in); err == nil {
+			t.Errorf("want error for %q", in)
+		}
+	}
+}
+
+// closedAddr returns an address nothing listens on.
+func closedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	return addr
+}
+
+func TestFailover(t *testing.T) {
+	var (
+		down = closedAddr(t)
+		up   = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Host))
+		}))
+		upAddr   = strings.TrimPrefix(up.URL, "http://")
+		failures = []string{}
+	)
+	defer up.Close()
+
+	f := newFailover("http", []string{down, upAddr}, http.DefaultTransport, func(from, to string) {
+		failures = append(failures, from+" -> "+to)
+	})
+	client := &http.Client{Transport: f}
+
+	for i := 0; i < 2; i++ {
+		res, err := client.Get("http://" + down + "/v1/health/service/http")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if want, got := upAddr, string(b); want != got {
+			t.Errorf("want request sent to %s, got %s", want, got)
+		}
+	}
+
+	if want := []string{down + " -> " + upAddr}; !reflect.DeepEqual(want, failures) {
+		t.Errorf("want failovers %v, got %v", want, failures)
+	}
+
+	want := []consulEndpoint{
+		{Address: down, Healthy: false, Active: false},
+		{Address: upAddr, Healthy: true, Active: true},
+	}
+	if got := f.status(); !reflect.DeepEqual(want, got) {
+		t.Errorf("want status %v, got %v", want, got)
+	}
+
+	// A probe finding the first endpoint unhealthy keeps the second active.
+	f.probe(time.Second)
+	if got := f.status(); !reflect.DeepEqual(want, got) {
+		t.Errorf("want status %v after probe, got %v", want, got)
+	}
+
+	// Requests fail once no endpoint is left.
+	up.Close()
+	if _, err := client.Get("http://" + down + "/"); err == nil {
+		t.Errorf("want error without healthy endpoints")
+	}
+}
+
+func TestFailoverPrefersFirstHealthy(t *testing.T) {
+	var servers []string
+	for i := 0; i < 2; i++ {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != consulProbePath {
+				t.Errorf("want probe of %s, got %s", consulProbePath, r.URL.Path)
+			}
+		}))
+		defer s.Close()
+		servers = append(servers, strings.TrimPrefix(s.URL, "http://"))
+	}
+
+	f := newFailover("http", servers, http.DefaultTransport, nil)
+	f.fail(0, make([]bool, 2))
+	if !f.status()[1].Active {
+		t.Fatalf("want second endpoint active after failure")
+	}
+
+	f.probe(time.Second)
+	if !f.status()[0].Active || !f.status()[0].Healthy {
+		t.Errorf("want first endpoint active again after successful probe")
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	f := newFailover("http", []string{"127.0.0.1:8500"}, http.DefaultTransport, nil)
+
+	w := httptest.NewRecorder()
+	statusHandler(storeConsul, f).ServeHTTP(w, httptest.NewRequest("GET", "/v1/status", nil))
+
+	var got agentStatus
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := agentStatus{
+		Version: version,
+		Store:   storeConsul,
+		Consul:  []consulEndpoint{{Address: "127.0.0.1:8500", Healthy: true, Active: true}},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want status %v, got %v", want, got)
+	}
+
+	w = httptest.NewRecorder()
+	statusHandler(storeConsul, f).ServeHTTP(w, httptest.NewRequest("POST", "/v1/status", nil))
+	if want, got := http.StatusMethodNotAllowed, w.Code; want != got {
+		t.Errorf("want status code %d, got %d", want, got)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/hcl"
+)
+
+const (
+	storeConsul = "consul"
+	storeFile   = "file"
+)
+
+// fileInstance is an instance of a service in the store file.
+type fileInstance struct {
+	Host   string            `hcl:"host"`
+	IP     string            `hcl:"ip"`
+	Port   int               `hcl:"port"`
+	Status string            `hcl:"status"`
+	Addrs  map[string]string `hcl:"addrs"`
+}
+
+// fileService is a service address with its instances.
+type fileService struct {
+	Address   string         `hcl:"address"`
+	Instances []fileInstance `hcl:"instance"`
+}
+
+// fileServer is a nameserver of a zone.
+type fileServer struct {
+	Host string `hcl:"host"`
+	IP   string `hcl:"ip"`
+	Zone string `hcl:"zone"`
+}
+
+// fileConfig is the topology of the file store in HCL or JSON, e.g.:
+//
+//	service {
+//	  address = "http.api.prod.harpoon.gg"
+//
+//	  instance {
+//	    host = "host-1"
+//	    ip   = "10.0.0.1"
+//	    port = 8080
+//	  }
+//
+//	  instance {
+//	    host   = "host-2"
+//	    ip     = "10.0.0.2"
+//	    port   = 8080
+//	    status = "warning"
+//	  }
+//	}
+//
+//	server {
+//	  host = "ns-1"
+//	  ip   = "10.0.0.53"
+//	  zone = "gg"
+//	}
+//
+// The status of instances defaults to passing.
+type fileConfig struct {
+	Services []fileService `hcl:"service"`
+	Servers  []fileServer  `hcl:"server"`
+}
+
+// fileTopology is the parsed topology of the file store.
+type fileTopology struct {
+	services map[info]instances
+	servers  map[string]instances
+	zones    map[string]bool
+}
+
+func parseFileTopology(in string) (*fileTopology, error) {
+	c := &fileConfig{}
+	if err := hcl.Decode(c, in); err != nil {
+		return nil, err
+	}
+
+	t := &fileTopology{
+		services: map[info]instances{},
+		servers:  map[string]instances{},
+		zones:    map[string]bool{},
+	}
+
+	for _, s := range c.Services {
+		i, err := infoFromAddr(s.Address)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := t.services[i]; ok {
+			return nil, fmt.Errorf("service %s defined twice", s.Address)
+		}
+
+		is := instances{}
+		for _, fi := range s.Instances {
+			in, err := fi.instance()
+			if err != nil {
+				return nil, fmt.Errorf("service %s: %s", s.Address, err)
+			}
+			is = append(is, in)
+		}
+		sort.Sort(is)
+
+		t.services[i] = is
+		t.zones[i.zone] = true
+	}
+
+	for _, s := range c.Servers {
+		if !rZone.MatchString(s.Zone) {
+			return nil, fmt.Errorf("server %s: zone %q is invalid", s.Host, s.Zone)
+		}
+		ip := net.ParseIP(s.IP)
+		if ip == nil {
+			return nil, fmt.Errorf("server %s: %s", s.Host, newError(errInvalidIP, "%q", s.IP))
+		}
+
+		t.servers[s.Zone] = append(t.servers[s.Zone], instance{host: s.Host, ip: ip})
+		t.zones[s.Zone] = true
+	}
+
+	return t, nil
+}
+
+func (fi fileInstance) instance() (instance, error) {
+	ip := net.ParseIP(fi.IP)
+	if ip == nil {
+		return instance{}, fmt.Errorf("instance %s: %s", fi.Host, newError(errInvalidIP, "%q", fi.IP))
+	}
+	if fi.Port <= 0 || fi.Port > 65535 {
+		return instance{}, fmt.Errorf("instance %s: port %d is invalid", fi.Host, fi.Port)
+	}
+
+	status := fi.Status
+	switch status {
+	case "":
+		status = checkPassing
+	case checkPassing, checkWarning, checkCritical:
+	default:
+		return instance{}, fmt.Errorf("instance %s: status %q is invalid", fi.Host, fi.Status)
+	}
+
+	in := instance{host: fi.Host, ip: ip, port: uint16(fi.Port), status: status}
+
+	if len(fi.Addrs) > 0 {
+		in.addrs = map[string]net.IP{}
+		for view, addr := range fi.Addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return instance{}, fmt.Errorf("instance %s: view %s: %s", fi.Host, view, newError(errInvalidIP, "%q", addr))
+			}
+			in.addrs[view] = ip
+		}
+	}
+
+	return in, nil
+}
+
+// fileStore serves the topology read from a HCL or JSON file instead of
+// Consul, for running the agent standalone or while Consul is unusable. The
+// file can be reloaded at runtime.
+type fileStore struct {
+	path string
+
+	mu       sync.RWMutex
+	topology *fileTopology
+	modified time.Time
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	s := &fileStore{path: path}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// load replaces the topology with the one read from path. The current
+// topology stays in place if the file is invalid.
+func (s *fileStore) load() error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	t, err := parseFileTopology(string(b))
+	if err != nil {
+		return fmt.Errorf("invalid store file %s: %s", s.path, err)
+	}
+
+	s.mu.Lock()
+	s.topology = t
+	s.modified = fi.ModTime()
+	s.mu.Unlock()
+
+	return nil
+}
+
+// watch reloads the file every interval if it was modified since it was last
+// loaded.
+func (s *fileStore) watch(interval time.Duration, logger *log.Logger) {
+	for range time.Tick(interval) {
+		fi, err := os.Stat(s.path)
+		if err != nil {
+			logger.Printf("[warning] store file not reloaded: %s", err)
+			continue
+		}
+
+		s.mu.RLock()
+		modified := s.modified
+		s.mu.RUnlock()
+
+		if fi.ModTime().Equal(modified) {
+			continue
+		}
+
+		if err := s.load(); err != nil {
+			logger.Printf("[warning] store file not reloaded: %s", err)
+			continue
+		}
+		logger.Printf("STORE file %s reloaded", s.path)
+	}
+}
+
+// getInstances returns healthy instances only.
+func (s *fileStore) getInstances(ctx context.Context, i info) (instances, error) {
+	return s.getInstancesByHealth(ctx, i, healthPassing)
+}
+
+func (s *fileStore) getInstancesByHealth(_ context.Context, i info, h health) (instances, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.topology.zones[i.zone] {
+		return nil, newError(errNoInstances, "unknown zone %s", i.zone)
+	}
+
+	is := instances{}
+	for _, in := range s.topology.services[i] {
+		if isHealthy(in.status, h) {
+			is = append(is, in)
+		}
+	}
+
+	if len(is) == 0 {
+		return nil, newError(errNoInstances, "found for %s", i.addr())
+	}
+
+	return is, nil
+}
+
+// getServers returns the servers of the zone, or of all zones if empty.
+func (s *fileStore) getServers(_ context.Context, zone string) (instances, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if zone != "" {
+		return append(instances{}, s.topology.servers[zone]...), nil
+	}
+
+	zones := make([]string, 0, len(s.topology.servers))
+	for z := range s.topology.servers {
+		zones = append(zones, z)
+	}
+	sort.Strings(zones)
+
+	is := instances{}
+	for _, z := range zones {
+		is = append(is, s.topology.servers[z]...)
+	}
+
+	return is, nil
+}
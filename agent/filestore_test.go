@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testStoreFile = `
+service {
+  address = "http.api.prod.harpoon.gg"
+
+  instance {
+    host   = "host-2"
+    ip     = "10.0.0.2"
+    port   = 8080
+    status = "warning"
+  }
+
+  instance {
+    host = "host-1"
+    ip   = "10.0.0.1"
+    port = 8080
+    addrs {
+      edge = "192.0.2.1"
+    }
+  }
+}
+
+server {
+  host = "ns-gg"
+  ip   = "10.0.0.53"
+  zone = "gg"
+}
+
+server {
+  host = "ns-tt"
+  ip   = "10.1.0.53"
+  zone = "tt"
+}
+`
+
+const testStoreFileJSON = `{
+  "service": [{
+    "address": "http.api.prod.harpoon.gg",
+    "instance": [{"host": "host-1", "ip": "10.0.0.1", "port": 8080}]
+  }]
+}`
+
+func writeStoreFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glimpse-filestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "store.hcl")
+	writeStoreFile(t, path, testStoreFile)
+
+	s, err := newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		ctx = context.Background()
+		srv = info{service: "http", job: "api", env: "prod", product: "harpoon", zone: "gg"}
+	)
+
+	is, err := s.getInstances(ctx, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := instances{{
+		host:   "host-1",
+		ip:     net.ParseIP("10.0.0.1"),
+		port:   8080,
+		status: checkPassing,
+		addrs:  map[string]net.IP{"edge": net.ParseIP("192.0.2.1")},
+	}}
+	if !reflect.DeepEqual(want, is) {
+		t.Errorf("want instances %v, got %v", want, is)
+	}
+
+	is, err = s.getInstancesByHealth(ctx, srv, healthWarning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(is); want != got {
+		t.Errorf("want %d instances including warning, got %d", want, got)
+	}
+
+	missing := srv
+	missing.job = "web"
+	if _, err := s.getInstances(ctx, missing); !isNoInstances(err) {
+		t.Errorf("want no instances for unknown service, got %v", err)
+	}
+	missing.zone = "xx"
+	if _, err := s.getInstances(ctx, missing); !isNoInstances(err) {
+		t.Errorf("want no instances for unknown zone, got %v", err)
+	}
+
+	for zone, want := range map[string][]string{
+		"":   {"ns-gg", "ns-tt"},
+		"tt": {"ns-tt"},
+		"xx": {},
+	} {
+		is, err := s.getServers(ctx, zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, i := range is {
+			got = append(got, i.host)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("want servers %v of zone %q, got %v", want, zone, got)
+		}
+	}
+
+	writeStoreFile(t, path, `service { address = "invalid" }`)
+	if err := s.load(); err == nil {
+		t.Errorf("want error for invalid store file")
+	}
+	if _, err := s.getInstances(ctx, srv); err != nil {
+		t.Errorf("want previous topology kept after failed reload, got %v", err)
+	}
+
+	writeStoreFile(t, path, testStoreFileJSON)
+	if err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.getInstancesByHealth(ctx, srv, healthAny); err != nil {
+		t.Errorf("want instances of JSON store file, got %v", err)
+	}
+	if is, _ := s.getServers(ctx, ""); len(is) != 0 {
+		t.Errorf("want no servers after reload, got %v", is)
+	}
+}
+
+func TestParseFileTopologyInvalid(t *testing.T) {
+	for _, in := range []string{
+		`service { address = "http.api.prod.harpoon" }`,
+		`service { address = "http.api.prod.harpoon.gg" }
+		 service { address = "http.api.prod.harpoon.gg" }`,
+		`service {
+		   address = "http.api.prod.harpoon.gg"
+		   instance { host = "a", ip = "10.0.0", port = 80 }
+		 }`,
+		`service {
+		   address = "http.api.prod.harpoon.gg"
+		   instance { host = "a", ip = "10.0.0.1", port = 0 }
+		 }`,
+		`service {
+		   address = "http.api.prod.harpoon.gg"
+		   instance { host = "a", ip = "10.0.0.1", port = 80, status = "ok" }
+		 }`,
+		`server { host = "ns", ip = "10.0.0.53", zone = "ggg" }`,
+		`server { host = "ns", ip = "ns", zone = "gg" }`,
+	} {
+		if _, err := parseFileTopology(in); err == nil {
+			t.Errorf("want error for %s", in)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Flap dampening along the lines of BGP route flap dampening (RFC 2439).
+// Every observed health transition of an instance adds a penalty, which
+// decays exponentially. Instances exceeding the suppress limit are dampened
+// until their penalty decayed below the reuse limit.
+const (
+	flapPenalty  = 1000.0
+	flapSuppress = 2000.0
+	flapReuse    = 750.0
+
+	// flapMaxHalfLifes bounds the time an instance stays dampened after its
+	// last transition.
+	flapMaxHalfLifes = 4
+)
+
+// flapTracker tracks health transitions of instances and dampens the status
+// of flapping ones.
+type flapTracker struct {
+	halfLife time.Duration
+
+	// holdIn keeps dampened instances in answers instead of holding them out.
+	holdIn bool
+
+	mu     sync.Mutex
+	now    func() time.Time
+	swept  time.Time
+	states map[string]*flapState
+}
+
+type flapState struct {
+	addr       string
+	host       string
+	port       uint16
+	status     string
+	penalty    float64
+	updated    time.Time
+	suppressed bool
+}
+
+// flap is the exported view of a flapState.
+type flap struct {
+	Addr       string  `json:"addr"`
+	Host       string  `json:"host"`
+	Port       uint16  `json:"port"`
+	Status     string  `json:"status"`
+	Penalty    float64 `json:"penalty"`
+	Suppressed bool    `json:"suppressed"`
+}
+
+func newFlapTracker(halfLife time.Duration, holdIn bool) *flapTracker {
+	return &flapTracker{
+		halfLife: halfLife,
+		holdIn:   holdIn,
+		now:      time.Now,
+		states:   map[string]*flapState{},
+	}
+}
+
+// observe records the current status of an instance and returns the status
+// it should be treated with.
+func (t *flapTracker) observe(i info, in instance) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var (
+		now = t.now()
+		key = fmt.Sprintf("%s/%s:%d", i.addr(), in.host, in.port)
+	)
+
+	t.sweep(now)
+
+	s, ok := t.states[key]
+	if !ok {
+		t.states[key] = &flapState{
+			addr:    i.addr(),
+			host:    in.host,
+			port:    in.port,
+			status:  in.status,
+			updated: now,
+		}
+		return in.status
+	}
+
+	s.penalty = t.decay(s.penalty, now.Sub(s.updated))
+	s.updated = now
+
+	if s.status != in.status {
+		s.status = in.status
+		s.penalty = math.Min(s.penalty+flapPenalty, t.maxPenalty())
+		flapTransitions.Inc()
+	}
+
+	switch {
+	case !s.suppressed && s.penalty > flapSuppress:
+		s.suppressed = true
+		flapSuppressions.Inc()
+		flapSuppressed.Inc()
+	case s.suppressed && s.penalty < flapReuse:
+		s.suppressed = false
+		flapSuppressed.Dec()
+	}
+
+	if !s.suppressed {
+		return in.status
+	}
+	if t.holdIn {
+		return checkPassing
+	}
+	return checkCritical
+}
+
+// flaps returns the state of all instances with a penalty.
+func (t *flapTracker) flaps() []flap {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var (
+		now = t.now()
+		fs  = []flap{}
+	)
+
+	for _, s := range t.states {
+		p := t.decay(s.penalty, now.Sub(s.updated))
+		if p < 1 && !s.suppressed {
+			continue
+		}
+
+		fs = append(fs, flap{
+			Addr:       s.addr,
+			Host:       s.host,
+			Port:       s.port,
+			Status:     s.status,
+			Penalty:    math.Floor(p),
+			Suppressed: s.suppressed,
+		})
+	}
+
+	sort.Sort(flapsByPenalty(fs))
+
+	return fs
+}
+
+func (t *flapTracker) decay(penalty float64, d time.Duration) float64 {
+	return penalty * math.Pow(0.5, float64(d)/float64(t.halfLife))
+}
+
+func (t *flapTracker) maxPenalty() float64 {
+	return flapReuse * math.Pow(2, flapMaxHalfLifes)
+}
+
+// sweep forgets instances which were not observed for a long time, at most
+// once per half-life.
+func (t *flapTracker) sweep(now time.Time) {
+	if now.Sub(t.swept) < t.halfLife {
+		return
+	}
+	t.swept = now
+
+	for key, s := range t.states {
+		if now.Sub(s.updated) < 10*t.halfLife {
+			continue
+		}
+
+		if s.suppressed {
+			flapSuppressed.Dec()
+		}
+		delete(t.states, key)
+	}
+}
+
+type flapsByPenalty []flap
+
+func (fs flapsByPenalty) Len() int           { return len(fs) }
+func (fs flapsByPenalty) Swap(i, j int)      { fs[i], fs[j] = fs[j], fs[i] }
+func (fs flapsByPenalty) Less(i, j int) bool { return fs[i].Penalty > fs[j].Penalty }
+
+// flapsHandler answers GET /v1/flaps with all instances which recently changed
+// their health.
+func flapsHandler(t *flapTracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		httpJSON(w, t.flaps())
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFlapTracker(t *testing.T) {
+	var (
+		i = info{
+			service: "http",
+			job:     "api",
+			env:     "prod",
+			product: "harpoon",
+			zone:    "tt",
+		}
+		in  = instance{host: "host1", ip: net.ParseIP("127.0.0.1"), port: 20000}
+		now = time.Unix(1428000000, 0)
+	)
+
+	for _, holdIn := range []bool{false, true} {
+		var (
+			tracker  = newFlapTracker(time.Minute, holdIn)
+			dampened = checkCritical
+			observe  = func(status string) string {
+				in.status = status
+				return tracker.observe(i, in)
+			}
+		)
+		tracker.now = func() time.Time { return now }
+
+		if holdIn {
+			dampened = checkPassing
+		}
+
+		for j, test := range []struct {
+			status string
+			after  time.Duration
+			want   string
+		}{
+			{status: checkPassing, want: checkPassing},
+			{status: checkCritical, want: checkCritical},
+			{status: checkPassing, want: checkPassing},
+			{status: checkCritical, want: dampened},
+			{status: checkPassing, want: dampened},
+			{status: checkPassing, after: time.Minute, want: dampened},
+			{status: checkPassing, after: 5 * time.Minute, want: checkPassing},
+		} {
+			now = now.Add(test.after)
+
+			if want, got := test.want, observe(test.status); want != got {
+				t.Errorf("hold in %t step %d want status %s, got %s", holdIn, j, want, got)
+			}
+		}
+	}
+}
+
+func TestFlapTrackerMaxPenalty(t *testing.T) {
+	var (
+		i       = info{service: "http", job: "api", env: "prod", product: "harpoon", zone: "tt"}
+		in      = instance{host: "host1", port: 20000}
+		now     = time.Unix(1428000000, 0)
+		tracker = newFlapTracker(time.Minute, false)
+	)
+	tracker.now = func() time.Time { return now }
+
+	for j := 0; j <= 100; j++ {
+		in.status = checkPassing
+		if j%2 == 1 {
+			in.status = checkCritical
+		}
+		tracker.observe(i, in)
+	}
+
+	now = now.Add(flapMaxHalfLifes*time.Minute + time.Second)
+	in.status = checkPassing
+
+	if want, got := checkPassing, tracker.observe(i, in); want != got {
+		t.Errorf("want dampening to end after %d half-lifes, got %s", flapMaxHalfLifes, got)
+	}
+}
+
+func TestFlapsHandler(t *testing.T) {
+	var (
+		i       = info{service: "http", job: "api", env: "prod", product: "harpoon", zone: "tt"}
+		tracker = newFlapTracker(time.Minute, false)
+	)
+
+	for _, status := range []string{checkPassing, checkCritical, checkPassing, checkCritical} {
+		tracker.observe(i, instance{host: "host1", port: 20000, status: status})
+	}
+	tracker.observe(i, instance{host: "host2", port: 20000, status: checkPassing})
+
+	var (
+		w      = httptest.NewRecorder()
+		r, err = http.NewRequest("GET", "/v1/flaps", nil)
+		fs     = []flap{}
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flapsHandler(tracker).ServeHTTP(w, r)
+
+	if want, got := http.StatusOK, w.Code; want != got {
+		t.Fatalf("want code %d, got %d", want, got)
+	}
+	if err := json.NewDecoder(w.Body).Decode(&fs); err != nil {
+		t.Fatalf("decoding flaps failed: %s", err)
+	}
+
+	if want, got := 1, len(fs); want != got {
+		t.Fatalf("want %d flaps, got %d", want, got)
+	}
+	if want, got := "http.api.prod.harpoon.tt", fs[0].Addr; want != got {
+		t.Errorf("want addr %s, got %s", want, got)
+	}
+	if want, got := true, fs[0].Suppressed; want != got {
+		t.Errorf("want suppressed %t, got %t", want, got)
+	}
+}
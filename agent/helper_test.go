@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,30 +11,78 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
+// counterValue returns the current value of the counter.
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m.GetCounter().GetValue()
+}
+
+// gaugeValue returns the current value of the gauge.
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	m := &dto.Metric{}
+	if err := g.Write(m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m.GetGauge().GetValue()
+}
+
 // brokenStore implements the glimpse.store interface.
 type brokenStore struct{}
 
-func (s *brokenStore) getInstances(srv info) (instances, error) {
+func (s *brokenStore) getInstances(ctx context.Context, srv info) (instances, error) {
 	return nil, newError(errConsulAPI, "could not get instances")
 }
 
-func (s *brokenStore) getServers(zone string) (instances, error) {
+func (s *brokenStore) getInstancesByHealth(ctx context.Context, srv info, h health) (instances, error) {
+	return nil, newError(errConsulAPI, "could not get instances")
+}
+
+func (s *brokenStore) getServers(ctx context.Context, zone string) (instances, error) {
 	return nil, newError(errConsulAPI, "could not get servers")
 }
 
+// hangingStore implements the glimpse.store interface, never answering
+// before the context is done.
+type hangingStore struct{}
+
+func (s *hangingStore) getInstances(ctx context.Context, srv info) (instances, error) {
+	<-ctx.Done()
+	return nil, newError(errConsulAPI, "%s", ctx.Err())
+}
+
+func (s *hangingStore) getInstancesByHealth(ctx context.Context, srv info, h health) (instances, error) {
+	return s.getInstances(ctx, srv)
+}
+
+func (s *hangingStore) getServers(ctx context.Context, zone string) (instances, error) {
+	return s.getInstances(ctx, info{})
+}
+
 // testStore implements the glimpse.store interface.
 type testStore struct {
 	instances map[info]instances
 	servers   map[string]instances
+
+	// unhealthy instances are only returned for health other than passing.
+	unhealthy map[info]instances
 }
 
-func (s *testStore) getInstances(srv info) (instances, error) {
+func (s *testStore) getInstances(ctx context.Context, srv info) (instances, error) {
 	r, ok := s.instances[srv]
 	if !ok {
 		return nil, newError(errNoInstances, "")
@@ -41,7 +90,21 @@ func (s *testStore) getInstances(srv info) (instances, error) {
 	return r, nil
 }
 
-func (s *testStore) getServers(zone string) (is instances, err error) {
+func (s *testStore) getInstancesByHealth(ctx context.Context, srv info, h health) (instances, error) {
+	r := instances{}
+	r = append(r, s.instances[srv]...)
+
+	if h != healthPassing {
+		r = append(r, s.unhealthy[srv]...)
+	}
+
+	if len(r) == 0 {
+		return nil, newError(errNoInstances, "")
+	}
+	return r, nil
+}
+
+func (s *testStore) getServers(ctx context.Context, zone string) (is instances, err error) {
 	for _, s := range s.servers[zone] {
 		is = append(is, s)
 	}
@@ -149,7 +212,7 @@ func generateInstancesFromInfo(i info) instances {
 func setupStubConsul(
 	result interface{},
 	t *testing.T,
-) (*api.Client, *httptest.Server) {
+) (*api.Config, *httptest.Server) {
 	server := httptest.NewServer(
 		http.HandlerFunc(
 			func(w http.ResponseWriter, r *http.Request) {
@@ -166,6 +229,55 @@ func setupStubConsul(
 		t.Fatalf("server url parse failed: %s", err)
 	}
 
+	return &api.Config{
+		Address:    url.Host,
+		Datacenter: defaultSrvZone,
+	}, server
+}
+
+// stubConsul answers consul API requests by path and records all requests it
+// received.
+type stubConsul struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func setupStubConsulRoutes(
+	routes map[string]interface{},
+	t *testing.T,
+) (*api.Client, *stubConsul) {
+	stub := &stubConsul{}
+	stub.Server = httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				stub.mu.Lock()
+				stub.requests = append(stub.requests, r)
+				stub.mu.Unlock()
+
+				result, ok := routes[r.URL.Path]
+				if !ok {
+					if r.Method != "GET" {
+						return
+					}
+					http.NotFound(w, r)
+					return
+				}
+
+				err := json.NewEncoder(w).Encode(result)
+				if err != nil {
+					t.Fatalf("encoding response failed: %s", err)
+				}
+			},
+		),
+	)
+
+	url, err := url.Parse(stub.URL)
+	if err != nil {
+		t.Fatalf("server url parse failed: %s", err)
+	}
+
 	client, err := api.NewClient(&api.Config{
 		Address:    url.Host,
 		Datacenter: defaultSrvZone,
@@ -174,5 +286,43 @@ func setupStubConsul(
 		t.Fatalf("consul setup failed: %s", err)
 	}
 
-	return client, server
+	return client, stub
+}
+
+// requested returns method, path and query of all received requests with the
+// given path prefix.
+func (s *stubConsul) requested(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rs := []string{}
+	for _, r := range s.requests {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			rs = append(rs, fmt.Sprintf("%s %s?%s", r.Method, r.URL.Path, r.URL.RawQuery))
+		}
+	}
+
+	return rs
+}
+
+// testClock is a manually advanced clock safe for concurrent use.
+type testClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{t: time.Unix(1428000000, 0)}
+}
+
+func (c *testClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *testClock) add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type instanceJSON struct {
+	Host   string `json:"host"`
+	IP     string `json:"ip"`
+	Port   uint16 `json:"port"`
+	Status string `json:"status,omitempty"`
+	Stale  bool   `json:"stale,omitempty"`
+}
+
+// instancesHandler answers GET /v1/instances/<service address> with the
+// instances of the service address. The query parameter health selects
+// instances other than passing ones, see parseHealth.
+func instancesHandler(
+	store store,
+	budget time.Duration,
+	acl *acl,
+	views *views,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		srv, err := infoFromAddr(strings.TrimPrefix(r.URL.Path, "/v1/instances/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		client := httpClientIP(r)
+		if !acl.allowed("HTTP", client, srv, srv.addr()) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		view := views.lookup(client)
+		if !view.visible(srv.zone) {
+			httpError(w, newError(errNoInstances, "found for %s", srv.addr()))
+			return
+		}
+
+		health, err := parseHealth(r.URL.Query().Get("health"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := withBudget(r.Context(), budget)
+		defer cancel()
+
+		var is instances
+		if health == healthPassing {
+			is, err = store.getInstances(ctx, srv)
+		} else {
+			is, err = store.getInstancesByHealth(ctx, srv, health)
+		}
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+
+		res := make([]instanceJSON, 0, len(is))
+		for _, i := range view.apply(is) {
+			res = append(res, instanceJSON{
+				Host:   i.host,
+				IP:     i.ip.String(),
+				Port:   i.port,
+				Status: i.status,
+				Stale:  i.stale,
+			})
+		}
+
+		httpJSON(w, res)
+	})
+}
+
+// httpClientIP returns the IP of the client of r.
+func httpClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+func httpJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Printf("HTTP - encoding response failed: %s", err)
+	}
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+
+	switch {
+	case isNoInstances(err):
+		code = http.StatusNotFound
+	case isConsulAPI(err), isPermissionDenied(err):
+		code = http.StatusBadGateway
+	case isCircuitOpen(err):
+		code = http.StatusServiceUnavailable
+	}
+
+	http.Error(w, err.Error(), code)
+}
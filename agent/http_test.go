@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestInstancesHandler(t *testing.T) {
+	var (
+		i = info{
+			service: "http",
+			job:     "api",
+			env:     "prod",
+			product: "harpoon",
+			zone:    "tt",
+		}
+		h = instancesHandler(&testStore{
+			instances: map[info]instances{
+				i: instances{
+					{host: "host1", ip: net.ParseIP("127.0.0.1"), port: 20000},
+				},
+			},
+			unhealthy: map[info]instances{
+				i: instances{
+					{host: "host2", ip: net.ParseIP("127.0.0.2"), port: 20000},
+				},
+			},
+		}, 0, nil, nil)
+	)
+
+	for _, test := range []struct {
+		method string
+		path   string
+		code   int
+		hosts  []string
+	}{
+		{
+			method: "GET",
+			path:   "/v1/instances/http.api.prod.harpoon.tt",
+			code:   http.StatusOK,
+			hosts:  []string{"host1"},
+		},
+		{
+			method: "GET",
+			path:   "/v1/instances/http.api.prod.harpoon.tt?health=any",
+			code:   http.StatusOK,
+			hosts:  []string{"host1", "host2"},
+		},
+		{
+			method: "GET",
+			path:   "/v1/instances/http.api.prod.harpoon.tt?health=critical",
+			code:   http.StatusBadRequest,
+		},
+		{
+			method: "GET",
+			path:   "/v1/instances/http.web.prod.harpoon.tt",
+			code:   http.StatusNotFound,
+		},
+		{
+			method: "GET",
+			path:   "/v1/instances/http.api.prod.harpoon",
+			code:   http.StatusBadRequest,
+		},
+		{
+			method: "POST",
+			path:   "/v1/instances/http.api.prod.harpoon.tt",
+			code:   http.StatusMethodNotAllowed,
+		},
+	} {
+		var (
+			w      = httptest.NewRecorder()
+			r, err = http.NewRequest(test.method, test.path, nil)
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h.ServeHTTP(w, r)
+
+		if want, got := test.code, w.Code; want != got {
+			t.Errorf("%s %s want code %d, got %d", test.method, test.path, want, got)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+
+		res := []instanceJSON{}
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatalf("decoding instances failed: %s", err)
+		}
+
+		hosts := []string{}
+		for _, i := range res {
+			hosts = append(hosts, i.Host)
+		}
+		if want, got := test.hosts, hosts; !reflect.DeepEqual(want, got) {
+			t.Errorf("%s want hosts %v, got %v", test.path, want, got)
+		}
+	}
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
-	"net"
 	"os/exec"
 	"strconv"
 	"strings"
@@ -20,7 +20,7 @@ const (
 )
 
 var (
-	storeLabels = []string{"error", "operation"}
+	storeLabels = []string{"backend", "error", "operation"}
 	countLabels = []string{
 		"service",
 		"job",
@@ -39,6 +39,84 @@ var (
 		},
 		[]string{"protocol", "qtype", "rcode"},
 	)
+	dnsShed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "dns",
+			Name:      "shed_requests",
+			Help:      "DNS requests shed as too many were in flight.",
+		},
+		[]string{"protocol", "reason"},
+	)
+	dnsInflight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "dns",
+			Name:      "inflight_requests",
+			Help:      "DNS requests in flight.",
+		},
+	)
+	dnsShedLimit = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "dns",
+			Name:      "inflight_limit",
+			Help:      "Current limit of DNS requests in flight, 0 if unlimited.",
+		},
+	)
+	dnsRateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "dns",
+			Name:      "rate_limited_responses",
+			Help:      "DNS responses exceeding the response rate limit by action.",
+		},
+		[]string{"action"},
+	)
+	dnsNXDomain = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "dns",
+			Name:      "nxdomain_responses",
+			Help:      "DNS responses with NXDOMAIN.",
+		},
+	)
+	dnsNXDomainTop = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "dns",
+			Name:      "nxdomain_top_names",
+			Help:      "NXDOMAIN responses of the most queried names in the last interval.",
+		},
+		[]string{"name"},
+	)
+	aclDenials = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "acl",
+			Name:      "denials",
+			Help:      "Queries denied by the ACL.",
+		},
+		[]string{"protocol", "zone"},
+	)
+	authDenials = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "auth",
+			Name:      "denials",
+			Help:      "HTTP requests denied by the required role.",
+		},
+		[]string{"role"},
+	)
+	dnssecSignatures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "dnssec",
+			Name:      "signatures",
+			Help:      "RRset signatures by result: signed, cached or failed.",
+		},
+		[]string{"result"},
+	)
 	storeCounts = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: namespace,
@@ -57,6 +135,162 @@ var (
 		},
 		storeLabels,
 	)
+	storeSkipped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "consul",
+			Name:      "skipped_instances",
+			Help:      "Instances left out of answers due to invalid registrations.",
+		},
+		[]string{"error", "zone"},
+	)
+	storePanics = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "consul",
+			Name:      "panics",
+			Help:      "Answers with all instances as too few were healthy.",
+		},
+		[]string{"service", "job", "env", "product", "zone"},
+	)
+	flapTransitions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "flap",
+			Name:      "transitions",
+			Help:      "Observed health transitions of instances.",
+		},
+	)
+	flapSuppressions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "flap",
+			Name:      "suppressions",
+			Help:      "Instances dampened for flapping.",
+		},
+	)
+	flapSuppressed = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "flap",
+			Name:      "suppressed_instances",
+			Help:      "Instances currently dampened for flapping.",
+		},
+	)
+	cacheEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "cache",
+			Name:      "events",
+			Help:      "Cache hits, misses, coalesced lookups and prefetches.",
+		},
+		[]string{"event"},
+	)
+	breakerStateGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "breaker",
+			Name:      "state",
+			Help:      "State of the Consul circuit breaker: 0 closed, 1 half-open, 2 open.",
+		},
+		[]string{"backend"},
+	)
+	breakerTransitions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "breaker",
+			Name:      "transitions",
+			Help:      "State transitions of the Consul circuit breaker.",
+		},
+		[]string{"backend", "state"},
+	)
+	breakerRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "breaker",
+			Name:      "rejected",
+			Help:      "Store calls failed fast by the Consul circuit breaker.",
+		},
+		[]string{"backend"},
+	)
+	consulEndpointHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "consul",
+			Name:      "endpoint_healthy",
+			Help:      "Health of the Consul endpoints as last probed: 1 healthy, 0 unhealthy.",
+		},
+		[]string{"endpoint"},
+	)
+	consulEndpointActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "consul",
+			Name:      "endpoint_active",
+			Help:      "Consul endpoint requests are sent to: 1 active, 0 standby.",
+		},
+		[]string{"endpoint"},
+	)
+	consulFailovers = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "consul",
+			Name:      "failovers",
+			Help:      "Changes of the active Consul endpoint.",
+		},
+	)
+	overrideAnswers = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "overrides",
+			Name:      "answers",
+			Help:      "Answers changed by operator overrides by action.",
+		},
+		[]string{"action"},
+	)
+	overridesActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "overrides",
+			Name:      "active",
+			Help:      "Operator overrides currently in place.",
+		},
+	)
+	aliasHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "alias",
+			Name:      "hits",
+			Help:      "Lookups of aliases answered with instances of the target.",
+		},
+		[]string{"alias", "target"},
+	)
+	snapshotAnswers = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "snapshot",
+			Name:      "stale_answers",
+			Help:      "Answers served from the last-known-good snapshot.",
+		},
+		[]string{"operation"},
+	)
+	snapshotEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "snapshot",
+			Name:      "entries",
+			Help:      "Entries in the last-known-good snapshot.",
+		},
+	)
+	snapshotWrites = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "snapshot",
+			Name:      "writes",
+			Help:      "Writes of the snapshot to disk.",
+		},
+		[]string{"result"},
+	)
 	storeErrors = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
@@ -70,9 +304,36 @@ var (
 
 func init() {
 	prometheus.MustRegister(dnsDurations)
+	prometheus.MustRegister(dnsShed)
+	prometheus.MustRegister(dnsInflight)
+	prometheus.MustRegister(dnsShedLimit)
+	prometheus.MustRegister(dnsRateLimited)
+	prometheus.MustRegister(dnsNXDomain)
+	prometheus.MustRegister(dnsNXDomainTop)
+	prometheus.MustRegister(aclDenials)
+	prometheus.MustRegister(authDenials)
+	prometheus.MustRegister(dnssecSignatures)
 	prometheus.MustRegister(storeCounts)
 	prometheus.MustRegister(storeDurations)
 	prometheus.MustRegister(storeErrors)
+	prometheus.MustRegister(storeSkipped)
+	prometheus.MustRegister(storePanics)
+	prometheus.MustRegister(flapTransitions)
+	prometheus.MustRegister(flapSuppressions)
+	prometheus.MustRegister(flapSuppressed)
+	prometheus.MustRegister(cacheEvents)
+	prometheus.MustRegister(snapshotAnswers)
+	prometheus.MustRegister(breakerStateGauge)
+	prometheus.MustRegister(breakerTransitions)
+	prometheus.MustRegister(breakerRejected)
+	prometheus.MustRegister(snapshotEntries)
+	prometheus.MustRegister(consulEndpointHealthy)
+	prometheus.MustRegister(consulEndpointActive)
+	prometheus.MustRegister(consulFailovers)
+	prometheus.MustRegister(overrideAnswers)
+	prometheus.MustRegister(overridesActive)
+	prometheus.MustRegister(aliasHits)
+	prometheus.MustRegister(snapshotWrites)
 	prometheus.MustRegister(
 		prometheus.NewProcessCollectorPIDFn(consulAgentPid, "consul"),
 	)
@@ -89,10 +350,10 @@ func dnsMetricsHandler(next dns.Handler) dns.HandlerFunc {
 			start  = time.Now()
 		)
 
-		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
-			prot = "udp"
-		} else if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
-			prot = "tcp"
+		// udp and tcp for plain DNS, dot and doh for the encrypted
+		// listeners.
+		if addr := w.RemoteAddr(); addr != nil {
+			prot = addr.Network()
 		}
 
 		if len(req.Question) == 1 {
@@ -103,6 +364,9 @@ func dnsMetricsHandler(next dns.Handler) dns.HandlerFunc {
 		if buffer.last != nil {
 			rcode = dns.RcodeToString[buffer.last.Rcode]
 		}
+		if buffer.shedReason != "" {
+			dnsShed.WithLabelValues(prot, buffer.shedReason).Inc()
+		}
 
 		duration := float64(time.Since(start)) / float64(time.Microsecond)
 		dnsDurations.WithLabelValues(prot, qtype, rcode).Observe(duration)
@@ -112,7 +376,12 @@ func dnsMetricsHandler(next dns.Handler) dns.HandlerFunc {
 type cachingWriter struct {
 	dns.ResponseWriter
 
-	last *dns.Msg
+	last       *dns.Msg
+	shedReason string
+}
+
+func (w *cachingWriter) shed(reason string) {
+	w.shedReason = reason
 }
 
 func (w *cachingWriter) WriteMsg(m *dns.Msg) error {
@@ -181,25 +450,21 @@ func (c *consulCollector) updateMetrics() error {
 
 type consulStats map[string]int64
 
+// metricsStore instruments the calls to the next store, labeled with the
+// Consul backend it's querying.
 type metricsStore struct {
-	next store
+	backend string
+	next    store
 }
 
-func newMetricsStore(next store) *metricsStore {
-	return &metricsStore{next: next}
+func newMetricsStore(backend string, next store) *metricsStore {
+	return &metricsStore{backend: backend, next: next}
 }
 
-func (s *metricsStore) getInstances(i info) (is instances, err error) {
+func (s *metricsStore) getInstances(ctx context.Context, i info) (is instances, err error) {
 	var (
-		labels = prometheus.Labels{
-			"service":   i.service,
-			"job":       i.job,
-			"env":       i.env,
-			"product":   i.product,
-			"zone":      i.zone,
-			"operation": "getInstances",
-		}
-		start = time.Now()
+		labels = instancesLabels(i, "getInstances")
+		start  = time.Now()
 	)
 
 	defer func() {
@@ -207,22 +472,50 @@ func (s *metricsStore) getInstances(i info) (is instances, err error) {
 			storeCounts.With(labels).Set(float64(len(is)))
 		}
 
-		trackStore(start, labels["operation"], err)
+		trackStore(start, s.backend, labels["operation"], err)
 	}()
 
-	return s.next.getInstances(i)
+	return s.next.getInstances(ctx, i)
 }
 
-func (s *metricsStore) getServers(zone string) (is instances, err error) {
+func (s *metricsStore) getInstancesByHealth(ctx context.Context, i info, h health) (is instances, err error) {
+	var (
+		labels = instancesLabels(i, "getInstancesByHealth")
+		start  = time.Now()
+	)
+
+	defer func() {
+		if err == nil {
+			storeCounts.With(labels).Set(float64(len(is)))
+		}
+
+		trackStore(start, s.backend, labels["operation"], err)
+	}()
+
+	return s.next.getInstancesByHealth(ctx, i, h)
+}
+
+func (s *metricsStore) getServers(ctx context.Context, zone string) (is instances, err error) {
 	var (
 		op    = "getServers"
 		start = time.Now()
 	)
 	defer func() {
-		trackStore(start, op, err)
+		trackStore(start, s.backend, op, err)
 	}()
 
-	return s.next.getServers(zone)
+	return s.next.getServers(ctx, zone)
+}
+
+func instancesLabels(i info, op string) prometheus.Labels {
+	return prometheus.Labels{
+		"service":   i.service,
+		"job":       i.job,
+		"env":       i.env,
+		"product":   i.product,
+		"zone":      i.zone,
+		"operation": op,
+	}
 }
 
 func getConsulStats(info string) (consulStats, error) {
@@ -316,10 +609,11 @@ func consulAgentPid() (int, error) {
 	return pid, nil
 }
 
-func trackStore(start time.Time, op string, err error) {
+func trackStore(start time.Time, backend, op string, err error) {
 	var (
 		duration = float64(time.Since(start)) / float64(time.Microsecond)
 		labels   = prometheus.Labels{
+			"backend":   backend,
 			"error":     "none",
 			"operation": op,
 		}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"io/ioutil"
 	"net"
 	"reflect"
@@ -164,10 +165,10 @@ func TestMetricsStoreGetInstances(t *testing.T) {
 			zone:    "tt",
 		}
 		ins = generateInstancesFromInfo(i)
-		s   = newMetricsStore(&testStore{instances: map[info]instances{i: ins}})
+		s   = newMetricsStore(defaultBackend, &testStore{instances: map[info]instances{i: ins}})
 	)
 
-	sins, err := s.getInstances(i)
+	sins, err := s.getInstances(context.Background(), i)
 	if err != nil {
 		t.Fatalf("want store to not return an error, got %s", err)
 	}
@@ -177,15 +178,42 @@ func TestMetricsStoreGetInstances(t *testing.T) {
 	}
 }
 
+func TestMetricsStoreGetInstancesByHealth(t *testing.T) {
+	var (
+		i = info{
+			service: "http",
+			job:     "walker",
+			env:     "prod",
+			product: "harpoon",
+			zone:    "tt",
+		}
+		ins = generateInstancesFromInfo(i)
+		s   = newMetricsStore(defaultBackend, &testStore{instances: map[info]instances{i: ins}})
+	)
+
+	sins, err := s.getInstancesByHealth(context.Background(), i, healthPassing)
+	if err != nil {
+		t.Fatalf("want store to not return an error, got %s", err)
+	}
+	if want, got := ins, sins; !reflect.DeepEqual(want, got) {
+		t.Errorf("want %d instances, got %d", len(want), len(got))
+	}
+
+	count := storeCounts.With(instancesLabels(i, "getInstancesByHealth"))
+	if want, got := float64(len(ins)), gaugeValue(t, count); want != got {
+		t.Errorf("want instance count %v, got %v", want, got)
+	}
+}
+
 func TestMetricsStoreGetServers(t *testing.T) {
 	var (
 		zone = "tt"
 		srvs = instances{{host: "foo"}}
 		m    = map[string]instances{zone: srvs}
-		s    = newMetricsStore(&testStore{servers: m})
+		s    = newMetricsStore(defaultBackend, &testStore{servers: m})
 	)
 
-	ss, err := s.getServers(zone)
+	ss, err := s.getServers(context.Background(), zone)
 	if err != nil {
 		t.Fatalf("want store to not return an error, got %s", err)
 	}
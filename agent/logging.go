@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"time"
 
@@ -69,20 +70,28 @@ func newLoggingStore(logger *log.Logger, next store) store {
 	}
 }
 
-func (s *loggingStore) getInstances(i info) (is instances, err error) {
+func (s *loggingStore) getInstances(ctx context.Context, i info) (is instances, err error) {
 	defer func(start time.Time) {
 		s.log(time.Since(start), "getInstances", i.addr(), err)
 	}(time.Now())
 
-	return s.next.getInstances(i)
+	return s.next.getInstances(ctx, i)
 }
 
-func (s *loggingStore) getServers(zone string) (is instances, err error) {
+func (s *loggingStore) getInstancesByHealth(ctx context.Context, i info, h health) (is instances, err error) {
+	defer func(start time.Time) {
+		s.log(time.Since(start), "getInstancesByHealth", i.addr()+" "+string(h), err)
+	}(time.Now())
+
+	return s.next.getInstancesByHealth(ctx, i, h)
+}
+
+func (s *loggingStore) getServers(ctx context.Context, zone string) (is instances, err error) {
 	defer func(start time.Time) {
 		s.log(time.Since(start), "getServers", zone, err)
 	}(time.Now())
 
-	return s.next.getServers(zone)
+	return s.next.getServers(ctx, zone)
 }
 
 func (s *loggingStore) log(took time.Duration, op, input string, err error) {
@@ -92,3 +101,19 @@ func (s *loggingStore) log(took time.Duration, op, input string, err error) {
 
 	s.logger.Printf("STORE %dms %s %s error: %s", took/time.Millisecond, op, input, err)
 }
+
+// logBreaker returns a function logging state transitions of the breakerStore
+// of the backend.
+func logBreaker(logger *log.Logger, backend string) func(from, to breakerState) {
+	return func(from, to breakerState) {
+		logger.Printf("STORE breaker %s %s -> %s", backend, from, to)
+	}
+}
+
+// logFailover returns a failover callback logging changes of the active
+// Consul endpoint.
+func logFailover(logger *log.Logger) func(from, to string) {
+	return func(from, to string) {
+		logger.Printf("STORE consul endpoint %s -> %s", from, to)
+	}
+}
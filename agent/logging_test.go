@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"log"
 	"net"
 	"strings"
@@ -117,12 +118,12 @@ func TestLoggingStoreError(t *testing.T) {
 		})
 	)
 
-	_, err := s.getInstances(i)
+	_, err := s.getInstances(context.Background(), i)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, err = s.getServers(i.zone)
+	_, err = s.getServers(context.Background(), i.zone)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -132,7 +133,7 @@ func TestLoggingStoreError(t *testing.T) {
 		t.Errorf("want %d, have %d", want, have)
 	}
 
-	_, err = s.getInstances(info{product: "nonsense"})
+	_, err = s.getInstances(context.Background(), info{product: "nonsense"})
 	if err == nil {
 		t.Error("want loggingStore to pass errors")
 	}
@@ -157,7 +158,7 @@ func TestLoggingStoreError(t *testing.T) {
 
 	b.Reset()
 
-	_, err = s.getServers("zz")
+	_, err = s.getServers(context.Background(), "zz")
 	if err == nil {
 		t.Errorf("want loggingStore to pass errors")
 	}
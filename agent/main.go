@@ -32,62 +32,548 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(runDoctor(os.Args[2:], os.Stdout))
+	}
+
 	var (
-		consulAddr = flag.String("consul.addr", "127.0.0.1:8500", "consul lookup address")
+		consulAddr = flag.String("consul.addr", "127.0.0.1:8500", "comma separated consul lookup addresses in the order of preference")
 		consulInfo = flag.String("consul.info", "consul info", "info command")
 		dnsAddr    = flag.String("dns.addr", ":5959", "DNS address to bind to")
 		dnsZone    = flag.String("dns.zone", defaultDNSZone, "DNS zone")
 		srvZone    = flag.String("srv.zone", defaultSrvZone, "srv zone")
 		httpAddr   = flag.String("http.addr", ":5960", "HTTP address to bind to")
+		httpCert   = flag.String(
+			"http.tls.cert",
+			"",
+			"certificate file of the HTTP API, reloaded on SIGHUP, empty serves plain HTTP",
+		)
+		httpKey = flag.String(
+			"http.tls.key",
+			"",
+			"key file of the HTTP API, reloaded on SIGHUP",
+		)
+		httpClientCA = flag.String(
+			"http.tls.client-ca",
+			"",
+			"CA bundle client certificates of the HTTP API are verified with, empty disables client certificates",
+		)
+		httpAuthFile = flag.String(
+			"http.auth.file",
+			"",
+			"HCL or JSON file with the identities and roles of HTTP API clients, reloaded on SIGHUP, empty allows all requests",
+		)
+		dotAddr = flag.String(
+			"dns.tls.addr",
+			"",
+			"DNS-over-TLS address to bind to, empty disables DoT",
+		)
+		dohAddr = flag.String(
+			"dns.https.addr",
+			"",
+			"DNS-over-HTTPS address to bind to, empty disables DoH",
+		)
+		dnsCert = flag.String(
+			"dns.tls.cert",
+			"",
+			"certificate file of the DoT and DoH listeners, reloaded on SIGHUP",
+		)
+		dnsKey = flag.String(
+			"dns.tls.key",
+			"",
+			"key file of the DoT and DoH listeners, reloaded on SIGHUP",
+		)
 		maxAnswers = flag.Int(
 			"dns.udp.maxanswers",
 			defaultMaxAnswers,
 			"DNS maximum answers returned via UDP",
 		)
+		maxInflight = flag.Int(
+			"dns.max-inflight",
+			0,
+			"maximum DNS queries in flight, 0 disables the limit",
+		)
+		maxInflightClient = flag.Int(
+			"dns.max-inflight-per-client",
+			0,
+			"maximum DNS queries in flight per client address, 0 disables the limit",
+		)
+		shedAction = flag.String(
+			"dns.shed.action",
+			"refuse",
+			"answer queries exceeding the in-flight limits with REFUSED or drop them: refuse or drop",
+		)
+		shedLatency = flag.Duration(
+			"dns.shed.latency",
+			0,
+			"target query latency the in-flight limit adapts to, 0 disables adaptive limits",
+		)
+		rrlRate = flag.Float64(
+			"dns.rrl.rate",
+			0,
+			"identical responses per second to a client network, 0 disables rate limiting",
+		)
+		rrlNXRate = flag.Float64(
+			"dns.rrl.nxdomain-rate",
+			0,
+			"NXDOMAIN responses per second and name to a client network, 0 disables rate limiting",
+		)
+		rrlSlip = flag.Int(
+			"dns.rrl.slip",
+			2,
+			"answer every nth rate limited response truncated instead of dropping it, 0 drops all",
+		)
+		rrlLogOnly = flag.Bool(
+			"dns.rrl.log-only",
+			false,
+			"only log and count rate limited responses",
+		)
+		aclFile = flag.String(
+			"acl.file",
+			"",
+			"HCL or JSON file with the ACL policy, reloaded on SIGHUP, empty allows all queries",
+		)
+		viewsFile = flag.String(
+			"views.file",
+			"",
+			"HCL or JSON file with split-horizon views, reloaded on SIGHUP",
+		)
+		dnssecZSK = flag.String(
+			"dnssec.zsk",
+			"",
+			"path prefix of the zone signing key files <prefix>.key and <prefix>.private, empty disables DNSSEC",
+		)
+		dnssecKSK = flag.String(
+			"dnssec.ksk",
+			"",
+			"path prefix of the key signing key files, empty signs the DNSKEY RRset with the zone signing key",
+		)
+		dnssecValidity = flag.Duration(
+			"dnssec.validity",
+			7*24*time.Hour,
+			"validity of signatures, which are renewed after half of it",
+		)
+		degraded = flag.Bool(
+			"dns.srv.degraded",
+			false,
+			"serve instances in warning state in SRV answers at lower priority",
+		)
+		cacheTTL = flag.Duration(
+			"cache.ttl",
+			time.Duration(defaultTTL)*time.Second,
+			"time store results are cached, 0 disables caching",
+		)
+		cacheNegativeTTL = flag.Duration(
+			"cache.negative-ttl",
+			time.Second,
+			"time results without instances are cached",
+		)
+		flapHalfLife = flag.Duration(
+			"consul.flap.halflife",
+			0,
+			"half-life of the flap dampening penalty, 0 disables dampening",
+		)
+		flapHold = flag.String(
+			"consul.flap.hold",
+			"out",
+			"hold dampened instances out of or in answers: out or in",
+		)
+		snapshotPath = flag.String(
+			"snapshot.path",
+			"",
+			"file the last-known-good results are persisted to, empty disables serving stale results",
+		)
+		snapshotMaxAge = flag.Duration(
+			"snapshot.max-age",
+			time.Hour,
+			"maximum age of stale results served while consul is unavailable",
+		)
+		snapshotInterval = flag.Duration(
+			"snapshot.interval",
+			10*time.Second,
+			"interval the snapshot is written to disk",
+		)
+		queryBudget = flag.Duration(
+			"query.budget",
+			time.Second,
+			"time a DNS or HTTP query may spend on store lookups, 0 disables the deadline",
+		)
+		consulTimeout = flag.Duration(
+			"consul.timeout",
+			5*time.Second,
+			"timeout of Consul API requests, 0 disables the timeout",
+		)
+		breakerFailures = flag.Int(
+			"consul.breaker.failures",
+			5,
+			"consecutive Consul API failures which open the circuit breaker, 0 disables the breaker",
+		)
+		breakerCooldown = flag.Duration(
+			"consul.breaker.cooldown",
+			time.Second,
+			"time the circuit breaker stays open before probing Consul",
+		)
+		breakerMaxCooldown = flag.Duration(
+			"consul.breaker.max-cooldown",
+			30*time.Second,
+			"maximum cooldown after repeatedly failed probes",
+		)
+		panicThreshold = flag.Float64(
+			"consul.panic.threshold",
+			0,
+			"percentage of healthy instances below which all instances are returned, 0 disables",
+		)
+		consulBackends = flag.String(
+			"consul.backends",
+			"",
+			"comma separated Consul backends of zones not WAN-joined with the local agent: zone=address[/datacenter]",
+		)
+		consulProbeInterval = flag.Duration(
+			"consul.probe.interval",
+			5*time.Second,
+			"interval the health of all Consul addresses is probed in",
+		)
+		storeKind = flag.String(
+			"store",
+			storeConsul,
+			"store serving the topology: consul or file",
+		)
+		storeFilePath = flag.String(
+			"store.file",
+			"",
+			"HCL or JSON file with the topology of the file store, reloaded on change and on SIGHUP",
+		)
+		storeFileInterval = flag.Duration(
+			"store.file.interval",
+			5*time.Second,
+			"interval the file of the file store is checked for changes in",
+		)
+		overridesPrefix = flag.String(
+			"overrides.prefix",
+			"",
+			"Consul KV prefix of operator overrides, empty disables overrides",
+		)
+		overridesInterval = flag.Duration(
+			"overrides.interval",
+			10*time.Second,
+			"interval overrides are refreshed from Consul in",
+		)
+		aliasesPrefix = flag.String(
+			"aliases.prefix",
+			"",
+			"Consul KV prefix of weighted alias service addresses, empty disables aliases",
+		)
+		aliasesInterval = flag.Duration(
+			"aliases.interval",
+			10*time.Second,
+			"interval aliases are refreshed from Consul in",
+		)
+		consulAuth = newConsulFlags(flag.CommandLine)
 	)
 	flag.Parse()
 
 	if !rDNSZone.MatchString(*dnsZone) {
 		log.Fatalf("invalid DNS zone: %s", *dnsZone)
 	}
+	if *panicThreshold < 0 || *panicThreshold > 100 {
+		log.Fatalf("invalid panic threshold: %f", *panicThreshold)
+	}
+	if *shedAction != "refuse" && *shedAction != "drop" {
+		log.Fatalf("invalid shed action: %s", *shedAction)
+	}
+	if *shedLatency > 0 && *maxInflight <= 0 {
+		log.Fatalf("adaptive limits require -dns.max-inflight")
+	}
+	if *dnssecKSK != "" && *dnssecZSK == "" {
+		log.Fatalf("DNSSEC requires -dnssec.zsk")
+	}
+	if (*dotAddr != "" || *dohAddr != "") && (*dnsCert == "" || *dnsKey == "") {
+		log.Fatalf("DoT and DoH require -dns.tls.cert and -dns.tls.key")
+	}
+	if (*httpCert == "") != (*httpKey == "") {
+		log.Fatalf("HTTP TLS requires -http.tls.cert and -http.tls.key")
+	}
+	if *httpClientCA != "" && *httpCert == "" {
+		log.Fatalf("client certificates require -http.tls.cert")
+	}
+	endpoints, err := parseEndpoints(*consulAddr)
+	if err != nil {
+		log.Fatalf("invalid Consul addresses: %s", err)
+	}
+	backends, err := parseBackends(*consulBackends)
+	if err != nil {
+		log.Fatalf("invalid Consul backends: %s", err)
+	}
+	if *storeKind != storeConsul && *storeKind != storeFile {
+		log.Fatalf("invalid store: %s", *storeKind)
+	}
+	if *storeKind == storeFile && *storeFilePath == "" {
+		log.Fatalf("the file store requires -store.file")
+	}
+	if *storeKind == storeFile && *overridesPrefix != "" {
+		log.Fatalf("overrides require the consul store")
+	}
+	if *storeKind == storeFile && *aliasesPrefix != "" {
+		log.Fatalf("aliases require the consul store")
+	}
+	if *flapHold != "out" && *flapHold != "in" {
+		log.Fatalf("invalid flap hold: %s", *flapHold)
+	}
 
 	log.Printf("glimpse-agent starting. v%s", version)
-	client, err := api.NewClient(&api.Config{
-		Address:    *consulAddr,
+	consulClient, token, err := consulAuth.httpClient(*consulTimeout)
+	if err != nil {
+		logger.Fatalf("configuring consul client failed: %s", err)
+	}
+
+	failover := newFailover(*consulAuth.scheme, endpoints, consulClient.Transport, logFailover(logger))
+	if *storeKind == storeConsul {
+		go failover.run(*consulProbeInterval, *consulTimeout)
+	}
+
+	config := &api.Config{
+		Address:    endpoints[0],
+		Scheme:     *consulAuth.scheme,
 		Datacenter: *srvZone,
-	})
+		HttpClient: &http.Client{Timeout: consulClient.Timeout, Transport: failover},
+	}
+	client, err := api.NewClient(config)
+	if err != nil {
+		logger.Fatalf("consul connection failed: %s", err)
+	}
+
+	// Drains act on the agent of the local host, which is the first address.
+	// Its endpoints must never fail over to the agent of another host.
+	local := *config
+	local.HttpClient = consulClient
+	localClient, err := api.NewClient(&local)
 	if err != nil {
 		logger.Fatalf("consul connection failed: %s", err)
 	}
 
+	var flaps *flapTracker
+	if *flapHalfLife > 0 {
+		flaps = newFlapTracker(*flapHalfLife, *flapHold == "in")
+		http.Handle("/v1/flaps", flapsHandler(flaps))
+	}
+
+	// newBackend returns the store of a Consul backend, instrumented and
+	// guarded by its own circuit breaker.
+	newBackend := func(name string, config *api.Config, datacenter string) store {
+		cs := newConsulStore(config, logger, *panicThreshold/100, flaps)
+		cs.datacenter = datacenter
+
+		var s store = newMetricsStore(name, cs)
+		if *breakerFailures > 0 {
+			s = newBreakerStore(
+				name,
+				s,
+				*breakerFailures,
+				*breakerCooldown,
+				*breakerMaxCooldown,
+				logBreaker(logger, name),
+			)
+		}
+
+		return s
+	}
+
+	zones := map[string]store{}
+	for _, b := range backends {
+		c := *config
+		c.Address = b.address
+		c.HttpClient = consulClient
+		c.Datacenter = b.datacenter
+		zones[b.zone] = newBackend(b.zone, &c, b.datacenter)
+	}
+
 	var (
 		errc  = make(chan error, 1)
-		store = newLoggingStore(
-			logger,
-			newMetricsStore(
-				newConsulStore(
-					client,
-				),
-			),
-		)
+		store = newBackend(defaultBackend, config, "")
 	)
+	if len(zones) > 0 {
+		store = newZoneStore(store, zones)
+	}
+
+	var files *fileStore
+	if *storeKind == storeFile {
+		files, err = newFileStore(*storeFilePath)
+		if err != nil {
+			logger.Fatalf("loading store file failed: %s", err)
+		}
+		go files.watch(*storeFileInterval, logger)
+
+		store = newMetricsStore(storeFile, files)
+	}
+
+	if *overridesPrefix != "" {
+		overrides := newOverrideStore(store, client.KV(), *overridesPrefix, logger)
+		if err := overrides.refresh(); err != nil {
+			logger.Printf("[warning] overrides not loaded: %s", err)
+		}
+		go overrides.run(*overridesInterval)
+
+		http.Handle("/v1/overrides", overridesHandler(overrides))
+		http.Handle("/v1/overrides/", overridesHandler(overrides))
+
+		store = overrides
+	}
+	store = newLoggingStore(logger, store)
+
+	var snapshot *snapshotStore
+	if *snapshotPath != "" {
+		snapshot = newSnapshotStore(store, *snapshotPath, *snapshotMaxAge, logger)
+		if err := snapshot.load(); err != nil {
+			logger.Printf("[warning] snapshot not loaded: %s", err)
+		}
+		go snapshot.run(*snapshotInterval)
+
+		store = snapshot
+	}
+
+	if *cacheTTL > 0 {
+		store = newCachingStore(store, *cacheTTL, *cacheNegativeTTL)
+	}
+
+	// Aliases wrap the cache, so every lookup is split on its own.
+	if *aliasesPrefix != "" {
+		aliases := newAliasStore(store, client.KV(), *aliasesPrefix, logger)
+		if err := aliases.refresh(); err != nil {
+			logger.Printf("[warning] aliases not loaded: %s", err)
+		}
+		go aliases.run(*aliasesInterval)
+
+		http.Handle("/v1/aliases", aliasesHandler(aliases))
+
+		store = aliases
+	}
+
+	var a *acl
+	if *aclFile != "" {
+		a, err = newACL(*aclFile)
+		if err != nil {
+			logger.Fatalf("loading ACL failed: %s", err)
+		}
+	}
+
+	var vs *views
+	if *viewsFile != "" {
+		vs, err = newViews(*viewsFile)
+		if err != nil {
+			logger.Fatalf("loading views failed: %s", err)
+		}
+	}
+
+	var answer dns.Handler = protocolHandler(
+		*maxAnswers,
+		newDNSHandler(
+			store,
+			dns.Fqdn(*dnsZone),
+			*degraded,
+			*queryBudget,
+			a,
+			vs,
+		),
+	)
+	if *dnssecZSK != "" {
+		s, err := loadSigner(dns.Fqdn(*dnsZone), *dnssecKSK, *dnssecZSK, *dnssecValidity)
+		if err != nil {
+			logger.Fatalf("loading DNSSEC keys failed: %s", err)
+		}
+		answer = dnssecHandler(s, answer)
+	}
+
+	var cert *certificate
+	if *dotAddr != "" || *dohAddr != "" {
+		cert, err = newCertificate(*dnsCert, *dnsKey)
+		if err != nil {
+			logger.Fatalf("loading DNS certificate failed: %s", err)
+		}
+	}
+
+	var httpTLS *certificate
+	if *httpCert != "" {
+		httpTLS, err = newCertificate(*httpCert, *httpKey)
+		if err != nil {
+			logger.Fatalf("loading HTTP certificate failed: %s", err)
+		}
+	}
+
+	var auth *authorizer
+	if *httpAuthFile != "" {
+		auth, err = newAuthorizer(*httpAuthFile)
+		if err != nil {
+			logger.Fatalf("loading HTTP auth config failed: %s", err)
+		}
+	}
+
+	go reload(func() {
+		if files != nil {
+			if err := files.load(); err != nil {
+				logger.Printf("[warning] store file not reloaded: %s", err)
+			}
+		}
+		if a != nil {
+			if err := a.load(); err != nil {
+				logger.Printf("[warning] ACL not reloaded: %s", err)
+			}
+		}
+		if vs != nil {
+			if err := vs.load(); err != nil {
+				logger.Printf("[warning] views not reloaded: %s", err)
+			}
+		}
+		if token != nil {
+			if err := token.load(); err != nil {
+				logger.Printf("[warning] consul token not reloaded: %s", err)
+			}
+		}
+		if cert != nil {
+			if err := cert.load(); err != nil {
+				logger.Printf("[warning] DNS certificate not reloaded: %s", err)
+			}
+		}
+		if httpTLS != nil {
+			if err := httpTLS.load(); err != nil {
+				logger.Printf("[warning] HTTP certificate not reloaded: %s", err)
+			}
+		}
+		if auth != nil {
+			if err := auth.load(); err != nil {
+				logger.Printf("[warning] HTTP auth config not reloaded: %s", err)
+			}
+		}
+	})
 
 	http.Handle("/metrics", prometheus.Handler())
+	http.Handle("/v1/instances/", instancesHandler(store, *queryBudget, a, vs))
+
+	// Drains are kept in Consul and the file store has no Consul endpoints.
+	if *storeKind == storeConsul {
+		drainer := newDrainer(localClient.Agent(), logger)
+		if err := drainer.restore(); err != nil {
+			logger.Printf("[warning] drain expiries not restored: %s", err)
+		}
+
+		http.Handle("/v1/status", statusHandler(storeConsul, failover))
+		http.Handle("/v1/drain", drainHandler(drainer))
+		http.Handle("/v1/drain/", drainHandler(drainer))
+	} else {
+		http.Handle("/v1/status", statusHandler(storeFile, nil))
+	}
+
+	rrl := newRateLimiter(*rrlRate, *rrlNXRate, *rrlSlip, *rrlLogOnly, logger)
+	go rrl.run(time.Minute)
 
 	dnsMux := dns.NewServeMux()
 	dnsMux.Handle(
 		".",
-		dnsLoggingHandler(
+		queryHandler(
 			logger,
-			dnsMetricsHandler(
-				protocolHandler(
-					*maxAnswers,
-					newDNSHandler(
-						store,
-						dns.Fqdn(*dnsZone),
-					),
-				),
-			),
+			rrl,
+			newShedder(*maxInflight, *maxInflightClient, *shedLatency),
+			*shedAction == "drop",
+			answer,
 		),
 	)
 
@@ -104,14 +590,39 @@ func main() {
 		Net:     "udp",
 	}, errc)
 
+	// DNS-over-TLS server
+	if *dotAddr != "" {
+		go runDoTServer(*dotAddr, cert.tlsConfig(), dnsMux, errc)
+	}
+	// DNS-over-HTTPS server
+	if *dohAddr != "" {
+		go runDoHServer(*dohAddr, cert.tlsConfig(), dnsMux, errc)
+	}
+
 	// HTTP server
-	go func(addr string, errc chan<- error) {
-		logger.Printf("HTTP listening on %s\n", addr)
-		errc <- fmt.Errorf(
-			"[error] HTTP - server failed: %s",
-			http.ListenAndServe(addr, nil),
-		)
-	}(*httpAddr, errc)
+	server := &http.Server{
+		Addr:    *httpAddr,
+		Handler: authHandler(auth, http.DefaultServeMux),
+	}
+	if httpTLS != nil {
+		server.TLSConfig = httpTLS.tlsConfig()
+	}
+	if *httpClientCA != "" {
+		if err := verifyClients(server.TLSConfig, *httpClientCA, auth == nil); err != nil {
+			logger.Fatalf("loading HTTP client CA failed: %s", err)
+		}
+	}
+	go func(server *http.Server, errc chan<- error) {
+		logger.Printf("HTTP listening on %s\n", server.Addr)
+
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		errc <- fmt.Errorf("[error] HTTP - server failed: %s", err)
+	}(server, errc)
 
 	// Signal handling
 	go func(errc chan<- error) { errc <- interrupt() }(errc)
@@ -120,15 +631,54 @@ func main() {
 		go registerConsulCollector(*consulInfo)
 	}
 
-	logger.Fatalln(<-errc)
+	err = <-errc
+
+	if snapshot != nil {
+		if err := snapshot.flush(); err != nil {
+			logger.Printf("[warning] writing snapshot failed: %s", err)
+		}
+	}
+
+	logger.Fatalln(err)
 }
 
 func interrupt() error {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 	return fmt.Errorf("[info] got signal: %s. Good bye", <-c)
 }
 
+// reload calls fn on every SIGHUP.
+func reload(fn func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	for range c {
+		logger.Printf("[info] got signal: %s. Reloading", syscall.SIGHUP)
+		fn()
+	}
+}
+
+// queryHandler wraps the answering handler with logging, metrics, rate
+// limiting and load shedding, in the order all DNS listeners serve queries.
+func queryHandler(
+	logger *log.Logger,
+	rrl *rateLimiter,
+	s *shedder,
+	drop bool,
+	answer dns.Handler,
+) dns.Handler {
+	return dnsLoggingHandler(
+		logger,
+		dnsMetricsHandler(
+			rrlHandler(
+				rrl,
+				sheddingHandler(s, drop, answer),
+			),
+		),
+	)
+}
+
 func runDNSServer(server *dns.Server, errc chan error) {
 	logger.Printf("DNS/%s listening on %s\n", server.Net, server.Addr)
 	errc <- fmt.Errorf(
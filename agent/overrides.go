@@ -0,0 +1,578 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// overrideAuditSize bounds the number of audit entries kept in Consul.
+	overrideAuditSize = 1000
+
+	// overrideAuditPath lists the audit trail under /v1/overrides. It can't
+	// clash with a service address, which always has five fields.
+	overrideAuditPath = "audit"
+)
+
+// overrideAction is the change an override applies to the instances of a
+// service address.
+type overrideAction string
+
+const (
+	// overrideReplace answers with the instances of the override only.
+	overrideReplace overrideAction = "replace"
+	// overrideAdd answers with the instances of the override in addition.
+	overrideAdd overrideAction = "add"
+	// overrideRemove leaves out the instances of the override.
+	overrideRemove overrideAction = "remove"
+	// overrideBlackhole answers as if the service address had no instances.
+	overrideBlackhole overrideAction = "blackhole"
+)
+
+// override is an operator-defined change of the instances of a service
+// address, stored as JSON in Consul KV so all agents of the zone apply it.
+type override struct {
+	Address   string         `json:"address"`
+	Action    overrideAction `json:"action"`
+	Instances []instanceJSON `json:"instances,omitempty"`
+	Reason    string         `json:"reason,omitempty"`
+	Author    string         `json:"author"`
+	Created   time.Time      `json:"created"`
+	Until     *time.Time     `json:"until,omitempty"`
+
+	info info
+	is   instances
+}
+
+// overrideAudit is an entry of the audit trail of overrides.
+type overrideAudit struct {
+	Time      time.Time `json:"time"`
+	Author    string    `json:"author"`
+	Operation string    `json:"operation"`
+	Override  override  `json:"override"`
+}
+
+// newOverride validates an override of the service address.
+func newOverride(
+	address string,
+	action overrideAction,
+	is []instanceJSON,
+	reason string,
+	until time.Time,
+) (override, error) {
+	o := override{
+		Address:   address,
+		Action:    action,
+		Instances: is,
+		Reason:    reason,
+	}
+	if !until.IsZero() {
+		o.Until = &until
+	}
+
+	if err := o.parse(); err != nil {
+		return override{}, err
+	}
+
+	return o, nil
+}
+
+// parse sets the service address and instances of the override from its
+// JSON fields.
+func (o *override) parse() error {
+	i, err := infoFromAddr(o.Address)
+	if err != nil {
+		return err
+	}
+	o.info = i
+
+	switch o.Action {
+	case overrideReplace, overrideAdd, overrideRemove:
+		if len(o.Instances) == 0 {
+			return fmt.Errorf("%s override without instances", o.Action)
+		}
+	case overrideBlackhole:
+		if len(o.Instances) > 0 {
+			return fmt.Errorf("blackhole override with instances")
+		}
+	default:
+		return fmt.Errorf("action %q is invalid", o.Action)
+	}
+
+	o.is = make(instances, 0, len(o.Instances))
+	for _, ij := range o.Instances {
+		ip := net.ParseIP(ij.IP)
+		if ip == nil {
+			return newError(errInvalidIP, "%q", ij.IP)
+		}
+		if ij.Port == 0 && o.Action != overrideRemove {
+			return fmt.Errorf("instance %s without port", ij.IP)
+		}
+		// An empty host would be answered as the SRV target ".", which
+		// tells clients the service is not available.
+		if ij.Host == "" && o.Action != overrideRemove {
+			return fmt.Errorf("instance %s without host", ij.IP)
+		}
+
+		o.is = append(o.is, instance{
+			host:   ij.Host,
+			ip:     ip,
+			port:   ij.Port,
+			status: checkPassing,
+		})
+	}
+
+	return nil
+}
+
+func (o override) expired(now time.Time) bool {
+	return o.Until != nil && !now.Before(*o.Until)
+}
+
+// apply returns the instances of the service address with the override
+// applied to the result of the next store.
+func (o override) apply(is instances, err error) (instances, error) {
+	switch o.Action {
+	case overrideBlackhole:
+		return nil, newError(errNoInstances, "blackholed %s", o.Address)
+	case overrideReplace:
+		return append(instances{}, o.is...), nil
+	case overrideAdd:
+		if err != nil && !isNoInstances(err) {
+			return nil, err
+		}
+		return append(append(instances{}, is...), o.is...), nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := instances{}
+	for _, i := range is {
+		if !o.removes(i) {
+			res = append(res, i)
+		}
+	}
+	if len(res) == 0 {
+		return nil, newError(errNoInstances, "all removed from %s", o.Address)
+	}
+
+	return res, nil
+}
+
+// removes reports whether the instance matches one of the instances of a
+// remove override. Instances without port match all ports of the IP.
+func (o override) removes(i instance) bool {
+	for _, r := range o.is {
+		if r.ip.Equal(i.ip) && (r.port == 0 || r.port == i.port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// overrideStore applies the overrides stored in Consul KV under prefix to
+// the results of the next store. Overrides are refreshed periodically and
+// expired ones are deleted.
+type overrideStore struct {
+	next   store
+	kv     *api.KV
+	prefix string
+	logger *log.Logger
+
+	mu        sync.RWMutex
+	now       func() time.Time
+	overrides map[info]override
+}
+
+func newOverrideStore(next store, kv *api.KV, prefix string, logger *log.Logger) *overrideStore {
+	return &overrideStore{
+		next:      next,
+		kv:        kv,
+		prefix:    strings.Trim(prefix, "/"),
+		logger:    logger,
+		now:       time.Now,
+		overrides: map[info]override{},
+	}
+}
+
+func (s *overrideStore) getInstances(ctx context.Context, i info) (instances, error) {
+	o, ok := s.lookup(i)
+	if !ok {
+		return s.next.getInstances(ctx, i)
+	}
+
+	overrideAnswers.WithLabelValues(string(o.Action)).Inc()
+	if o.Action == overrideBlackhole || o.Action == overrideReplace {
+		return o.apply(nil, nil)
+	}
+
+	return o.apply(s.next.getInstances(ctx, i))
+}
+
+func (s *overrideStore) getInstancesByHealth(ctx context.Context, i info, h health) (instances, error) {
+	o, ok := s.lookup(i)
+	if !ok {
+		return s.next.getInstancesByHealth(ctx, i, h)
+	}
+
+	overrideAnswers.WithLabelValues(string(o.Action)).Inc()
+	if o.Action == overrideBlackhole || o.Action == overrideReplace {
+		return o.apply(nil, nil)
+	}
+
+	return o.apply(s.next.getInstancesByHealth(ctx, i, h))
+}
+
+func (s *overrideStore) getServers(ctx context.Context, zone string) (instances, error) {
+	return s.next.getServers(ctx, zone)
+}
+
+// lookup returns the unexpired override of the service address.
+func (s *overrideStore) lookup(i info) (override, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	o, ok := s.overrides[i]
+	if !ok || o.expired(s.now()) {
+		return override{}, false
+	}
+
+	return o, true
+}
+
+func (s *overrideStore) serviceKey(address string) string {
+	return s.prefix + "/services/" + address
+}
+
+func (s *overrideStore) auditPrefix() string {
+	return s.prefix + "/audit/"
+}
+
+// refresh replaces the overrides with the ones stored in Consul and deletes
+// expired ones.
+func (s *overrideStore) refresh() error {
+	pairs, _, err := s.kv.List(s.prefix+"/services/", nil)
+	if err != nil {
+		return consulError(err)
+	}
+
+	var (
+		now       = s.now()
+		overrides = map[info]override{}
+	)
+
+	for _, p := range pairs {
+		o := override{}
+		if err := json.Unmarshal(p.Value, &o); err != nil {
+			s.logger.Printf("[warning] invalid override %s: %s", p.Key, err)
+			continue
+		}
+		if err := o.parse(); err != nil {
+			s.logger.Printf("[warning] invalid override %s: %s", p.Key, err)
+			continue
+		}
+
+		if o.expired(now) {
+			s.expire(o, p)
+			continue
+		}
+
+		overrides[o.info] = o
+	}
+
+	s.mu.Lock()
+	s.overrides = overrides
+	s.mu.Unlock()
+
+	overridesActive.Set(float64(len(overrides)))
+
+	return nil
+}
+
+// expire deletes the expired override unless it was changed in the meantime,
+// possibly by another agent.
+func (s *overrideStore) expire(o override, p *api.KVPair) {
+	ok, _, err := s.kv.DeleteCAS(p, nil)
+	if err != nil {
+		s.logger.Printf("[warning] expired override %s not deleted: %s", o.Address, err)
+		return
+	}
+	if ok {
+		s.audit("expire", "glimpse-agent", o)
+	}
+}
+
+// run refreshes the overrides every interval.
+func (s *overrideStore) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.refresh(); err != nil {
+			s.logger.Printf("[warning] overrides not refreshed: %s", err)
+		}
+	}
+}
+
+// put stores the override, replacing an existing one of the service address.
+func (s *overrideStore) put(o override, author string) error {
+	o.Author = author
+	o.Created = s.now()
+
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.kv.Put(&api.KVPair{Key: s.serviceKey(o.Address), Value: b}, nil); err != nil {
+		return consulError(err)
+	}
+
+	s.mu.Lock()
+	s.overrides[o.info] = o
+	overridesActive.Set(float64(len(s.overrides)))
+	s.mu.Unlock()
+
+	s.audit("put", author, o)
+
+	return nil
+}
+
+// remove deletes the override of the service address.
+func (s *overrideStore) remove(address, author string) error {
+	i, err := infoFromAddr(address)
+	if err != nil {
+		return err
+	}
+
+	// The override may not have been refreshed into this agent yet, so only
+	// Consul knows whether it exists.
+	p, _, err := s.kv.Get(s.serviceKey(address), nil)
+	if err != nil {
+		return consulError(err)
+	}
+	if p == nil {
+		return newError(errNoInstances, "no override of %s", address)
+	}
+
+	// Invalid overrides are removed as well, and audited by address only.
+	o := override{}
+	json.Unmarshal(p.Value, &o)
+	o.Address = address
+
+	if _, err := s.kv.Delete(p.Key, nil); err != nil {
+		return consulError(err)
+	}
+
+	s.mu.Lock()
+	delete(s.overrides, i)
+	overridesActive.Set(float64(len(s.overrides)))
+	s.mu.Unlock()
+
+	s.audit("delete", author, o)
+
+	return nil
+}
+
+// list returns all unexpired overrides ordered by service address.
+func (s *overrideStore) list() []override {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var (
+		now = s.now()
+		res = []override{}
+	)
+	for _, o := range s.overrides {
+		if !o.expired(now) {
+			res = append(res, o)
+		}
+	}
+	sort.Sort(overridesByAddress(res))
+
+	return res
+}
+
+// audit logs the change of the override and appends it to the audit trail
+// in Consul, dropping the oldest entries beyond overrideAuditSize. Failing to
+// store the entry is logged only, as the change already happened.
+func (s *overrideStore) audit(op, author string, o override) {
+	var (
+		now   = s.now()
+		entry = overrideAudit{Time: now, Author: author, Operation: op, Override: o}
+		until = "never"
+	)
+
+	if o.Until != nil {
+		until = o.Until.Format(time.RFC3339)
+	}
+	s.logger.Printf(
+		"AUDIT override %s %s %s by %s until %s: %s",
+		op,
+		o.Action,
+		o.Address,
+		author,
+		until,
+		o.Reason,
+	)
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		s.logger.Printf("[warning] audit entry not stored: %s", err)
+		return
+	}
+
+	// Zero-padded timestamps keep the keys in chronological order.
+	key := fmt.Sprintf("%s%020d-%s", s.auditPrefix(), now.UnixNano(), o.Address)
+	if _, err := s.kv.Put(&api.KVPair{Key: key, Value: b}, nil); err != nil {
+		s.logger.Printf("[warning] audit entry not stored: %s", err)
+		return
+	}
+
+	keys, _, err := s.kv.Keys(s.auditPrefix(), "", nil)
+	if err != nil {
+		s.logger.Printf("[warning] audit trail not trimmed: %s", err)
+		return
+	}
+	sort.Strings(keys)
+
+	for len(keys) > overrideAuditSize {
+		if _, err := s.kv.Delete(keys[0], nil); err != nil {
+			s.logger.Printf("[warning] audit trail not trimmed: %s", err)
+			return
+		}
+		keys = keys[1:]
+	}
+}
+
+// auditTrail returns the audit entries, newest first.
+func (s *overrideStore) auditTrail() ([]overrideAudit, error) {
+	pairs, _, err := s.kv.List(s.auditPrefix(), nil)
+	if err != nil {
+		return nil, consulError(err)
+	}
+
+	entries := make([]overrideAudit, 0, len(pairs))
+	for i := len(pairs) - 1; i >= 0; i-- {
+		e := overrideAudit{}
+		if err := json.Unmarshal(pairs[i].Value, &e); err != nil {
+			s.logger.Printf("[warning] invalid audit entry %s: %s", pairs[i].Key, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+type overridesByAddress []override
+
+func (o overridesByAddress) Len() int           { return len(o) }
+func (o overridesByAddress) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+func (o overridesByAddress) Less(i, j int) bool { return o[i].Address < o[j].Address }
+
+// overridesHandler exposes the overrides under /v1/overrides:
+//
+//	GET           /v1/overrides            list current overrides
+//	GET           /v1/overrides/audit      list the audit trail, newest first
+//	PUT, DELETE   /v1/overrides/<address>  override a service address
+//
+// PUT requires the query parameter action and accepts the optional query
+// parameters reason and expiry, the latter as a duration like 15m. The
+// instances of replace, add and remove overrides are sent as JSON body, e.g.
+// [{"host": "db-1", "ip": "10.0.0.1", "port": 5432}].
+func overridesHandler(s *overrideStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		address := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/overrides"), "/")
+
+		if address == "" || address == overrideAuditPath {
+			if r.Method != "GET" {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			if address == "" {
+				httpJSON(w, s.list())
+				return
+			}
+
+			entries, err := s.auditTrail()
+			if err != nil {
+				httpError(w, err)
+				return
+			}
+			httpJSON(w, entries)
+			return
+		}
+
+		var err error
+
+		switch r.Method {
+		case "PUT":
+			o, perr := overrideFromRequest(address, r)
+			if perr != nil {
+				http.Error(w, perr.Error(), http.StatusBadRequest)
+				return
+			}
+
+			err = s.put(o, httpIdentity(r))
+		case "DELETE":
+			if _, perr := infoFromAddr(address); perr != nil {
+				http.Error(w, perr.Error(), http.StatusBadRequest)
+				return
+			}
+
+			err = s.remove(address, httpIdentity(r))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// overrideFromRequest returns the override of the service address described
+// by the PUT request.
+func overrideFromRequest(address string, r *http.Request) (override, error) {
+	var (
+		q     = r.URL.Query()
+		until time.Time
+		is    = []instanceJSON{}
+	)
+
+	if expiry := q.Get("expiry"); expiry != "" {
+		dur, err := time.ParseDuration(expiry)
+		if err != nil || dur <= 0 {
+			return override{}, fmt.Errorf("invalid expiry %q", expiry)
+		}
+		until = time.Now().Add(dur)
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return override{}, err
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &is); err != nil {
+			return override{}, fmt.Errorf("invalid instances: %s", err)
+		}
+	}
+
+	return newOverride(address, overrideAction(q.Get("action")), is, q.Get("reason"), until)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// stubKV is an in-memory Consul KV API.
+type stubKV struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	pairs map[string]*api.KVPair
+	index uint64
+}
+
+func setupStubKV(t *testing.T) (*api.KV, *stubKV) {
+	kv := &stubKV{pairs: map[string]*api.KVPair{}}
+	kv.Server = httptest.NewServer(http.HandlerFunc(kv.serve))
+
+	u, err := url.Parse(kv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := api.NewClient(&api.Config{Address: u.Host})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client.KV(), kv
+}
+
+func (kv *stubKV) serve(w http.ResponseWriter, r *http.Request) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	var (
+		key = strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		q   = r.URL.Query()
+	)
+
+	switch r.Method {
+	case "GET":
+		// Single keys are matched exactly, lists and keys by prefix.
+		_, recurse := q["recurse"]
+		_, onlyKeys := q["keys"]
+
+		keys := []string{}
+		for k := range kv.pairs {
+			if k == key || ((recurse || onlyKeys) && strings.HasPrefix(k, key)) {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		sort.Strings(keys)
+
+		if _, ok := q["keys"]; ok {
+			json.NewEncoder(w).Encode(keys)
+			return
+		}
+		pairs := api.KVPairs{}
+		for _, k := range keys {
+			pairs = append(pairs, kv.pairs[k])
+		}
+		json.NewEncoder(w).Encode(pairs)
+	case "PUT":
+		b, _ := ioutil.ReadAll(r.Body)
+		kv.index++
+		kv.pairs[key] = &api.KVPair{Key: key, Value: b, ModifyIndex: kv.index}
+		w.Write([]byte("true"))
+	case "DELETE":
+		if cas := q.Get("cas"); cas != "" {
+			p, ok := kv.pairs[key]
+			if !ok || strconv.FormatUint(p.ModifyIndex, 10) != cas {
+				w.Write([]byte("false"))
+				return
+			}
+		}
+		delete(kv.pairs, key)
+		w.Write([]byte("true"))
+	}
+}
+
+func (kv *stubKV) keys(prefix string) []string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	keys := []string{}
+	for k := range kv.pairs {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func TestOverrideApply(t *testing.T) {
+	var (
+		a = instance{host: "a", ip: net.ParseIP("10.0.0.1"), port: 80}
+		b = instance{host: "b", ip: net.ParseIP("10.0.0.2"), port: 80}
+		c = instanceJSON{Host: "c", IP: "10.0.0.3", Port: 5432}
+
+		consulErr = newError(errConsulAPI, "down")
+		noneErr   = newError(errNoInstances, "none")
+	)
+
+	for _, test := range []struct {
+		action    overrideAction
+		instances []instanceJSON
+		is        instances
+		err       error
+		want      []string
+		wantErr   func(error) bool
+	}{
+		{action: overrideBlackhole, is: instances{a}, wantErr: isNoInstances},
+		{action: overrideReplace, instances: []instanceJSON{c}, err: consulErr, want: []string{"c"}},
+		{action: overrideAdd, instances: []instanceJSON{c}, is: instances{a, b}, want: []string{"a", "b", "c"}},
+		{action: overrideAdd, instances: []instanceJSON{c}, err: noneErr, want: []string{"c"}},
+		{action: overrideAdd, instances: []instanceJSON{c}, err: consulErr, wantErr: isConsulAPI},
+		{action: overrideRemove, instances: []instanceJSON{{IP: "10.0.0.1"}}, is: instances{a, b}, want: []string{"b"}},
+		{action: overrideRemove, instances: []instanceJSON{{IP: "10.0.0.1", Port: 81}}, is: instances{a, b}, want: []string{"a", "b"}},
+		{action: overrideRemove, instances: []instanceJSON{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}}, is: instances{a, b}, wantErr: isNoInstances},
+	} {
+		o, err := newOverride("http.api.prod.harpoon.gg", test.action, test.instances, "", time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		is, err := o.apply(test.is, test.err)
+		if test.wantErr != nil {
+			if !test.wantErr(err) {
+				t.Errorf("%s: unexpected error %v", test.action, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.action, err)
+		}
+
+		hosts := []string{}
+		for _, i := range is {
+			hosts = append(hosts, i.host)
+		}
+		if !reflect.DeepEqual(test.want, hosts) {
+			t.Errorf("%s: want %v, got %v", test.action, test.want, hosts)
+		}
+	}
+}
+
+func TestNewOverrideInvalid(t *testing.T) {
+	for _, test := range []struct {
+		address   string
+		action    overrideAction
+		instances []instanceJSON
+	}{
+		{"http.api.prod.harpoon", overrideBlackhole, nil},
+		{"http.api.prod.harpoon.gg", "pin", nil},
+		{"http.api.prod.harpoon.gg", overrideReplace, nil},
+		{"http.api.prod.harpoon.gg", overrideBlackhole, []instanceJSON{{IP: "10.0.0.1", Port: 80}}},
+		{"http.api.prod.harpoon.gg", overrideAdd, []instanceJSON{{IP: "db", Port: 80}}},
+		{"http.api.prod.harpoon.gg", overrideAdd, []instanceJSON{{Host: "db", IP: "10.0.0.1"}}},
+		{"http.api.prod.harpoon.gg", overrideAdd, []instanceJSON{{IP: "10.0.0.1", Port: 80}}},
+		{"http.api.prod.harpoon.gg", overrideReplace, []instanceJSON{{IP: "10.0.0.1", Port: 80}}},
+	} {
+		if _, err := newOverride(test.address, test.action, test.instances, "", time.Time{}); err == nil {
+			t.Errorf("want error for %s override of %s with %v", test.action, test.address, test.instances)
+		}
+	}
+}
+
+func TestOverrideStore(t *testing.T) {
+	kv, stub := setupStubKV(t)
+	defer stub.Close()
+
+	var (
+		ctx    = context.Background()
+		srv    = info{service: "http", job: "api", env: "prod", product: "harpoon", zone: "gg"}
+		logger = log.New(ioutil.Discard, "", 0)
+		next   = &testStore{instances: map[info]instances{
+			srv: {{host: "a", ip: net.ParseIP("10.0.0.1"), port: 80}},
+		}}
+		s     = newOverrideStore(next, kv, "/glimpse/overrides/", logger)
+		other = newOverrideStore(next, kv, "glimpse/overrides", logger)
+		now   = time.Now()
+	)
+
+	o, err := newOverride(srv.addr(), overrideBlackhole, nil, "incident", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.put(o, "ops"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.getInstances(ctx, srv); !isNoInstances(err) {
+		t.Errorf("want blackholed service address, got %v", err)
+	}
+
+	// Other agents see the override after refreshing.
+	if _, err := other.getInstances(ctx, srv); err != nil {
+		t.Errorf("want override not applied before refresh, got %v", err)
+	}
+	if err := other.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.getInstancesByHealth(ctx, srv, healthAny); !isNoInstances(err) {
+		t.Errorf("want blackholed service address after refresh, got %v", err)
+	}
+	if want, got := "ops", other.list()[0].Author; want != got {
+		t.Errorf("want author %s, got %s", want, got)
+	}
+
+	// Expired overrides are ignored and deleted on refresh.
+	other.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, err := other.getInstances(ctx, srv); err != nil {
+		t.Errorf("want expired override ignored, got %v", err)
+	}
+	if err := other.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := stub.keys("glimpse/overrides/services/"); len(keys) != 0 {
+		t.Errorf("want expired override deleted, got %v", keys)
+	}
+	s.now = other.now
+
+	o, err = newOverride(srv.addr(), overrideRemove, []instanceJSON{{IP: "10.0.0.1"}}, "", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.put(o, "ops"); err != nil {
+		t.Fatal(err)
+	}
+	// Overrides not refreshed yet can be removed by other agents.
+	if err := other.remove(srv.addr(), "ops"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.remove(srv.addr(), "ops"); !isNoInstances(err) {
+		t.Errorf("want error removing missing override, got %v", err)
+	}
+	if err := s.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.getInstances(ctx, srv); err != nil {
+		t.Errorf("want instances after removing override, got %v", err)
+	}
+
+	entries, err := s.auditTrail()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := []string{}
+	for _, e := range entries {
+		ops = append(ops, e.Operation+" "+string(e.Override.Action)+" "+e.Author)
+	}
+	want := []string{
+		"delete remove ops",
+		"put remove ops",
+		"expire blackhole glimpse-agent",
+		"put blackhole ops",
+	}
+	if !reflect.DeepEqual(want, ops) {
+		t.Errorf("want audit trail %v, got %v", want, ops)
+	}
+}
+
+func TestOverridesHandler(t *testing.T) {
+	kv, stub := setupStubKV(t)
+	defer stub.Close()
+
+	var (
+		srv = info{service: "db", job: "vendor", env: "prod", product: "harpoon", zone: "gg"}
+		s   = newOverrideStore(&testStore{}, kv, "glimpse/overrides", log.New(ioutil.Discard, "", 0))
+		h   = overridesHandler(s)
+	)
+
+	for _, test := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{"PUT", "/v1/overrides/" + srv.addr() + "?action=add&reason=vendor", `[{"host": "db", "ip": "10.0.0.9", "port": 5432}]`, http.StatusNoContent},
+		{"PUT", "/v1/overrides/" + srv.addr() + "?action=add", `[{"ip": "10.0.0.9"`, http.StatusBadRequest},
+		{"PUT", "/v1/overrides/" + srv.addr() + "?action=pin", "", http.StatusBadRequest},
+		{"PUT", "/v1/overrides/" + srv.addr() + "?action=blackhole&expiry=-1m", "", http.StatusBadRequest},
+		{"PUT", "/v1/overrides/invalid?action=blackhole", "", http.StatusBadRequest},
+		{"POST", "/v1/overrides", "", http.StatusMethodNotAllowed},
+		{"PATCH", "/v1/overrides/" + srv.addr(), "", http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(test.method, test.path, bytes.NewBufferString(test.body)))
+		if want, got := test.want, w.Code; want != got {
+			t.Errorf("%s %s: want status %d, got %d: %s", test.method, test.path, want, got, w.Body)
+		}
+	}
+
+	is, err := s.getInstances(context.Background(), srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "10.0.0.9", is[0].ip.String(); want != got {
+		t.Errorf("want added instance %s, got %s", want, got)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/overrides", nil))
+	res := []override{}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(res); want != got {
+		t.Fatalf("want %d overrides, got %d", want, got)
+	}
+	if want, got := "vendor", res[0].Reason; want != got {
+		t.Errorf("want reason %s, got %s", want, got)
+	}
+	// Without authorizer the author is the client IP.
+	if want, got := "192.0.2.1", res[0].Author; want != got {
+		t.Errorf("want author %s, got %s", want, got)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/v1/overrides/"+srv.addr(), nil))
+	if want, got := http.StatusNoContent, w.Code; want != got {
+		t.Errorf("want status %d, got %d", want, got)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/v1/overrides/"+srv.addr(), nil))
+	if want, got := http.StatusNotFound, w.Code; want != got {
+		t.Errorf("want status %d for missing override, got %d", want, got)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/overrides/audit", nil))
+	entries := []overrideAudit{}
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(entries); want != got {
+		t.Errorf("want %d audit entries, got %d", want, got)
+	}
+}
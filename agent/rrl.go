@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Responses are rate limited per client network of these sizes, so a
+	// client can't escape the limit by rotating addresses.
+	rrlIPv4Prefix = 24
+	rrlIPv6Prefix = 56
+
+	// rrlSweepInterval is the interval idle buckets are dropped in.
+	rrlSweepInterval = 10 * time.Second
+
+	// nxTopNames is the number of names exported by the NXDOMAIN tracking.
+	nxTopNames = 10
+
+	// nxMaxNames bounds the number of names tracked per interval, further
+	// names are counted as nxOtherName.
+	nxMaxNames  = 10000
+	nxOtherName = "other"
+)
+
+// rrlKey identifies the responses sharing a rate limit.
+type rrlKey struct {
+	prefix string
+	qname  string
+	rcode  int
+}
+
+type rrlBucket struct {
+	tokens  float64
+	updated time.Time
+
+	// limited counts the responses limited since the bucket last had tokens.
+	limited int
+}
+
+// rateLimiter implements response rate limiting (RRL) along the lines of
+// https://kb.isc.org/docs/aa-00994. Identical responses to a client network
+// are limited to rate per second, NXDOMAIN responses to nxRate per second.
+// Every slip-th limited response is answered truncated, so legitimate clients
+// retry over TCP, all others are dropped. In logOnly mode limited responses
+// are only logged and counted.
+type rateLimiter struct {
+	rate    float64
+	nxRate  float64
+	slip    int
+	logOnly bool
+	logger  *log.Logger
+
+	mu      sync.Mutex
+	now     func() time.Time
+	swept   time.Time
+	buckets map[rrlKey]*rrlBucket
+	nx      map[string]int
+}
+
+func newRateLimiter(
+	rate, nxRate float64,
+	slip int,
+	logOnly bool,
+	logger *log.Logger,
+) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		nxRate:  nxRate,
+		slip:    slip,
+		logOnly: logOnly,
+		logger:  logger,
+		now:     time.Now,
+		buckets: map[rrlKey]*rrlBucket{},
+		nx:      map[string]int{},
+	}
+}
+
+// rrl actions for a response.
+const (
+	rrlPass = "pass"
+	rrlDrop = "drop"
+	rrlSlip = "slip"
+	rrlLog  = "log"
+)
+
+// check returns the action for a response to the client.
+func (l *rateLimiter) check(client net.Addr, res *dns.Msg) string {
+	if len(res.Question) == 0 {
+		return rrlPass
+	}
+
+	// Names are case-insensitive, and clients randomizing the case of names
+	// (0x20 encoding) must not get a bucket per query.
+	var (
+		qname = strings.ToLower(res.Question[0].Name)
+		rate  = l.rate
+		nx    = res.Rcode == dns.RcodeNameError || isBlackLie(res)
+	)
+	if nx {
+		dnsNXDomain.Inc()
+		rate = l.nxRate
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if nx {
+		l.observeNX(qname)
+	}
+
+	// TCP clients can't spoof their address, which is what RRL guards
+	// against.
+	if _, ok := client.(*net.UDPAddr); !ok || rate <= 0 {
+		return rrlPass
+	}
+
+	now := l.now()
+	l.sweep(now)
+
+	var (
+		key   = rrlKey{prefix: clientPrefix(client), qname: qname, rcode: res.Rcode}
+		burst = math.Max(rate, 1)
+	)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rrlBucket{tokens: burst, updated: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = 0
+		return rrlPass
+	}
+
+	b.limited++
+	if b.limited == 1 {
+		l.logger.Printf(
+			"DNS rate limiting %s %s %s",
+			key.prefix,
+			qname,
+			dns.RcodeToString[res.Rcode],
+		)
+	}
+
+	switch {
+	case l.logOnly:
+		return rrlLog
+	case l.slip > 0 && b.limited%l.slip == 0:
+		return rrlSlip
+	default:
+		return rrlDrop
+	}
+}
+
+func (l *rateLimiter) observeNX(qname string) {
+	if _, ok := l.nx[qname]; !ok && len(l.nx) >= nxMaxNames {
+		qname = nxOtherName
+	}
+	l.nx[qname]++
+}
+
+// sweep drops buckets idle for rrlSweepInterval, at most once per
+// rrlSweepInterval.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < rrlSweepInterval {
+		return
+	}
+	l.swept = now
+
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) > rrlSweepInterval {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+type nxName struct {
+	name  string
+	count int
+}
+
+type nxNames []nxName
+
+func (ns nxNames) Len() int      { return len(ns) }
+func (ns nxNames) Swap(i, j int) { ns[i], ns[j] = ns[j], ns[i] }
+func (ns nxNames) Less(i, j int) bool {
+	if ns[i].count != ns[j].count {
+		return ns[i].count > ns[j].count
+	}
+	return ns[i].name < ns[j].name
+}
+
+// publish exports the names with the most NXDOMAIN responses since the last
+// call and starts a new interval.
+func (l *rateLimiter) publish() {
+	dnsNXDomainTop.Reset()
+	for _, n := range l.topNX() {
+		dnsNXDomainTop.WithLabelValues(n.name).Set(float64(n.count))
+	}
+}
+
+// topNX returns the names with the most NXDOMAIN responses since the last
+// call.
+func (l *rateLimiter) topNX() nxNames {
+	l.mu.Lock()
+	ns := make(nxNames, 0, len(l.nx))
+	for name, count := range l.nx {
+		ns = append(ns, nxName{name: name, count: count})
+	}
+	l.nx = map[string]int{}
+	l.mu.Unlock()
+
+	sort.Sort(ns)
+	if len(ns) > nxTopNames {
+		ns = ns[:nxTopNames]
+	}
+
+	return ns
+}
+
+// run publishes the top NXDOMAIN names every interval.
+func (l *rateLimiter) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.publish()
+	}
+}
+
+// rrlHandler applies the rate limiter to all responses of next.
+func rrlHandler(l *rateLimiter, next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		next.ServeDNS(&rrlWriter{ResponseWriter: w, limiter: l}, req)
+	})
+}
+
+type rrlWriter struct {
+	dns.ResponseWriter
+
+	limiter *rateLimiter
+}
+
+func (w *rrlWriter) WriteMsg(res *dns.Msg) error {
+	action := w.limiter.check(w.RemoteAddr(), res)
+	if action != rrlPass {
+		dnsRateLimited.WithLabelValues(action).Inc()
+	}
+
+	switch action {
+	case rrlDrop:
+		return nil
+	case rrlSlip:
+		tc := &dns.Msg{}
+		tc.SetReply(res)
+		tc.Rcode = res.Rcode
+		tc.Authoritative = res.Authoritative
+		tc.Truncated = true
+		return w.ResponseWriter.WriteMsg(tc)
+	}
+
+	return w.ResponseWriter.WriteMsg(res)
+}
+
+// shed passes the reason of a shed query on to the wrapped writer.
+func (w *rrlWriter) shed(reason string) {
+	if r, ok := w.ResponseWriter.(shedRecorder); ok {
+		r.shed(reason)
+	}
+}
+
+// clientPrefix returns the network of the client rate limits apply to.
+func clientPrefix(addr net.Addr) string {
+	ip := net.ParseIP(clientIP(addr))
+	if ip == nil {
+		return ""
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%s/%d", ip4.Mask(net.CIDRMask(rrlIPv4Prefix, 32)), rrlIPv4Prefix)
+	}
+
+	return fmt.Sprintf("%s/%d", ip.Mask(net.CIDRMask(rrlIPv6Prefix, 128)), rrlIPv6Prefix)
+}
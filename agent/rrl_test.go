@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func rrlQuery(h dns.Handler, addr net.Addr, name string) *dns.Msg {
+	var (
+		w = &testWriter{remoteAddr: addr}
+		m = &dns.Msg{}
+	)
+	m.SetQuestion(name, dns.TypeA)
+	h.ServeDNS(w, m)
+
+	return w.msg
+}
+
+func newTestRateLimiter(slip int, logOnly bool) (*rateLimiter, *testClock) {
+	var (
+		clock = newTestClock()
+		l     = newRateLimiter(2, 1, slip, logOnly, log.New(ioutil.Discard, "", 0))
+	)
+	l.now = clock.now
+
+	return l, clock
+}
+
+func TestRRLHandler(t *testing.T) {
+	var (
+		l, clock = newTestRateLimiter(2, false)
+		h        = rrlHandler(l, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			res := &dns.Msg{}
+			res.SetReply(req)
+			w.WriteMsg(res)
+		}))
+		name  = "http.api.prod.harpoon.tt.test.glimpse.io."
+		a     = &net.UDPAddr{IP: net.ParseIP("10.0.0.1")}
+		b     = &net.UDPAddr{IP: net.ParseIP("10.0.0.2")}
+		other = &net.UDPAddr{IP: net.ParseIP("10.0.1.1")}
+	)
+
+	// Both clients share the /24 bucket.
+	for _, addr := range []net.Addr{a, b} {
+		if r := rrlQuery(h, addr, name); r == nil || r.Truncated {
+			t.Fatalf("want answer within rate, got %v", r)
+		}
+	}
+
+	if r := rrlQuery(h, a, name); r != nil {
+		t.Errorf("want first limited response dropped, got %v", r)
+	}
+	if r := rrlQuery(h, a, name); r == nil || !r.Truncated || len(r.Answer) != 0 {
+		t.Errorf("want second limited response to slip, got %v", r)
+	}
+
+	if r := rrlQuery(h, other, name); r == nil || r.Truncated {
+		t.Errorf("want other network unaffected, got %v", r)
+	}
+	if r := rrlQuery(h, a, "other."+name); r == nil || r.Truncated {
+		t.Errorf("want other name unaffected, got %v", r)
+	}
+	if r := rrlQuery(h, &net.TCPAddr{IP: a.IP}, name); r == nil || r.Truncated {
+		t.Errorf("want TCP unaffected, got %v", r)
+	}
+
+	clock.add(time.Second)
+	if r := rrlQuery(h, a, name); r == nil || r.Truncated {
+		t.Errorf("want answer after refill, got %v", r)
+	}
+}
+
+func TestRRLHandlerNXDomain(t *testing.T) {
+	var (
+		l, _ = newTestRateLimiter(0, false)
+		h    = rrlHandler(l, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			res := &dns.Msg{}
+			res.SetRcode(req, dns.RcodeNameError)
+			w.WriteMsg(res)
+		}))
+		addr = &net.UDPAddr{IP: net.ParseIP("10.0.0.1")}
+	)
+
+	if r := rrlQuery(h, addr, "a.glimpse.io."); r == nil {
+		t.Fatal("want NXDOMAIN answered within rate")
+	}
+	if r := rrlQuery(h, addr, "a.glimpse.io."); r != nil {
+		t.Errorf("want NXDOMAIN limited to nxdomain rate, got %v", r)
+	}
+
+	for i := 0; i < nxTopNames+2; i++ {
+		for j := 0; j <= i; j++ {
+			rrlQuery(h, addr, fmt.Sprintf("n%02d.glimpse.io.", i))
+		}
+	}
+
+	top := l.topNX()
+	if len(top) != nxTopNames {
+		t.Fatalf("want %d names, got %d", nxTopNames, len(top))
+	}
+	if want, got := (nxName{name: "n11.glimpse.io.", count: 12}), top[0]; want != got {
+		t.Errorf("want top name %v, got %v", want, got)
+	}
+	if got := l.topNX(); len(got) != 0 {
+		t.Errorf("want new interval without names, got %v", got)
+	}
+}
+
+func TestRRLHandlerCase(t *testing.T) {
+	var (
+		l, _ = newTestRateLimiter(0, false)
+		h    = rrlHandler(l, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			res := &dns.Msg{}
+			res.SetRcode(req, dns.RcodeNameError)
+			w.WriteMsg(res)
+		}))
+		addr = &net.UDPAddr{IP: net.ParseIP("10.0.0.1")}
+	)
+
+	if r := rrlQuery(h, addr, "a.glimpse.io."); r == nil {
+		t.Fatal("want NXDOMAIN answered within rate")
+	}
+	if r := rrlQuery(h, addr, "A.gLiMpSe.Io."); r != nil {
+		t.Errorf("want name in other case limited, got %v", r)
+	}
+
+	top := l.topNX()
+	if len(top) != 1 {
+		t.Fatalf("want 1 name, got %v", top)
+	}
+	if want, got := (nxName{name: "a.glimpse.io.", count: 2}), top[0]; want != got {
+		t.Errorf("want top name %v, got %v", want, got)
+	}
+}
+
+func TestRRLHandlerLogOnly(t *testing.T) {
+	var (
+		l, _ = newTestRateLimiter(2, true)
+		h    = rrlHandler(l, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			res := &dns.Msg{}
+			res.SetReply(req)
+			w.WriteMsg(res)
+		}))
+		addr = &net.UDPAddr{IP: net.ParseIP("10.0.0.1")}
+	)
+
+	for i := 0; i < 10; i++ {
+		if r := rrlQuery(h, addr, "a.glimpse.io."); r == nil || r.Truncated {
+			t.Fatalf("want all responses in log-only mode, got %v", r)
+		}
+	}
+}
+
+func TestClientPrefix(t *testing.T) {
+	var (
+		addrs = []net.Addr{
+			&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 53},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8:1:2ff::1")},
+		}
+		want = []string{"10.1.2.0/24", "2001:db8:1:200::/56"}
+		got  = []string{}
+	)
+
+	for _, addr := range addrs {
+		got = append(got, clientPrefix(addr))
+	}
+
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// shedLatencyWeight is the weight of a single query in the moving average
+	// of the query latency.
+	shedLatencyWeight = 0.1
+
+	// shedDecrease is the fraction the adaptive limit is lowered by per query
+	// answered slower than the target latency.
+	shedDecrease = 0.01
+)
+
+// Reasons for shedding a query.
+const (
+	shedGlobal = "global"
+	shedClient = "client"
+)
+
+// shedder limits the number of queries in flight, globally and per client
+// address. With a target latency set, the global limit adapts to the
+// observed latency: it shrinks while queries are slower than the target and
+// grows back additively up to max otherwise.
+type shedder struct {
+	max       int
+	perClient int
+	target    time.Duration
+
+	mu       sync.Mutex
+	inflight int
+	clients  map[string]int
+	limit    float64
+	latency  float64
+}
+
+func newShedder(max, perClient int, target time.Duration) *shedder {
+	dnsShedLimit.Set(float64(max))
+
+	return &shedder{
+		max:       max,
+		perClient: perClient,
+		target:    target,
+		clients:   map[string]int{},
+		limit:     float64(max),
+	}
+}
+
+// acquire admits a query of client, unless a limit is reached in which case
+// the reason is returned. Admitted queries must be released.
+func (s *shedder) acquire(client string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.max > 0 && s.inflight >= int(s.limit) {
+		return shedGlobal, false
+	}
+	if s.perClient > 0 && s.clients[client] >= s.perClient {
+		return shedClient, false
+	}
+
+	s.inflight++
+	s.clients[client]++
+	dnsInflight.Inc()
+
+	return "", true
+}
+
+// release finishes a query of client which took d.
+func (s *shedder) release(client string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inflight--
+	if s.clients[client]--; s.clients[client] <= 0 {
+		delete(s.clients, client)
+	}
+	dnsInflight.Dec()
+
+	if s.target <= 0 || s.max <= 0 {
+		return
+	}
+
+	if s.latency == 0 {
+		s.latency = d.Seconds()
+	} else {
+		s.latency += shedLatencyWeight * (d.Seconds() - s.latency)
+	}
+
+	if s.latency > s.target.Seconds() {
+		s.limit = math.Max(s.limit*(1-shedDecrease), 1)
+	} else {
+		s.limit = math.Min(s.limit+1/s.limit, float64(s.max))
+	}
+	dnsShedLimit.Set(math.Floor(s.limit))
+}
+
+// shedRecorder is implemented by writers which record shed queries.
+type shedRecorder interface {
+	shed(reason string)
+}
+
+// sheddingHandler answers queries exceeding the limits of s with REFUSED, or
+// drops them without answer if drop is set.
+func sheddingHandler(s *shedder, drop bool, next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		client := clientIP(w.RemoteAddr())
+
+		reason, ok := s.acquire(client)
+		if !ok {
+			if r, ok := w.(shedRecorder); ok {
+				r.shed(reason)
+			}
+			if drop {
+				return
+			}
+
+			res := &dns.Msg{}
+			res.SetRcode(req, dns.RcodeRefused)
+			w.WriteMsg(res)
+			return
+		}
+
+		start := time.Now()
+		next.ServeDNS(w, req)
+		s.release(client, time.Since(start))
+	})
+}
+
+// clientIP returns the IP of a client address without the port.
+func clientIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	case encryptedAddr:
+		return a.IP.String()
+	case nil:
+		return ""
+	default:
+		host, _, err := net.SplitHostPort(a.String())
+		if err != nil {
+			return a.String()
+		}
+		return host
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSheddingHandler(t *testing.T) {
+	var (
+		release = make(chan struct{})
+		started = make(chan struct{})
+		blocked = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			started <- struct{}{}
+			<-release
+
+			res := &dns.Msg{}
+			res.SetReply(req)
+			w.WriteMsg(res)
+		})
+		a  = &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+		b  = &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1234}
+		c  = &net.UDPAddr{IP: net.ParseIP("10.0.0.3"), Port: 1234}
+		h  = sheddingHandler(newShedder(2, 1, 0), false, blocked)
+		wg sync.WaitGroup
+	)
+
+	query := func(addr net.Addr) *dns.Msg {
+		var (
+			w = &testWriter{remoteAddr: addr}
+			m = &dns.Msg{}
+		)
+		m.SetQuestion("http.api.prod.harpoon.tt.test.glimpse.io.", dns.TypeA)
+		h.ServeDNS(w, m)
+
+		return w.msg
+	}
+
+	wg.Add(1)
+	go func() { defer wg.Done(); query(a) }()
+	<-started
+
+	// Same client address on another port.
+	r := query(&net.UDPAddr{IP: a.IP, Port: 4321})
+	if r == nil || r.Rcode != dns.RcodeRefused {
+		t.Errorf("want per client limit to refuse query, got %v", r)
+	}
+
+	wg.Add(1)
+	go func() { defer wg.Done(); query(b) }()
+	<-started
+
+	r = query(c)
+	if r == nil || r.Rcode != dns.RcodeRefused {
+		t.Errorf("want global limit to refuse query, got %v", r)
+	}
+
+	close(release)
+	wg.Wait()
+
+	go func() { <-started }()
+	if r := query(c); r == nil || r.Rcode != dns.RcodeSuccess {
+		t.Errorf("want query answered after release, got %v", r)
+	}
+}
+
+func TestSheddingHandlerDrop(t *testing.T) {
+	var (
+		s = newShedder(1, 0, 0)
+		h = sheddingHandler(s, true, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			t.Fatal("want query shed")
+		}))
+		w = &cachingWriter{ResponseWriter: &testWriter{remoteAddr: &net.UDPAddr{}}}
+		m = &dns.Msg{}
+	)
+
+	if _, ok := s.acquire("10.0.0.1"); !ok {
+		t.Fatal("want first query admitted")
+	}
+
+	m.SetQuestion("http.api.prod.harpoon.tt.test.glimpse.io.", dns.TypeA)
+	h.ServeDNS(w, m)
+
+	if w.last != nil {
+		t.Errorf("want dropped query without answer, got %v", w.last)
+	}
+	if want, got := shedGlobal, w.shedReason; want != got {
+		t.Errorf("want shed reason %s, got %s", want, got)
+	}
+}
+
+func TestQueryHandlerShed(t *testing.T) {
+	var (
+		logger = log.New(ioutil.Discard, "", 0)
+		s      = newShedder(1, 0, 0)
+		h      = queryHandler(
+			logger,
+			newRateLimiter(100, 100, 2, false, logger),
+			s,
+			false,
+			dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+				t.Fatal("want query shed")
+			}),
+		)
+		w    = &testWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.0.0.1")}}
+		m    = &dns.Msg{}
+		shed = dnsShed.WithLabelValues("udp", shedGlobal)
+	)
+
+	if _, ok := s.acquire("10.0.0.1"); !ok {
+		t.Fatal("want first query admitted")
+	}
+	before := counterValue(t, shed)
+
+	m.SetQuestion("http.api.prod.harpoon.tt.test.glimpse.io.", dns.TypeA)
+	h.ServeDNS(w, m)
+
+	if w.msg == nil || w.msg.Rcode != dns.RcodeRefused {
+		t.Errorf("want shed query refused, got %v", w.msg)
+	}
+	if want, got := before+1, counterValue(t, shed); want != got {
+		t.Errorf("want %v shed queries, got %v", want, got)
+	}
+}
+
+func TestShedderAdaptiveLimit(t *testing.T) {
+	s := newShedder(100, 0, 10*time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		s.acquire("10.0.0.1")
+		s.release("10.0.0.1", 50*time.Millisecond)
+	}
+	if s.limit >= 50 {
+		t.Errorf("want limit to shrink with slow queries, got %f", s.limit)
+	}
+	shrunk := s.limit
+
+	for i := 0; i < 1000; i++ {
+		s.acquire("10.0.0.1")
+		s.release("10.0.0.1", time.Millisecond)
+	}
+	if s.limit <= shrunk {
+		t.Errorf("want limit to grow with fast queries, got %f", s.limit)
+	}
+	if s.limit > 100 {
+		t.Errorf("want limit bounded by max, got %f", s.limit)
+	}
+	if len(s.clients) != 0 || s.inflight != 0 {
+		t.Errorf("want no queries in flight, got %d", s.inflight)
+	}
+}
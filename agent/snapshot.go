@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// snapshotStore keeps the last successful results of the next store and
+// serves them, marked stale, while the next store fails with errConsulAPI or
+// errCircuitOpen. The snapshot is written to disk periodically and loaded on
+// startup, so the agent can answer even when it is restarted during an outage.
+type snapshotStore struct {
+	next   store
+	path   string
+	maxAge time.Duration
+	logger *log.Logger
+
+	mu      sync.Mutex
+	now     func() time.Time
+	entries map[string]snapshotEntry
+	dirty   bool
+}
+
+type snapshotEntry struct {
+	is      instances
+	updated time.Time
+}
+
+// snapshotFileEntry is the on-disk form of a snapshotEntry.
+type snapshotFileEntry struct {
+	Instances []snapshotInstance `json:"instances"`
+	Updated   time.Time          `json:"updated"`
+}
+
+type snapshotInstance struct {
+	instanceJSON
+	Addrs map[string]string `json:"addrs,omitempty"`
+}
+
+func newSnapshotStore(
+	next store,
+	path string,
+	maxAge time.Duration,
+	logger *log.Logger,
+) *snapshotStore {
+	return &snapshotStore{
+		next:    next,
+		path:    path,
+		maxAge:  maxAge,
+		logger:  logger,
+		now:     time.Now,
+		entries: map[string]snapshotEntry{},
+	}
+}
+
+func (s *snapshotStore) getInstances(ctx context.Context, i info) (instances, error) {
+	key := fmt.Sprintf("getInstances %s", i.addr())
+	is, err := s.next.getInstances(ctx, i)
+	return s.result("getInstances", key, is, err)
+}
+
+func (s *snapshotStore) getInstancesByHealth(ctx context.Context, i info, h health) (instances, error) {
+	key := fmt.Sprintf("getInstancesByHealth %s %s", i.addr(), h)
+	is, err := s.next.getInstancesByHealth(ctx, i, h)
+	return s.result("getInstancesByHealth", key, is, err)
+}
+
+func (s *snapshotStore) getServers(ctx context.Context, zone string) (instances, error) {
+	key := fmt.Sprintf("getServers %s", zone)
+	is, err := s.next.getServers(ctx, zone)
+	return s.result("getServers", key, is, err)
+}
+
+// result records successful results and replaces unavailability errors with
+// the last-known-good result if it isn't older than maxAge.
+func (s *snapshotStore) result(
+	op, key string,
+	is instances,
+	err error,
+) (instances, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case err == nil:
+		s.entries[key] = snapshotEntry{is: copyInstances(is), updated: s.now()}
+		s.dirty = true
+		return is, nil
+	case isNoInstances(err):
+		// The store is authoritative about the absence of instances.
+		if _, ok := s.entries[key]; ok {
+			delete(s.entries, key)
+			s.dirty = true
+		}
+		return is, err
+	case !isConsulAPI(err) && !isCircuitOpen(err):
+		return is, err
+	}
+
+	e, ok := s.entries[key]
+	if !ok || s.now().Sub(e.updated) > s.maxAge {
+		return is, err
+	}
+
+	snapshotAnswers.WithLabelValues(op).Inc()
+	s.logger.Printf(
+		"STORE serving stale %s from %s: %s",
+		key,
+		e.updated.Format(time.RFC3339),
+		err,
+	)
+
+	stale := make(instances, 0, len(e.is))
+	for _, i := range e.is {
+		i.stale = true
+		stale = append(stale, i)
+	}
+
+	return stale, nil
+}
+
+// load reads the snapshot from disk. A missing file is not an error.
+func (s *snapshotStore) load() error {
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	fes := map[string]snapshotFileEntry{}
+	if err := json.Unmarshal(b, &fes); err != nil {
+		return fmt.Errorf("invalid snapshot %s: %s", s.path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, fe := range fes {
+		is := make(instances, 0, len(fe.Instances))
+		for _, i := range fe.Instances {
+			ip := net.ParseIP(i.IP)
+			if ip == nil {
+				return fmt.Errorf("invalid snapshot %s: invalid IP %q", s.path, i.IP)
+			}
+
+			in := instance{
+				host:   i.Host,
+				ip:     ip,
+				port:   i.Port,
+				status: i.Status,
+			}
+			for view, addr := range i.Addrs {
+				ip := net.ParseIP(addr)
+				if ip == nil {
+					return fmt.Errorf("invalid snapshot %s: invalid IP %q", s.path, addr)
+				}
+
+				if in.addrs == nil {
+					in.addrs = map[string]net.IP{}
+				}
+				in.addrs[view] = ip
+			}
+
+			is = append(is, in)
+		}
+
+		s.entries[key] = snapshotEntry{is: is, updated: fe.Updated}
+	}
+	snapshotEntries.Set(float64(len(s.entries)))
+
+	return nil
+}
+
+// flush drops entries older than maxAge and writes the snapshot to disk if
+// it changed since the last flush.
+func (s *snapshotStore) flush() error {
+	s.mu.Lock()
+
+	now := s.now()
+	for key, e := range s.entries {
+		if now.Sub(e.updated) > s.maxAge {
+			delete(s.entries, key)
+			s.dirty = true
+		}
+	}
+	snapshotEntries.Set(float64(len(s.entries)))
+
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+
+	fes := make(map[string]snapshotFileEntry, len(s.entries))
+	for key, e := range s.entries {
+		is := make([]snapshotInstance, 0, len(e.is))
+		for _, i := range e.is {
+			si := snapshotInstance{
+				instanceJSON: instanceJSON{
+					Host:   i.host,
+					IP:     i.ip.String(),
+					Port:   i.port,
+					Status: i.status,
+				},
+			}
+			for view, ip := range i.addrs {
+				if si.Addrs == nil {
+					si.Addrs = map[string]string{}
+				}
+				si.Addrs[view] = ip.String()
+			}
+
+			is = append(is, si)
+		}
+
+		fes[key] = snapshotFileEntry{Instances: is, Updated: e.updated}
+	}
+	s.dirty = false
+	s.mu.Unlock()
+
+	b, err := json.Marshal(fes)
+	if err == nil {
+		err = writeSnapshot(s.path, b)
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+
+		snapshotWrites.WithLabelValues("error").Inc()
+		return err
+	}
+
+	snapshotWrites.WithLabelValues("success").Inc()
+	return nil
+}
+
+// run flushes the snapshot every interval.
+func (s *snapshotStore) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.flush(); err != nil {
+			s.logger.Printf("[warning] writing snapshot failed: %s", err)
+		}
+	}
+}
+
+// writeSnapshot atomically replaces the file at path.
+func writeSnapshot(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// outageStore answers from the broken store while down is set.
+type outageStore struct {
+	up   store
+	down bool
+}
+
+func (s *outageStore) current() store {
+	if s.down {
+		return &brokenStore{}
+	}
+	return s.up
+}
+
+func (s *outageStore) getInstances(ctx context.Context, i info) (instances, error) {
+	return s.current().getInstances(context.Background(), i)
+}
+
+func (s *outageStore) getInstancesByHealth(ctx context.Context, i info, h health) (instances, error) {
+	return s.current().getInstancesByHealth(context.Background(), i, h)
+}
+
+func (s *outageStore) getServers(ctx context.Context, zone string) (instances, error) {
+	return s.current().getServers(context.Background(), zone)
+}
+
+func newTestSnapshotStore(t *testing.T, next store) (*snapshotStore, *testClock, func()) {
+	dir, err := ioutil.TempDir("", "glimpse-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		clock = newTestClock()
+		s     = newSnapshotStore(
+			next,
+			filepath.Join(dir, "snapshot.json"),
+			time.Hour,
+			log.New(ioutil.Discard, "", 0),
+		)
+	)
+	s.now = clock.now
+
+	return s, clock, func() { os.RemoveAll(dir) }
+}
+
+func TestSnapshotStore(t *testing.T) {
+	var (
+		srv  = info{env: "prod", job: "web", product: "harpoon", service: "http", zone: "gg"}
+		want = instances{
+			{host: "host1", ip: net.ParseIP("10.2.3.4"), port: 8080, status: checkPassing},
+		}
+		next = &outageStore{
+			up: &testStore{
+				instances: map[info]instances{srv: want},
+				servers:   map[string]instances{"gg": want},
+			},
+		}
+		s, clock, cleanup = newTestSnapshotStore(t, next)
+	)
+	defer cleanup()
+
+	if _, err := s.getInstances(context.Background(), srv); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.getServers(context.Background(), "gg"); err != nil {
+		t.Fatal(err)
+	}
+
+	next.down = true
+
+	got, err := s.getInstances(context.Background(), srv)
+	if err != nil {
+		t.Fatalf("want stale instances, got %s", err)
+	}
+	if len(got) != 1 || !got[0].stale {
+		t.Fatalf("want 1 stale instance, got %v", got)
+	}
+	if got, want := got[0].ip.String(), "10.2.3.4"; got != want {
+		t.Errorf("want ip %s, got %s", want, got)
+	}
+
+	if got, err := s.getServers(context.Background(), "gg"); err != nil || !got[0].stale {
+		t.Errorf("want stale servers, got %v, %v", got, err)
+	}
+
+	// Queries never answered before fail as usual.
+	_, err = s.getInstancesByHealth(context.Background(), srv, healthAny)
+	if !isConsulAPI(err) {
+		t.Errorf("want consul API error, got %v", err)
+	}
+
+	clock.add(time.Hour + time.Second)
+
+	_, err = s.getInstances(context.Background(), srv)
+	if !isConsulAPI(err) {
+		t.Errorf("want consul API error after max age, got %v", err)
+	}
+
+	// Recorded results must not be marked stale.
+	next.down = false
+	got, err = s.getInstances(context.Background(), srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestSnapshotStoreNoInstances(t *testing.T) {
+	var (
+		srv           = info{env: "prod", job: "web", product: "harpoon", service: "http", zone: "gg"}
+		up            = &testStore{instances: map[info]instances{srv: generateInstancesFromInfo(srv)}}
+		next          = &outageStore{up: up}
+		s, _, cleanup = newTestSnapshotStore(t, next)
+	)
+	defer cleanup()
+
+	if _, err := s.getInstances(context.Background(), srv); err != nil {
+		t.Fatal(err)
+	}
+
+	delete(up.instances, srv)
+	if _, err := s.getInstances(context.Background(), srv); !isNoInstances(err) {
+		t.Fatalf("want no instances error, got %v", err)
+	}
+
+	next.down = true
+	if _, err := s.getInstances(context.Background(), srv); !isConsulAPI(err) {
+		t.Errorf("want consul API error, got %v", err)
+	}
+}
+
+func TestSnapshotStorePersistence(t *testing.T) {
+	var (
+		srv  = info{env: "prod", job: "web", product: "harpoon", service: "http", zone: "gg"}
+		want = instances{
+			{host: "host1", ip: net.ParseIP("10.2.3.4"), port: 8080, status: checkWarning},
+			{
+				host:   "host2",
+				ip:     net.ParseIP("10.2.3.5"),
+				port:   8081,
+				status: checkPassing,
+				addrs:  map[string]net.IP{"edge": net.ParseIP("192.0.2.1")},
+			},
+		}
+		next = &outageStore{
+			up: &testStore{instances: map[info]instances{srv: want}},
+		}
+		s, clock, cleanup = newTestSnapshotStore(t, next)
+	)
+	defer cleanup()
+
+	if _, err := s.getInstancesByHealth(context.Background(), srv, healthAny); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newSnapshotStore(&brokenStore{}, s.path, time.Hour, s.logger)
+	restarted.now = clock.now
+	if err := restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := restarted.getInstancesByHealth(context.Background(), srv, healthAny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("want %d instances, got %d", len(want), len(got))
+	}
+	for i := range want {
+		w := want[i]
+		w.stale = true
+		if !reflect.DeepEqual(w, got[i]) {
+			t.Errorf("want %v, got %v", w, got[i])
+		}
+	}
+
+	// Entries exceeding the max age are dropped on flush.
+	clock.add(2 * time.Hour)
+	if err := restarted.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	empty := newSnapshotStore(&brokenStore{}, s.path, time.Hour, s.logger)
+	if err := empty.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(empty.entries); got != 0 {
+		t.Errorf("want no entries, got %d", got)
+	}
+}
+
+func TestSnapshotStoreLoadMissing(t *testing.T) {
+	s, _, cleanup := newTestSnapshotStore(t, &brokenStore{})
+	defer cleanup()
+
+	if err := s.load(); err != nil {
+		t.Errorf("want no error for missing snapshot, got %s", err)
+	}
+}
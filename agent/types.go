@@ -1,24 +1,32 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"regexp"
 	"strings"
+	"time"
 )
 
 var (
+	errCircuitOpen = errors.New("circuit open")
 	errConsulAPI   = errors.New("Consul API failed")
 	errInvalidIP   = errors.New("invalid IP address")
 	errNoInstances = errors.New("no instances")
 	errUntracked   = errors.New("untracked error")
 
+	errPermissionDenied = errors.New("Consul permission denied")
+
 	errLabels = map[error]string{
+		errCircuitOpen: "circuitopen",
 		errConsulAPI:   "consulapi",
 		errInvalidIP:   "invalidip",
 		errNoInstances: "noinstances",
 		errUntracked:   "untracked",
+
+		errPermissionDenied: "permissiondenied",
 	}
 
 	rField = regexp.MustCompile(`^[[:alnum:]\-]+$`)
@@ -26,14 +34,62 @@ var (
 )
 
 type store interface {
-	getInstances(info) (instances, error)
-	getServers(string) (instances, error)
+	getInstances(context.Context, info) (instances, error)
+	getInstancesByHealth(context.Context, info, health) (instances, error)
+	getServers(context.Context, string) (instances, error)
+}
+
+// withBudget returns a context cancelled after budget. Zero means no
+// deadline.
+func withBudget(ctx context.Context, budget time.Duration) (context.Context, context.CancelFunc) {
+	if budget <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, budget)
+}
+
+// health selects the subset of instances by the state of their checks.
+type health string
+
+const (
+	healthPassing health = "passing"
+	healthWarning health = "warning"
+	healthAny     health = "any"
+)
+
+func parseHealth(s string) (health, error) {
+	switch h := health(s); h {
+	case healthPassing, healthWarning, healthAny:
+		return h, nil
+	case "":
+		return healthPassing, nil
+	default:
+		return "", fmt.Errorf("health %q is invalid", s)
+	}
 }
 
 type instance struct {
 	host string
 	ip   net.IP
 	port uint16
+
+	// status is the aggregated state of all checks of the instance. It is
+	// empty if the store doesn't track health.
+	status string
+
+	// stale marks instances served from the last-known-good snapshot while
+	// the store is unavailable.
+	stale bool
+
+	// addrs are the addresses of the instance in views other than the
+	// default one.
+	addrs map[string]net.IP
+}
+
+// degraded reports if the instance has failing checks.
+func (i instance) degraded() bool {
+	return i.status == checkWarning || i.status == checkCritical
 }
 
 type instances []instance
@@ -122,6 +178,10 @@ func (e glimpseError) Error() string {
 	return fmt.Sprintf("%s: %s", e.err, e.msg)
 }
 
+func isCircuitOpen(err error) bool {
+	return unwrapError(err) == errCircuitOpen
+}
+
 func isConsulAPI(err error) bool {
 	return unwrapError(err) == errConsulAPI
 }
@@ -134,6 +194,10 @@ func isNoInstances(err error) bool {
 	return unwrapError(err) == errNoInstances
 }
 
+func isPermissionDenied(err error) bool {
+	return unwrapError(err) == errPermissionDenied
+}
+
 func unwrapError(err error) error {
 	switch e := err.(type) {
 	case glimpseError:
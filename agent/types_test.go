@@ -48,3 +48,25 @@ func TestInfoFromAddrInvalid(t *testing.T) {
 		}
 	}
 }
+
+func TestParseHealth(t *testing.T) {
+	for input, want := range map[string]health{
+		"":        healthPassing,
+		"passing": healthPassing,
+		"warning": healthWarning,
+		"any":     healthAny,
+	} {
+		got, err := parseHealth(input)
+		if err != nil {
+			t.Errorf("parse of %q failed: %s", input, err)
+			continue
+		}
+		if want != got {
+			t.Errorf("want %s, got %s", want, got)
+		}
+	}
+
+	if _, err := parseHealth("critical"); err == nil {
+		t.Error("want parse of unknown health to fail")
+	}
+}
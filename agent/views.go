@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/hashicorp/hcl"
+)
+
+// view is a split-horizon view of the topology for clients from networks.
+// Instances are answered with their address for the view, set with the
+// glimpse:addr.<view>=<ip> tag, and only the listed zones are visible. Empty
+// zones make all zones visible.
+type view struct {
+	Name     string   `hcl:"name"`
+	Networks []string `hcl:"networks"`
+	Zones    []string `hcl:"zones"`
+
+	nets []*net.IPNet
+}
+
+// viewsConfig is the views configuration, e.g.:
+//
+//	view {
+//	  name     = "edge"
+//	  networks = ["192.0.2.0/24"]
+//	  zones    = ["gg"]
+//	}
+//
+// Clients are served by the first view matching their network, all others by
+// the default view returning the Consul addresses of all zones.
+type viewsConfig struct {
+	Views []view `hcl:"view"`
+}
+
+func parseViews(in string) ([]view, error) {
+	c := &viewsConfig{}
+	if err := hcl.Decode(c, in); err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for i := range c.Views {
+		v := &c.Views[i]
+
+		if !rField.MatchString(v.Name) {
+			return nil, fmt.Errorf("view %d: name %q is invalid", i, v.Name)
+		}
+		if names[v.Name] {
+			return nil, fmt.Errorf("view %s defined twice", v.Name)
+		}
+		names[v.Name] = true
+
+		nets, err := parseNetworks(v.Networks)
+		if err != nil {
+			return nil, fmt.Errorf("view %s: %s", v.Name, err)
+		}
+		v.nets = nets
+	}
+
+	return c.Views, nil
+}
+
+// visible reports whether the zone is visible in the view. All zones are
+// visible in the default view, represented by nil.
+func (v *view) visible(zone string) bool {
+	if v == nil || len(v.Zones) == 0 {
+		return true
+	}
+
+	for _, z := range v.Zones {
+		if z == zone {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apply returns the instances with their address for the view.
+func (v *view) apply(is instances) instances {
+	if v == nil {
+		return is
+	}
+
+	res := make(instances, 0, len(is))
+	for _, i := range is {
+		if ip, ok := i.addrs[v.Name]; ok {
+			i.ip = ip
+		}
+		res = append(res, i)
+	}
+
+	return res
+}
+
+// views selects the view of clients from the configuration at path, which
+// can be reloaded at runtime. A nil views serves everyone the default view.
+type views struct {
+	path string
+
+	mu    sync.RWMutex
+	views []view
+}
+
+func newViews(path string) (*views, error) {
+	v := &views{path: path}
+	if err := v.load(); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// load replaces the views with the ones read from path. The current views
+// stay in place if the file is invalid.
+func (v *views) load() error {
+	b, err := ioutil.ReadFile(v.path)
+	if err != nil {
+		return err
+	}
+
+	vs, err := parseViews(string(b))
+	if err != nil {
+		return fmt.Errorf("invalid views %s: %s", v.path, err)
+	}
+
+	v.mu.Lock()
+	v.views = vs
+	v.mu.Unlock()
+
+	return nil
+}
+
+// lookup returns the view of the client at ip, nil for the default view.
+func (v *views) lookup(ip net.IP) *view {
+	if v == nil {
+		return nil
+	}
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	for i := range v.views {
+		if networksContain(v.views[i].nets, ip) {
+			return &v.views[i]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testViews = `
+view {
+  name     = "edge"
+  networks = ["192.0.2.0/24"]
+  zones    = ["gg"]
+}
+
+view {
+  name     = "office"
+  networks = ["172.16.0.0/12"]
+}
+`
+
+func TestParseViews(t *testing.T) {
+	vs, err := parseViews(testViews)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(vs); want != got {
+		t.Fatalf("want %d views, got %d", want, got)
+	}
+
+	for _, in := range []string{
+		`view { name = "edge" }`,
+		`view { name = "ed ge" networks = ["10.0.0.0/8"] }`,
+		`view { name = "edge" networks = ["10.0.0.0/8"] }
+		 view { name = "edge" networks = ["10.0.0.0/8"] }`,
+	} {
+		if _, err := parseViews(in); err == nil {
+			t.Errorf("want error for %s", in)
+		}
+	}
+}
+
+func TestViews(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glimpse-views")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "views.hcl")
+	if err := ioutil.WriteFile(path, []byte(testViews), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	vs, err := newViews(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edge := vs.lookup(net.ParseIP("192.0.2.10"))
+	if edge == nil || edge.Name != "edge" {
+		t.Fatalf("want edge view, got %v", edge)
+	}
+	if !edge.visible("gg") || edge.visible("tt") {
+		t.Errorf("want only zone gg visible in edge view")
+	}
+
+	office := vs.lookup(net.ParseIP("172.17.0.1"))
+	if office == nil || !office.visible("tt") {
+		t.Errorf("want all zones visible in office view, got %v", office)
+	}
+
+	var def *view = vs.lookup(net.ParseIP("10.0.0.1"))
+	if def != nil || !def.visible("tt") {
+		t.Errorf("want default view with all zones, got %v", def)
+	}
+
+	var (
+		is = instances{
+			{host: "host1", ip: net.ParseIP("10.0.0.1"), addrs: map[string]net.IP{"edge": net.ParseIP("192.0.2.1")}},
+			{host: "host2", ip: net.ParseIP("10.0.0.2")},
+		}
+		got = edge.apply(is)
+	)
+	if want := "192.0.2.1"; got[0].ip.String() != want {
+		t.Errorf("want edge address %s, got %s", want, got[0].ip)
+	}
+	if want := "10.0.0.2"; got[1].ip.String() != want {
+		t.Errorf("want default address %s, got %s", want, got[1].ip)
+	}
+	if want := "10.0.0.1"; is[0].ip.String() != want {
+		t.Errorf("want instances unmodified, got %s", is[0].ip)
+	}
+	if got := def.apply(is); got[0].ip.String() != "10.0.0.1" {
+		t.Errorf("want default address in default view, got %s", got[0].ip)
+	}
+}
+
+func TestViewsHandlers(t *testing.T) {
+	vs, err := parseViews(testViews)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		views = &views{views: vs}
+		gg    = info{service: "http", job: "api", env: "prod", product: "harpoon", zone: "gg"}
+		tt    = info{service: "http", job: "api", env: "prod", product: "harpoon", zone: "tt"}
+		store = &testStore{instances: map[info]instances{
+			gg: {{host: "host1", ip: net.ParseIP("10.0.0.1"), port: 8000, addrs: map[string]net.IP{"edge": net.ParseIP("192.0.2.1")}}},
+			tt: {{host: "host2", ip: net.ParseIP("10.0.0.2"), port: 8000}},
+		}}
+		h    = newDNSHandler(store, dns.Fqdn("test.glimpse.io"), false, 0, nil, views)
+		edge = &net.UDPAddr{IP: net.ParseIP("192.0.2.10")}
+	)
+
+	query := func(name string) *dns.Msg {
+		var (
+			w = &testWriter{remoteAddr: edge}
+			m = &dns.Msg{}
+		)
+		m.SetQuestion(name+".test.glimpse.io.", dns.TypeA)
+		h.ServeDNS(w, m)
+
+		return w.msg
+	}
+
+	r := query(gg.addr())
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("want edge address, got %v", r.Answer)
+	}
+
+	if r := query(tt.addr()); r.Rcode != dns.RcodeNameError {
+		t.Errorf("want invisible zone to be NXDOMAIN, got %s", dns.RcodeToString[r.Rcode])
+	}
+	if r := query("tt"); r.Rcode != dns.RcodeNameError {
+		t.Errorf("want servers of invisible zone to be NXDOMAIN, got %s", dns.RcodeToString[r.Rcode])
+	}
+
+	var (
+		handler = instancesHandler(store, 0, nil, views)
+		rec     = httptest.NewRecorder()
+		req     = httptest.NewRequest("GET", "/v1/instances/"+gg.addr(), nil)
+	)
+	req.RemoteAddr = "192.0.2.10:4321"
+	handler.ServeHTTP(rec, req)
+
+	res := []instanceJSON{}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].IP != "192.0.2.1" {
+		t.Errorf("want edge address, got %v", res)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/v1/instances/"+tt.addr(), nil)
+	req.RemoteAddr = "192.0.2.10:4321"
+	handler.ServeHTTP(rec, req)
+
+	if want, got := http.StatusNotFound, rec.Code; want != got {
+		t.Errorf("want status %d for invisible zone, got %d", want, got)
+	}
+}
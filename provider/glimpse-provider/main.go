@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/soundcloud/glimpse/provider"
+)
+
+func main() {
+	var (
+		name     = flag.String("provider", "", "provider name")
+		dir      = flag.String("consul.config-dir", "/etc/consul.d", "consul-agent configuration directory")
+		reload   = flag.String("consul.reload", provider.DefaultReloadCommand, "reload command")
+		debounce = flag.Duration("reload.debounce", provider.DefaultDebounce, "time to coalesce reloads")
+		file     = flag.String("services", "-", "JSON file with a list of services, - for stdin")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s -provider <name> [flags] [<addr>:<port> ...]\n\n", os.Args[0])
+		fmt.Fprint(os.Stderr, "Services are read from -services unless given as arguments.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *name == "" {
+		fmt.Fprint(os.Stderr, "flag must be provided: -provider\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	services, err := readServices(*file, flag.Args())
+	if err != nil {
+		log.Fatalf("reading services failed: %s", err)
+	}
+
+	w := provider.NewWriter(*dir)
+	w.Debounce = *debounce
+	w.Reload = provider.ReloadCommand(*reload)
+
+	changed, err := w.Update(*name, services)
+	if err != nil {
+		log.Fatalf("update of %s failed: %s", w.Path(*name), err)
+	}
+	if !changed {
+		log.Printf("%s unchanged", w.Path(*name))
+	}
+}
+
+func readServices(file string, args []string) ([]provider.Service, error) {
+	services := []provider.Service{}
+
+	if len(args) > 0 {
+		for _, arg := range args {
+			s, err := provider.ParseService(arg)
+			if err != nil {
+				return nil, err
+			}
+			services = append(services, s)
+		}
+
+		return services, nil
+	}
+
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if err := json.NewDecoder(r).Decode(&services); err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
@@ -0,0 +1,238 @@
+// Package provider renders and writes the Consul services configuration of a
+// glimpse provider.
+//
+// Every provider owns a single file in the consul-agent configuration
+// directory, representing the entire state known to it, scoped to the host.
+// Updates replace that file atomically and trigger a reload of the local
+// consul-agent.
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	rField = regexp.MustCompile(`^[[:alnum:]\-]+$`)
+	rZone  = regexp.MustCompile(`^[[:alnum:]]{2}$`)
+)
+
+// Service describes a single instance registered by a provider.
+type Service struct {
+	// Addr is the glimpse service address "service.job.env.product". A
+	// trailing zone is accepted and validated, but not part of the
+	// registration as the zone is implied by the consul datacenter.
+	Addr  string `json:"addr"`
+	Port  int    `json:"port"`
+	Check *Check `json:"check,omitempty"`
+
+	// Addrs are the addresses of the service in split-horizon views of the
+	// glimpse-agent, keyed by view name.
+	Addrs map[string]string `json:"addrs,omitempty"`
+}
+
+// Check is a Consul health check attached to a service.
+type Check struct {
+	Script   string `json:"script,omitempty"`
+	HTTP     string `json:"http,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	TTL      string `json:"ttl,omitempty"`
+}
+
+// Info is the parsed form of a glimpse service address.
+type Info struct {
+	Service string
+	Job     string
+	Env     string
+	Product string
+	Zone    string
+}
+
+// ParseAddr parses and validates a glimpse service address following the same
+// rules as the glimpse-agent.
+func ParseAddr(addr string) (Info, error) {
+	fields := strings.Split(addr, ".")
+
+	switch len(fields) {
+	case 4:
+	case 5:
+		if !rZone.MatchString(fields[4]) {
+			return Info{}, fmt.Errorf("zone %q is invalid", fields[4])
+		}
+	default:
+		return Info{}, fmt.Errorf("invalid service address: %s", addr)
+	}
+
+	i := Info{
+		Service: fields[0],
+		Job:     fields[1],
+		Env:     fields[2],
+		Product: fields[3],
+	}
+	if len(fields) == 5 {
+		i.Zone = fields[4]
+	}
+
+	if !rField.MatchString(i.Product) {
+		return Info{}, fmt.Errorf("product %q is invalid", i.Product)
+	}
+	if !rField.MatchString(i.Env) {
+		return Info{}, fmt.Errorf("env %q is invalid", i.Env)
+	}
+	if !rField.MatchString(i.Job) {
+		return Info{}, fmt.Errorf("job %q is invalid", i.Job)
+	}
+	if !rField.MatchString(i.Service) {
+		return Info{}, fmt.Errorf("service %q is invalid", i.Service)
+	}
+
+	return i, nil
+}
+
+// ParseService parses the short form "addr:port" of a service without check.
+func ParseService(s string) (Service, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return Service{}, fmt.Errorf("missing port in %q", s)
+	}
+
+	port, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return Service{}, fmt.Errorf("invalid port in %q", s)
+	}
+
+	return Service{Addr: s[:i], Port: port}, nil
+}
+
+// Tags returns the glimpse tags identifying the service address for the given
+// provider.
+func (i Info) Tags(provider string) []string {
+	return []string{
+		fmt.Sprintf("glimpse:env=%s", i.Env),
+		fmt.Sprintf("glimpse:job=%s", i.Job),
+		fmt.Sprintf("glimpse:product=%s", i.Product),
+		fmt.Sprintf("glimpse:provider=%s", provider),
+		fmt.Sprintf("glimpse:service=%s", i.Service),
+	}
+}
+
+type consulService struct {
+	ID    string   `json:"id"`
+	Name  string   `json:"name"`
+	Tags  []string `json:"tags"`
+	Port  int      `json:"port"`
+	Check *Check   `json:"check,omitempty"`
+}
+
+// Render validates the services of a provider and renders them as Consul
+// services configuration. The output is stable for the same set of services
+// regardless of their order.
+func Render(provider string, services []Service) ([]byte, error) {
+	if !rField.MatchString(provider) {
+		return nil, fmt.Errorf("provider %q is invalid", provider)
+	}
+
+	var (
+		cs    = make([]consulService, 0, len(services))
+		ports = map[int]string{}
+	)
+
+	for _, s := range services {
+		i, err := ParseAddr(s.Addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.Port <= 0 || s.Port > 65535 {
+			return nil, fmt.Errorf("port %d of %s is invalid", s.Port, s.Addr)
+		}
+		if addr, ok := ports[s.Port]; ok {
+			return nil, fmt.Errorf("port %d used by %s and %s", s.Port, addr, s.Addr)
+		}
+		ports[s.Port] = s.Addr
+
+		if err := s.Check.validate(); err != nil {
+			return nil, fmt.Errorf("check of %s: %s", s.Addr, err)
+		}
+
+		tags := i.Tags(provider)
+		views := make([]string, 0, len(s.Addrs))
+		for view := range s.Addrs {
+			views = append(views, view)
+		}
+		sort.Strings(views)
+
+		for _, view := range views {
+			if !rField.MatchString(view) {
+				return nil, fmt.Errorf("view %q of %s is invalid", view, s.Addr)
+			}
+			if net.ParseIP(s.Addrs[view]) == nil {
+				return nil, fmt.Errorf("address %q of %s is invalid", s.Addrs[view], s.Addr)
+			}
+
+			tags = append(tags, fmt.Sprintf("glimpse:addr.%s=%s", view, s.Addrs[view]))
+		}
+
+		cs = append(cs, consulService{
+			ID: fmt.Sprintf(
+				"%s-%s-%s-%s-%d",
+				i.Product,
+				i.Env,
+				i.Job,
+				i.Service,
+				s.Port,
+			),
+			Name:  i.Product,
+			Tags:  tags,
+			Port:  s.Port,
+			Check: s.Check,
+		})
+	}
+
+	sort.Sort(byID(cs))
+
+	b, err := json.MarshalIndent(&struct {
+		Services []consulService `json:"services"`
+	}{
+		Services: cs,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, '\n'), nil
+}
+
+func (c *Check) validate() error {
+	if c == nil {
+		return nil
+	}
+
+	switch {
+	case c.TTL != "":
+		if c.Script != "" || c.HTTP != "" {
+			return fmt.Errorf("ttl can't be combined with script or http")
+		}
+	case c.Script != "" && c.HTTP != "":
+		return fmt.Errorf("script and http are exclusive")
+	case c.Script != "" || c.HTTP != "":
+		if c.Interval == "" {
+			return fmt.Errorf("interval missing")
+		}
+	default:
+		return fmt.Errorf("one of script, http or ttl is required")
+	}
+
+	return nil
+}
+
+type byID []consulService
+
+func (cs byID) Len() int           { return len(cs) }
+func (cs byID) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
+func (cs byID) Less(i, j int) bool { return cs[i].ID < cs[j].ID }
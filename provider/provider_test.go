@@ -0,0 +1,166 @@
+package provider
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	tests := map[string]Info{
+		"http.ent.staging.asset-hosting": Info{
+			Service: "http",
+			Job:     "ent",
+			Env:     "staging",
+			Product: "asset-hosting",
+		},
+		"http.ent.staging.asset-hosting.ro": Info{
+			Service: "http",
+			Job:     "ent",
+			Env:     "staging",
+			Product: "asset-hosting",
+			Zone:    "ro",
+		},
+	}
+
+	for input, want := range tests {
+		got, err := ParseAddr(input)
+		if err != nil {
+			t.Errorf("parse failed '%s': %s", input, err)
+			continue
+		}
+
+		if want != got {
+			t.Errorf("want %+v, got %+v", want, got)
+		}
+	}
+}
+
+func TestParseAddrInvalid(t *testing.T) {
+	tests := []string{
+		"service.job.env",                 // missing fields
+		"service..env.product",            // zero-length field
+		"service.job.env.product.zone",    // zone too long
+		"service.job.env.product.zo.ro",   // too many fields
+		"ser/vice.job.env.product",        // invalid service
+		"service.j|ob.env.product.ro",     // invalid job
+		"service.job.e^nv.product.ro",     // invalid env
+		"service.job.env.pro_duct.ro",     // invalid product
+		"service.job.env.product.r_",      // invalid zone
+		"service.job.env.product.ro.test", // too many fields
+	}
+
+	for _, input := range tests {
+		_, err := ParseAddr(input)
+		if err == nil {
+			t.Errorf("parse of addr '%s' did not error", input)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	b, err := Render("harpoon", []Service{
+		{
+			Addr:  "http.stream.prod.goku.cz",
+			Port:  8001,
+			Check: &Check{HTTP: "http://localhost:8001/health", Interval: "5s"},
+		},
+		{
+			Addr:  "http.stream.prod.goku",
+			Port:  8000,
+			Addrs: map[string]string{"vpn": "10.8.0.1", "edge": "192.0.2.1"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("render failed: %s", err)
+	}
+
+	var cfg struct {
+		Services []consulService `json:"services"`
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		t.Fatalf("rendered config invalid: %s", err)
+	}
+
+	want := []consulService{
+		{
+			ID:   "goku-prod-stream-http-8000",
+			Name: "goku",
+			Tags: []string{
+				"glimpse:env=prod",
+				"glimpse:job=stream",
+				"glimpse:product=goku",
+				"glimpse:provider=harpoon",
+				"glimpse:service=http",
+				"glimpse:addr.edge=192.0.2.1",
+				"glimpse:addr.vpn=10.8.0.1",
+			},
+			Port: 8000,
+		},
+		{
+			ID:   "goku-prod-stream-http-8001",
+			Name: "goku",
+			Tags: []string{
+				"glimpse:env=prod",
+				"glimpse:job=stream",
+				"glimpse:product=goku",
+				"glimpse:provider=harpoon",
+				"glimpse:service=http",
+			},
+			Port:  8001,
+			Check: &Check{HTTP: "http://localhost:8001/health", Interval: "5s"},
+		},
+	}
+	if got := cfg.Services; !reflect.DeepEqual(want, got) {
+		t.Errorf("want\n%+v\ngot\n%+v", want, got)
+	}
+}
+
+func TestRenderInvalid(t *testing.T) {
+	for provider, services := range map[string][]Service{
+		"har_poon": []Service{},
+		"port": []Service{
+			{Addr: "http.stream.prod.goku", Port: 0},
+		},
+		"duplicate": []Service{
+			{Addr: "http.stream.prod.goku", Port: 8000},
+			{Addr: "http.walker.prod.goku", Port: 8000},
+		},
+		"addr": []Service{
+			{Addr: "http.stream.goku", Port: 8000},
+		},
+		"check": []Service{
+			{Addr: "http.stream.prod.goku", Port: 8000, Check: &Check{Script: "true"}},
+		},
+		"view": []Service{
+			{Addr: "http.stream.prod.goku", Port: 8000, Addrs: map[string]string{"ed_ge": "192.0.2.1"}},
+		},
+		"viewaddr": []Service{
+			{Addr: "http.stream.prod.goku", Port: 8000, Addrs: map[string]string{"edge": "192.0.2"}},
+		},
+		"ttl": []Service{
+			{Addr: "http.stream.prod.goku", Port: 8000, Check: &Check{TTL: "5s", Script: "true"}},
+		},
+	} {
+		_, err := Render(provider, services)
+		if err == nil {
+			t.Errorf("render of %s did not error", provider)
+		}
+	}
+}
+
+func TestParseService(t *testing.T) {
+	s, err := ParseService("http.stream.prod.goku:8000")
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+	if want, got := (Service{Addr: "http.stream.prod.goku", Port: 8000}), s; !reflect.DeepEqual(want, got) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+
+	for _, input := range []string{"http.stream.prod.goku", "http.stream.prod.goku:http"} {
+		if _, err := ParseService(input); err == nil {
+			t.Errorf("parse of '%s' did not error", input)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package provider
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultReloadCommand reloads the local consul-agent.
+	DefaultReloadCommand = "consul reload"
+
+	// DefaultDebounce is the time a reload is delayed to coalesce updates of
+	// several providers.
+	DefaultDebounce = time.Second
+
+	lockFile    = ".glimpse.lock"
+	pendingFile = ".glimpse.reload"
+)
+
+// Writer writes provider configurations into a consul-agent configuration
+// directory. Writes of all providers sharing the directory are serialised
+// with a file lock, and reloads requested within the debounce interval are
+// coalesced into one, even across processes.
+type Writer struct {
+	Dir      string
+	Debounce time.Duration
+	Reload   func() error
+}
+
+// NewWriter returns a Writer for the given directory reloading consul with
+// DefaultReloadCommand.
+func NewWriter(dir string) *Writer {
+	return &Writer{
+		Dir:      dir,
+		Debounce: DefaultDebounce,
+		Reload:   ReloadCommand(DefaultReloadCommand),
+	}
+}
+
+// ReloadCommand returns a reload function running the given command.
+func ReloadCommand(command string) func() error {
+	return func() error {
+		cmd := strings.Fields(command)
+		if len(cmd) == 0 {
+			return fmt.Errorf("empty reload command")
+		}
+
+		out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s failed: %s: %s", command, err, bytes.TrimSpace(out))
+		}
+
+		return nil
+	}
+}
+
+// Path returns the location of the configuration file of the given provider.
+func (w *Writer) Path(provider string) string {
+	return filepath.Join(w.Dir, fmt.Sprintf("glimpse-%s.json", provider))
+}
+
+// Update replaces the configuration of the provider with the given services
+// and reloads consul. It reports whether the configuration changed, an
+// unchanged configuration neither touches the file nor reloads consul, unless
+// a previous reload is still pending because it failed.
+func (w *Writer) Update(provider string, services []Service) (bool, error) {
+	cfg, err := Render(provider, services)
+	if err != nil {
+		return false, err
+	}
+
+	changed, err := w.write(w.Path(provider), cfg)
+	if err != nil {
+		return false, err
+	}
+	if !changed {
+		if !w.pending() {
+			return false, nil
+		}
+		return false, w.reload()
+	}
+
+	return true, w.reload()
+}
+
+func (w *Writer) write(path string, cfg []byte) (bool, error) {
+	unlock, err := w.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	old, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil && bytes.Equal(old, cfg) {
+		return false, nil
+	}
+
+	return true, writeFile(path, cfg)
+}
+
+// reload requests a reload, which is run after the debounce interval unless
+// another request superseded it in the meantime. The request stays pending
+// until the reload succeeded.
+func (w *Writer) reload() error {
+	var (
+		path  = filepath.Join(w.Dir, pendingFile)
+		nonce = []byte(fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano()))
+	)
+
+	unlock, err := w.lock()
+	if err != nil {
+		return err
+	}
+	err = writeFile(path, nonce)
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	time.Sleep(w.Debounce)
+
+	unlock, err = w.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	pending, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !bytes.Equal(pending, nonce) {
+		return nil
+	}
+
+	if err := w.Reload(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// pending reports whether a reload was requested but didn't succeed yet.
+func (w *Writer) pending() bool {
+	_, err := os.Stat(filepath.Join(w.Dir, pendingFile))
+	return err == nil
+}
+
+func (w *Writer) lock() (func(), error) {
+	f, err := os.OpenFile(filepath.Join(w.Dir, lockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock %s failed: %s", f.Name(), err)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// writeFile atomically replaces the file at path.
+func writeFile(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
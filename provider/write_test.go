@@ -0,0 +1,175 @@
+package provider
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWriterUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glimpse-provider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		reloads  int32
+		services = []Service{{Addr: "http.stream.prod.goku", Port: 8000}}
+		w        = &Writer{
+			Dir: dir,
+			Reload: func() error {
+				atomic.AddInt32(&reloads, 1)
+				return nil
+			},
+		}
+	)
+
+	changed, err := w.Update("harpoon", services)
+	if err != nil {
+		t.Fatalf("update failed: %s", err)
+	}
+	if want, got := true, changed; want != got {
+		t.Errorf("want changed %t, got %t", want, got)
+	}
+
+	want, err := Render("harpoon", services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "glimpse-harpoon.json"))
+	if err != nil {
+		t.Fatalf("config not written: %s", err)
+	}
+	if string(want) != string(got) {
+		t.Errorf("want config\n%s\ngot\n%s", want, got)
+	}
+
+	changed, err = w.Update("harpoon", services)
+	if err != nil {
+		t.Fatalf("update failed: %s", err)
+	}
+	if want, got := false, changed; want != got {
+		t.Errorf("want changed %t, got %t", want, got)
+	}
+	if want, got := int32(1), atomic.LoadInt32(&reloads); want != got {
+		t.Errorf("want %d reloads, got %d", want, got)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(files); want != got {
+		t.Errorf("want %d config files, got %d: %v", want, got, files)
+	}
+
+	if _, err := w.Update("harpoon", []Service{{Addr: "invalid", Port: 1}}); err == nil {
+		t.Error("want update with invalid services to fail")
+	}
+}
+
+func TestWriterDebounce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glimpse-provider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		reloads int32
+		wg      sync.WaitGroup
+	)
+
+	for i, p := range []string{"harpoon", "bazooka", "sniper"} {
+		wg.Add(1)
+
+		go func(i int, p string) {
+			defer wg.Done()
+
+			w := &Writer{
+				Dir:      dir,
+				Debounce: 50 * time.Millisecond,
+				Reload: func() error {
+					atomic.AddInt32(&reloads, 1)
+					return nil
+				},
+			}
+
+			_, err := w.Update(p, []Service{{Addr: "http.stream.prod.goku", Port: 8000 + i}})
+			if err != nil {
+				t.Errorf("update failed: %s", err)
+			}
+		}(i, p)
+	}
+
+	wg.Wait()
+
+	if want, got := int32(1), atomic.LoadInt32(&reloads); want != got {
+		t.Errorf("want %d reloads, got %d", want, got)
+	}
+}
+
+func TestWriterReloadRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glimpse-provider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		reloads  int32
+		services = []Service{{Addr: "http.stream.prod.goku", Port: 8000}}
+		w        = &Writer{
+			Dir: dir,
+			Reload: func() error {
+				if atomic.AddInt32(&reloads, 1) == 1 {
+					return errors.New("consul unavailable")
+				}
+				return nil
+			},
+		}
+	)
+
+	if _, err := w.Update("harpoon", services); err == nil {
+		t.Fatal("want update with failing reload to fail")
+	}
+	if !w.pending() {
+		t.Fatal("want reload pending after failure")
+	}
+
+	changed, err := w.Update("harpoon", services)
+	if err != nil {
+		t.Fatalf("update failed: %s", err)
+	}
+	if want, got := false, changed; want != got {
+		t.Errorf("want changed %t, got %t", want, got)
+	}
+	if want, got := int32(2), atomic.LoadInt32(&reloads); want != got {
+		t.Errorf("want %d reloads, got %d", want, got)
+	}
+	if w.pending() {
+		t.Error("want no reload pending after success")
+	}
+
+	if _, err := w.Update("harpoon", services); err != nil {
+		t.Fatalf("update failed: %s", err)
+	}
+	if want, got := int32(2), atomic.LoadInt32(&reloads); want != got {
+		t.Errorf("want %d reloads, got %d", want, got)
+	}
+}
+
+func TestReloadCommand(t *testing.T) {
+	if err := ReloadCommand("  true   --ignored ")(); err != nil {
+		t.Errorf("want command with surplus spaces to succeed, got %s", err)
+	}
+	if err := ReloadCommand(" ")(); err == nil {
+		t.Error("want empty command to fail")
+	}
+}